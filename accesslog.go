@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// The defaults of the access log rotation.
+const (
+	defaultAccessLogMaxSize    = 100 * 1024 * 1024
+	defaultAccessLogMaxBackups = 3
+)
+
+// rotatingFile is a file that is rotated when it grows over maxSize: the file
+// is renamed with a ".1" suffix, the previous ones are shifted to ".2" and so
+// on, keeping at most maxBackups of them.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	fh   *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAccessLogMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultAccessLogMaxBackups
+	}
+
+	f := rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *rotatingFile) open() error {
+	fh, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	f.fh, f.size = fh, fi.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.fh.Close(); err != nil {
+		return err
+	}
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		// the older files might not exist yet
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("rotating %s: %w", f.path, err)
+		}
+	}
+
+	n, err := f.fh.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fh.Close()
+}
+
+// newAccessLog opens the access log configured in conf.
+func newAccessLog(conf config.AccessLogConfig) (*rotatingFile, error) {
+	return newRotatingFile(conf.Path, conf.MaxSize, conf.MaxBackups)
+}
+
+// statusRecorder records the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.size += n
+	return n, err
+}
+
+// redactTokenParam returns the request URI of r with the value of the token
+// parameter, the management token, replaced with "REDACTED".
+func redactTokenParam(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("token") {
+		return r.RequestURI
+	}
+
+	u := *r.URL
+	query.Set("token", "REDACTED")
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// combinedLogLine formats a request in the Apache Combined Log Format.
+func combinedLogLine(r *http.Request, status, size int, t time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.Itoa(size)
+	}
+
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		host, user, t.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(r.Method+" "+redactTokenParam(r)+" "+r.Proto), status, bytes,
+		quote(r.Referer()), quote(r.UserAgent()))
+}
+
+// withAccessLog writes a line to w for each request served by next.
+func withAccessLog(w io.Writer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		_, _ = io.WriteString(w, combinedLogLine(r, rec.status, rec.size, start))
+	})
+}
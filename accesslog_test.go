@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCombinedLogLine(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/data/report/?x=1", nil)
+	req.RemoteAddr = "192.0.2.10:41234"
+	req.Header.Set("User-Agent", "GW1000_V1.7.3")
+
+	ts := time.Date(2024, 6, 16, 16, 32, 10, 0, time.FixedZone("", 2*60*60))
+	want := `192.0.2.10 - - [16/Jun/2024:16:32:10 +0200] "POST /data/report/?x=1 HTTP/1.1" 200 12 "-" "GW1000_V1.7.3"` + "\n"
+	if got := combinedLogLine(req, http.StatusOK, 12, ts); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("Referer", "https://example.com/")
+	want = `192.0.2.10 - admin [16/Jun/2024:16:32:10 +0200] "POST /data/report/?x=1 HTTP/1.1" 404 - "https://example.com/" "GW1000_V1.7.3"` + "\n"
+	if got := combinedLogLine(req, http.StatusNotFound, 0, ts); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the management token is not logged
+	req = httptest.NewRequest(http.MethodGet, "/metrics?token=t0k3n", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	want = `192.0.2.10 - - [16/Jun/2024:16:32:10 +0200] "GET /metrics?token=REDACTED HTTP/1.1" 200 12 "-" "-"` + "\n"
+	if got := combinedLogLine(req, http.StatusOK, 12, ts); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWithAccessLog(t *testing.T) {
+	var log strings.Builder
+	handler := withAccessLog(&log, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stations", nil))
+
+	if line := log.String(); !strings.Contains(line, `"GET /stations HTTP/1.1" 418 15 `) {
+		t.Errorf("unexpected access log line %q", line)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, got %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// handleAPI registers a read-only API endpoint on mux, answering GET requests
+// and CORS preflight requests.
+func handleAPI(mux *http.ServeMux, path string, h http.Handler, allowedOrigins []string) {
+	h = withCORS(allowedOrigins, h)
+	mux.Handle("GET "+path, h)
+	mux.Handle("OPTIONS "+path, h)
+}
+
+// withCORS sets the CORS headers for requests coming from one of the allowed
+// origins and answers preflight requests; no headers are set when allowedOrigins
+// is empty.
+func withCORS(allowedOrigins []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && (slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin))
+
+		if allowed {
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		}
+
+		if r.Method == http.MethodOptions {
+			if allowed {
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodOptions}, ", "))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiError is the JSON body of the error responses.
+type apiError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+
+	// Fields lists the invalid fields of a report, when known.
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// writeJSONError replies to the request with the given status code and a JSON
+// body describing the error.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSONFieldErrors(w, code, msg, nil)
+}
+
+// writeJSONFieldErrors is like writeJSONError, also listing the invalid fields.
+func writeJSONFieldErrors(w http.ResponseWriter, code int, msg string, fields []fieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(apiError{Error: msg, Code: code, Fields: fields})
+}
+
+// The formats of the read API responses.
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// negotiateFormat returns the response format preferred by the Accept header
+// of r, JSON or CSV: the one with the highest quality and, on ties, the most
+// specific media range. It defaults to JSON when the header is missing or
+// accepts neither.
+func negotiateFormat(r *http.Request) string {
+	format, bestQ, bestSpecificity := formatJSON, 0.0, -1
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		var candidate string
+		var specificity int
+		switch mediaType {
+		case "application/json":
+			candidate, specificity = formatJSON, 2
+		case "text/csv":
+			candidate, specificity = formatCSV, 2
+		case "application/*":
+			candidate, specificity = formatJSON, 1
+		case "text/*":
+			candidate, specificity = formatCSV, 1
+		case "*/*":
+			candidate, specificity = formatJSON, 0
+		default:
+			continue
+		}
+
+		if q > bestQ || (q == bestQ && specificity > bestSpecificity) {
+			format, bestQ, bestSpecificity = candidate, q, specificity
+		}
+	}
+
+	return format
+}
+
+// csvTable is implemented by the read API responses that can be encoded as CSV.
+type csvTable interface {
+	CSV() (header []string, rows [][]string)
+}
+
+// writeAPIResponse encodes v in the format negotiated with the client.
+func writeAPIResponse(w http.ResponseWriter, r *http.Request, logger *slog.Logger, v csvTable) {
+	w.Header().Add("Vary", "Accept")
+
+	var err error
+	if negotiateFormat(r) == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		header, rows := v.CSV()
+		cw := csv.NewWriter(w)
+		if err = cw.Write(header); err == nil {
+			err = cw.WriteAll(rows)
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(v)
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error("error encoding API response", "path", r.URL.Path, "err", err)
+	}
+}
+
+// The units of the values returned by the read API, by field name, added to
+// the JSON responses when http.api_units is set; the rain is in the unit of
+// the database, see withRainUnit.
+var (
+	readingUnits = map[string]string{
+		"temperature_outdoor": "°C",
+		"humidity_outdoor":    "%",
+		"pressure_relative":   "hPa",
+		"wind_speed":          "m/s",
+		"wind_gust":           "m/s",
+		"wind_direction":      "°",
+		"rain_rate":           "mm/h",
+		"daily_rain":          "mm",
+	}
+	dailyUnits = map[string]string{
+		"temperature_min": "°C",
+		"temperature_max": "°C",
+		"temperature_avg": "°C",
+		"wind_gust_max":   "m/s",
+		"rainfall":        "mm",
+	}
+	degreeDaysUnits = map[string]string{
+		"heating_degree_days": "°C·d",
+		"cooling_degree_days": "°C·d",
+	}
+)
+
+// withRainUnit returns units with the rain in inches when rainUnit is "in".
+func withRainUnit(units map[string]string, rainUnit string) map[string]string {
+	if rainUnit != "in" {
+		return units
+	}
+
+	result := maps.Clone(units)
+	for field, unit := range result {
+		switch unit {
+		case "mm":
+			result[field] = "in"
+		case "mm/h":
+			result[field] = "in/h"
+		}
+	}
+	return result
+}
+
+// formatOptionalFloat formats v for a CSV field; nil values are empty.
+func formatOptionalFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
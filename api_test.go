@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		origins    []string
+		method     string
+		origin     string
+		wantStatus int
+		wantOrigin string
+	}{
+		{"disabled", nil, http.MethodGet, "https://example.com", http.StatusOK, ""},
+		{"allowed", []string{"https://example.com"}, http.MethodGet, "https://example.com", http.StatusOK, "https://example.com"},
+		{"not allowed", []string{"https://example.com"}, http.MethodGet, "https://evil.example", http.StatusOK, ""},
+		{"wildcard", []string{"*"}, http.MethodGet, "https://example.com", http.StatusOK, "https://example.com"},
+		{"preflight", []string{"https://example.com"}, http.MethodOptions, "https://example.com", http.StatusNoContent, "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			handleAPI(mux, "/stations", ok, tt.origins)
+
+			req := httptest.NewRequest(tt.method, "/stations", nil)
+			req.Header.Set("Origin", tt.origin)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.wantOrigin)
+			}
+		})
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", formatJSON},
+		{"application/json", formatJSON},
+		{"text/csv", formatCSV},
+		{"*/*", formatJSON},
+		{"text/csv, */*", formatCSV},
+		{"text/csv;q=0.5, application/json", formatJSON},
+		{"application/json;q=0.5, text/csv;q=0.9", formatCSV},
+		{"text/*", formatCSV},
+		{"text/html", formatJSON},
+		{"text/csv;q=0", formatJSON},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		if got := negotiateFormat(req); got != tt.want {
+			t.Errorf("Accept %q: expected %s, got %s", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func TestStationsHandlerFormats(t *testing.T) {
+	tracker := newStationTracker(nil, 0)
+	tracker.Seen(&WeatherData{Station: "abc", Model: "GW2000A", Interval: time.Minute}, time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC))
+	handler := makeStationsHandler(tracker, "", false, false)
+
+	tests := []struct {
+		accept          string
+		wantContentType string
+	}{
+		{"application/json", "application/json"},
+		{"text/csv", "text/csv; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+		req.Header.Set("Accept", tt.accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+			t.Errorf("Accept %q: expected Content-Type %q, got %q", tt.accept, tt.wantContentType, got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("Accept %q: expected Vary: Accept, got %q", tt.accept, got)
+		}
+
+		switch tt.wantContentType {
+		case "application/json":
+			var list []stationStatus
+			if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 1 || list[0].Station != "abc" {
+				t.Errorf("unexpected stations: %+v", list)
+			}
+		default:
+			records, err := csv.NewReader(rec.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 2 || records[0][0] != "station" || records[1][0] != "abc" || records[1][2] != "GW2000A" {
+				t.Errorf("unexpected CSV: %v", records)
+			}
+		}
+	}
+}
+
+func TestStationsHandlerUnits(t *testing.T) {
+	tracker := newStationTracker(nil, 0)
+	tracker.Seen(&WeatherData{Station: "abc", Interval: time.Minute}, time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC))
+
+	for _, units := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+		rec := httptest.NewRecorder()
+		makeStationsHandler(tracker, "", units, false).ServeHTTP(rec, req)
+
+		var list []stationStatus
+		if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].LastReading == nil {
+			t.Fatalf("unexpected stations: %+v", list)
+		}
+
+		got := list[0].LastReading.Units
+		if !units && got != nil {
+			t.Errorf("expected no units, got %v", got)
+		}
+		if units && (got["temperature_outdoor"] != "°C" || got["pressure_relative"] != "hPa" || got["wind_speed"] != "m/s" || got["daily_rain"] != "mm") {
+			t.Errorf("unexpected units: %v", got)
+		}
+	}
+}
+
+func TestStationsHandlerRainInches(t *testing.T) {
+	sink := &recordingSink{}
+	conf := config.Config{Database: config.DatabaseConfig{RainUnit: "in"}}
+	in := newTestIngester(t, conf, sink)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("dailyrainin", "1.0")
+
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd.DailyRain != 1.0 {
+		t.Fatalf("expected 1in of daily rain to be stored, got %v", wd.DailyRain)
+	}
+
+	// the tracker keeps its own copy, in mm, converted by the handler
+	req := httptest.NewRequest(http.MethodGet, "/stations", nil)
+	rec := httptest.NewRecorder()
+	makeStationsHandler(in.stations, "in", true, false).ServeHTTP(rec, req)
+
+	var list []stationStatus
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].LastReading == nil {
+		t.Fatalf("unexpected stations: %+v", list)
+	}
+	if r := list[0].LastReading; math.Abs(r.DailyRain-1.0) > 1e-9 || r.Units["daily_rain"] != "in" || r.Units["rain_rate"] != "in/h" {
+		t.Errorf("expected 1in of daily rain, got %v %s", r.DailyRain, r.Units["daily_rain"])
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/parquet-go/parquet-go"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// archiveRow is a row of the weather data table, as written to the Parquet archive.
+type archiveRow struct {
+	Time               time.Time `db:"time" parquet:"time"`
+	Station            string    `db:"station" parquet:"station"`
+	AbsolutePressure   *float64  `db:"pressure_absolute" parquet:"pressure_absolute"`
+	RelativePressure   *float64  `db:"pressure_relative" parquet:"pressure_relative"`
+	Frequency          *string   `db:"frequency" parquet:"frequency"`
+	Heap               *int32    `db:"heap" parquet:"heap"`
+	DailyRain          *float64  `db:"daily_rain" parquet:"daily_rain"`
+	EventRain          *float64  `db:"event_rain" parquet:"event_rain"`
+	HourlyRain         *float64  `db:"hourly_rain" parquet:"hourly_rain"`
+	MonthlyRain        *float64  `db:"monthly_rain" parquet:"monthly_rain"`
+	RainRate           *float64  `db:"rain_rate" parquet:"rain_rate"`
+	TotalRain          *float64  `db:"total_rain" parquet:"total_rain"`
+	WeeklyRain         *float64  `db:"weekly_rain" parquet:"weekly_rain"`
+	YearlyRain         *float64  `db:"yearly_rain" parquet:"yearly_rain"`
+	OutdoorHumidity    *int32    `db:"humidity_outdoor" parquet:"humidity_outdoor"`
+	IndoorHumidity     *int32    `db:"humidity_indoor" parquet:"humidity_indoor"`
+	Interval           *int32    `db:"interval" parquet:"interval"`
+	Model              *string   `db:"model" parquet:"model"`
+	Runtime            *int32    `db:"runtime" parquet:"runtime"`
+	SolarRadiation     *float64  `db:"solar_radiation" parquet:"solar_radiation"`
+	StationType        *string   `db:"station_type" parquet:"station_type"`
+	OutdoorTemperature *float64  `db:"temperature_outdoor" parquet:"temperature_outdoor"`
+	IndoorTemperature  *float64  `db:"temperature_indoor" parquet:"temperature_indoor"`
+	UV                 *float64  `db:"uv" parquet:"uv"`
+	BatteryLevel       *float64  `db:"battery" parquet:"battery"`
+	MaxDailyGust       *float64  `db:"wind_max_daily_gust" parquet:"wind_max_daily_gust"`
+	WindDirection      *int32    `db:"wind_direction" parquet:"wind_direction"`
+	WindGust           *float64  `db:"wind_gust" parquet:"wind_gust"`
+	WindSpeed          *float64  `db:"wind_speed" parquet:"wind_speed"`
+}
+
+// archiveColumns is the list of columns that are copied to the archive.
+var archiveColumns = func() []string {
+	var names []string
+	for _, col := range parseColumns(reflect.TypeOf(archiveRow{})) {
+		names = append(names, col.Name)
+	}
+	return names
+}()
+
+// archiveSelectList returns the select list of the archive query, reading
+// the columns with columnExpr.
+func archiveSelectList(db config.DatabaseConfig) string {
+	items := make([]string, len(archiveColumns))
+	for i, name := range archiveColumns {
+		items[i] = name
+		if expr := columnExpr(db, name); expr != name {
+			items[i] = expr + " AS " + name
+		}
+	}
+
+	return strings.Join(items, ",")
+}
+
+// monthStart returns the beginning of the month t falls in.
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// archive moves the rows older than the configured cutoff to Parquet files, one
+// per month, optionally deleting them from the database once written.
+func archive(ctx context.Context, logger *slog.Logger, pool *pgxpool.Pool, db config.DatabaseConfig, conf config.ArchiveConfig, now time.Time) error {
+	if conf.Dir == "" || conf.OlderThan <= 0 {
+		return fmt.Errorf("archive.dir and archive.older_than must be set")
+	}
+
+	cutoff := now.UTC().Add(-conf.OlderThan)
+
+	var oldest *time.Time
+	if err := pool.QueryRow(ctx, fmt.Sprintf("SELECT min(%s) FROM %s WHERE time < $1", columnExpr(db, "time"), db.Table),
+		timeBound(cutoff, db.TimeStorage)).Scan(&oldest); err != nil {
+		return fmt.Errorf("finding oldest row: %w", err)
+	}
+	if oldest == nil {
+		logger.Info("nothing to archive", "cutoff", cutoff)
+		return nil
+	}
+
+	for start := monthStart(*oldest); start.Before(cutoff); start = start.AddDate(0, 1, 0) {
+		end := start.AddDate(0, 1, 0)
+		if end.After(cutoff) {
+			end = cutoff
+		}
+
+		if err := archiveRange(ctx, logger, pool, db, conf, start, end, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func archiveRange(ctx context.Context, logger *slog.Logger, pool *pgxpool.Pool, db config.DatabaseConfig, conf config.ArchiveConfig, start, end, now time.Time) error {
+	table := db.Table
+	lower, upper := timeBound(start, db.TimeStorage), timeBound(end, db.TimeStorage)
+	rows, err := pool.Query(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE time >= $1 AND time < $2 ORDER BY time", archiveSelectList(db), table),
+		lower, upper)
+	if err != nil {
+		return fmt.Errorf("querying rows to archive: %w", err)
+	}
+
+	records, err := pgx.CollectRows(rows, pgx.RowToStructByName[archiveRow])
+	if err != nil {
+		return fmt.Errorf("reading rows to archive: %w", err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	filename := filepath.Join(conf.Dir, start.Format("2006-01"),
+		fmt.Sprintf("%s-%s.parquet", table, now.UTC().Format("20060102T150405")))
+	if err := writeArchiveFile(filename, records); err != nil {
+		return err
+	}
+	logger.Info("archived rows", "file", filename, "rows", len(records), "from", start, "to", end)
+
+	if !conf.Delete {
+		return nil
+	}
+
+	tag, err := pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE time >= $1 AND time < $2", table), lower, upper)
+	if err != nil {
+		return fmt.Errorf("deleting archived rows: %w", err)
+	}
+	logger.Info("deleted archived rows", "rows", tag.RowsAffected(), "from", start, "to", end)
+
+	return nil
+}
+
+// writeArchiveFile writes records to a Parquet file; the file is first written
+// to a temporary name and then renamed, so that partial files are never left behind.
+func writeArchiveFile(filename string, records []archiveRow) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+
+	fh, err := os.CreateTemp(filepath.Dir(filename), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+
+	if err := parquet.Write(fh, records); err != nil {
+		fh.Close()
+		return fmt.Errorf("writing parquet file: %w", err)
+	}
+
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fh.Name(), filename)
+}
+
+func runArchive(logger *slog.Logger, conf config.Config) error {
+	ctx := context.Background()
+
+	pool, err := newPool(ctx, conf.Database)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	return archive(ctx, logger, pool, conf.Database, conf.Archive, time.Now())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestWriteArchiveFile(t *testing.T) {
+	temp := 19.9
+	humidity := int32(47)
+	records := []archiveRow{
+		{
+			Time:               time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC),
+			Station:            "station",
+			OutdoorTemperature: &temp,
+			OutdoorHumidity:    &humidity,
+		},
+		{
+			Time:    time.Date(2024, 6, 16, 16, 33, 8, 0, time.UTC),
+			Station: "station",
+		},
+	}
+
+	filename := filepath.Join(t.TempDir(), "2024-06", "weather.parquet")
+	if err := writeArchiveFile(filename, records); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parquet.ReadFile[archiveRow](filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(records) {
+		t.Fatalf("expected %d rows, got %d", len(records), len(got))
+	}
+	if !got[0].Time.Equal(records[0].Time) || got[0].Station != "station" {
+		t.Errorf("unexpected first row: %+v", got[0])
+	}
+	if got[0].OutdoorTemperature == nil || *got[0].OutdoorTemperature != temp {
+		t.Errorf("expected temperature %v, got %v", temp, got[0].OutdoorTemperature)
+	}
+	if got[1].OutdoorTemperature != nil {
+		t.Errorf("expected NULL temperature, got %v", *got[1].OutdoorTemperature)
+	}
+}
+
+func TestArchiveColumns(t *testing.T) {
+	// the archive must contain all the non-optional columns
+	var want []string
+	for _, col := range weatherDataColumns {
+		if !col.OmitEmpty {
+			want = append(want, col.Name)
+		}
+	}
+
+	if len(archiveColumns) != len(want) {
+		t.Fatalf("expected columns %v, got %v", want, archiveColumns)
+	}
+	for i := range want {
+		if archiveColumns[i] != want[i] {
+			t.Errorf("column %d: expected %s, got %s", i, want[i], archiveColumns[i])
+		}
+	}
+}
+
+func TestArchiveSelectList(t *testing.T) {
+	list := archiveSelectList(config.DatabaseConfig{IgnoreFields: []string{"heap"}})
+	if !strings.Contains(list, "NULL::integer AS heap,") {
+		t.Errorf("expected the ignored column to be selected as NULL: %s", list)
+	}
+	if !strings.HasPrefix(list, "time,station,") {
+		t.Errorf("unexpected select list: %s", list)
+	}
+
+	list = archiveSelectList(config.DatabaseConfig{RainJSONB: true})
+	if !strings.Contains(list, "(rain->>'daily_rain')::double precision AS daily_rain,") {
+		t.Errorf("expected the rain columns to be extracted from the jsonb column: %s", list)
+	}
+
+	list = archiveSelectList(config.DatabaseConfig{TimeStorage: "epoch_millis"})
+	if !strings.HasPrefix(list, "to_timestamp(time / 1000.0) AS time,station,") {
+		t.Errorf("expected the time to be converted from the Unix time: %s", list)
+	}
+}
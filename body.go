@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingBody counts the bytes read from a request body, to tell how much of
+// a truncated body was received; when raw is set, it also keeps a copy of them.
+type countingBody struct {
+	io.ReadCloser
+	n   int64
+	raw *bytes.Buffer
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.raw != nil {
+		b.raw.Write(p[:n])
+	}
+	return n, err
+}
+
+type rawBodyKey struct{}
+
+// rawBodyFromContext returns the raw body of the request ctx belongs to, if it
+// was kept.
+func rawBodyFromContext(ctx context.Context) (string, bool) {
+	raw, ok := ctx.Value(rawBodyKey{}).(string)
+	return raw, ok
+}
+
+// redactPasskey replaces the value of the PASSKEY field of the URL-encoded
+// body with "REDACTED", leaving the rest of it untouched.
+func redactPasskey(body string) string {
+	fields := strings.Split(body, "&")
+	for i, field := range fields {
+		key, _, _ := strings.Cut(field, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == "PASSKEY" {
+			fields[i] = key + "=REDACTED"
+		}
+	}
+
+	return strings.Join(fields, "&")
+}
+
+// reportBodyError logs an error reading the body of r and counts it in the
+// errors metric. Truncated bodies, common with stations on a weak WiFi
+// connection, are counted separately from the malformed ones.
+func reportBodyError(logger *slog.Logger, r *http.Request, body *countingBody, err error) {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		logger.Warn("station sent a truncated body", "received", body.n, "content_length", r.ContentLength, "err", err)
+		reqErrors.With(prometheus.Labels{"error_type": "truncated"}).Inc()
+		return
+	}
+
+	logger.Warn("error reading form data", "err", err)
+	reqErrors.With(prometheus.Labels{"error_type": "parser"}).Inc()
+}
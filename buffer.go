@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// bufferRetryInterval is how often bufferedSink tries to write the buffered
+// readings.
+const bufferRetryInterval = 30 * time.Second
+
+// bufferedSink keeps the readings that couldn't be written to the wrapped
+// sink, e.g. during a database outage, and writes them once it recovers. Up
+// to maxMemory readings are kept in memory, the others are spilled to a file
+// as JSON lines; the spill file survives restarts, and is written back on
+// startup.
+type bufferedSink struct {
+	logger    *slog.Logger
+	next      MetricsSink
+	maxMemory int
+
+	// spillPath is where new readings are spilled; during a flush the file
+	// is renamed to replayPath, so that the spilling can continue.
+	spillPath  string
+	replayPath string
+
+	mu        sync.Mutex
+	queue     []*WeatherData
+	spilled   bool
+	replaying bool
+	closed    bool // once Run returned, the readings are spilled directly
+}
+
+func newBufferedSink(logger *slog.Logger, next MetricsSink, conf config.BufferConfig) (*bufferedSink, error) {
+	s := bufferedSink{
+		logger:    logger,
+		next:      next,
+		maxMemory: conf.MaxMemory,
+	}
+
+	if conf.SpillDir != "" {
+		if err := os.MkdirAll(conf.SpillDir, 0o700); err != nil {
+			return nil, err
+		}
+		s.spillPath = filepath.Join(conf.SpillDir, "spill.jsonl")
+		s.replayPath = filepath.Join(conf.SpillDir, "spill-replay.jsonl")
+
+		// readings spilled before a restart
+		s.spilled = fileExists(s.spillPath)
+		s.replaying = fileExists(s.replayPath)
+	}
+
+	return &s, nil
+}
+
+// isOutage reports whether err, returned by a write, could go away by writing
+// again later, e.g. a connection error or a database restart; the errors
+// reported by PostgreSQL for the reading itself, like a unique_violation or a
+// numeric overflow, would fail again, and aren't buffered.
+func isOutage(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return true
+	}
+
+	switch pgErr.Code[:2] {
+	case "08", // connection exception
+		"40", // transaction rollback, e.g. a deadlock
+		"53", // insufficient resources
+		"57", // operator intervention, e.g. a shutdown
+		"58": // system error
+		return true
+	}
+
+	return false
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Write writes wd to the wrapped sink, buffering it if that fails because of
+// an outage; while there are buffered readings, new ones are buffered
+// directly, without waiting for a database that is probably still down.
+func (s *bufferedSink) Write(ctx context.Context, wd *WeatherData) error {
+	s.mu.Lock()
+	backlog := len(s.queue) > 0 || s.spilled || s.replaying
+	s.mu.Unlock()
+
+	if !backlog {
+		err := s.next.Write(ctx, wd)
+		if err == nil || errors.Is(err, errSinkBusy) || !isOutage(err) {
+			return err
+		}
+		s.logger.Warn("error writing data, buffering it", "station", wd.Station, "err", err)
+	}
+
+	return s.buffer(wd)
+}
+
+func (s *bufferedSink) buffer(wd *WeatherData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) < s.maxMemory && !s.closed {
+		s.queue = append(s.queue, wd)
+		return nil
+	}
+
+	if s.spillPath == "" {
+		return fmt.Errorf("write buffer full (%d readings)", s.maxMemory)
+	}
+
+	return s.spill([]*WeatherData{wd})
+}
+
+// spilledReading is a line of the spill file: the reading, without the
+// passkey, which is never written to disk, and with the columns missing from
+// its report, so that a merge doesn't overwrite them with zeros.
+type spilledReading struct {
+	WeatherData
+	Unreported []string `json:"unreported,omitempty"`
+}
+
+func newSpilledReading(wd *WeatherData) spilledReading {
+	r := spilledReading{WeatherData: *wd}
+	r.Passkey = ""
+	for column := range wd.unreported {
+		r.Unreported = append(r.Unreported, column)
+	}
+	slices.Sort(r.Unreported)
+
+	return r
+}
+
+// reading returns the spilled reading.
+func (r *spilledReading) reading() *WeatherData {
+	wd := r.WeatherData
+	if len(r.Unreported) > 0 {
+		wd.unreported = make(map[string]bool, len(r.Unreported))
+		for _, column := range r.Unreported {
+			wd.unreported[column] = true
+		}
+	}
+
+	return &wd
+}
+
+// spill appends readings to the spill file; s.mu must be held.
+func (s *bufferedSink) spill(readings []*WeatherData) error {
+	fh, err := os.OpenFile(s.spillPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("spilling data: %w", err)
+	}
+
+	w := bufio.NewWriter(fh)
+	for _, wd := range readings {
+		line, err := json.Marshal(newSpilledReading(wd))
+		if err != nil {
+			fh.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return fmt.Errorf("spilling data: %w", err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("spilling data: %w", err)
+	}
+	s.spilled = true
+
+	return nil
+}
+
+// Run periodically flushes the buffered readings until ctx is done, then
+// spills the readings left in memory, so that they are written after a
+// restart.
+func (s *bufferedSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(bufferRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.close()
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				s.logger.Warn("error writing buffered data", "err", err)
+			}
+		}
+	}
+}
+
+// close spills the readings in memory, and the ones buffered from now on; they
+// are lost without a spill directory.
+func (s *bufferedSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if len(s.queue) == 0 {
+		return
+	}
+
+	if s.spillPath == "" {
+		s.logger.Error("dropping the buffered data on shutdown, no spill directory configured", "readings", len(s.queue))
+		s.queue = nil
+		return
+	}
+	if err := s.spill(s.queue); err != nil {
+		s.logger.Error("error spilling the buffered data on shutdown", "readings", len(s.queue), "err", err)
+		return
+	}
+	s.logger.Info("spilled the buffered data on shutdown", "readings", len(s.queue))
+	s.queue = nil
+}
+
+// Flush writes the buffered readings to the wrapped sink, first those in
+// memory and then the spilled ones, stopping at the first outage; the readings
+// failing for other reasons are logged and dropped, so that they don't hold
+// back the others.
+func (s *bufferedSink) Flush(ctx context.Context) error {
+	var flushed int
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			break
+		}
+		wd := s.queue[0]
+		s.mu.Unlock()
+
+		switch err := s.next.Write(ctx, wd); {
+		case err == nil:
+			flushed++
+		case isOutage(err):
+			return err
+		default:
+			s.logger.Error("dropping buffered data that can't be written", "station", wd.Station, "time", wd.Timestamp, "err", err)
+		}
+
+		s.mu.Lock()
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+	}
+
+	if flushed > 0 {
+		s.logger.Info("wrote buffered data", "readings", flushed)
+	}
+
+	return s.flushSpilled(ctx)
+}
+
+func (s *bufferedSink) flushSpilled(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.replaying && s.spilled {
+		if err := os.Rename(s.spillPath, s.replayPath); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.spilled = false
+		s.replaying = true
+	}
+	replaying := s.replaying
+	s.mu.Unlock()
+
+	if !replaying {
+		return nil
+	}
+
+	lines, err := readLines(s.replayPath)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range lines {
+		var spilled spilledReading
+		if err := json.Unmarshal(line, &spilled); err != nil {
+			s.logger.Error("skipping invalid spilled data", "err", err)
+			continue
+		}
+		wd := spilled.reading()
+
+		err := s.next.Write(ctx, wd)
+		switch {
+		case err == nil:
+		case isOutage(err):
+			// keep the readings not written yet for the next attempt
+			if werr := writeLines(s.replayPath, lines[i:]); werr != nil {
+				return errors.Join(err, werr)
+			}
+			return err
+		default:
+			s.logger.Error("dropping spilled data that can't be written", "station", wd.Station, "time", wd.Timestamp, "err", err)
+		}
+	}
+
+	if err := os.Remove(s.replayPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	s.mu.Lock()
+	s.replaying = false
+	s.mu.Unlock()
+	s.logger.Info("wrote spilled data", "readings", len(lines))
+
+	return nil
+}
+
+func readLines(path string) ([][]byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+
+	return lines, scanner.Err()
+}
+
+// writeLines atomically replaces the file at path with lines.
+func writeLines(path string, lines [][]byte) error {
+	tmp := path + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fh)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
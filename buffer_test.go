@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestBufferedSink(t *testing.T) {
+	dir := t.TempDir()
+	next := &recordingSink{err: errors.New("database is down")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := newBufferedSink(logger, next, config.BufferConfig{MaxMemory: 2, SpillDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	start := time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		wd := WeatherData{Station: "station", Timestamp: start.Add(time.Duration(i) * time.Minute)}
+		if err := s.Write(ctx, &wd); err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+	}
+
+	if len(s.queue) != 2 || !fileExists(filepath.Join(dir, "spill.jsonl")) {
+		t.Fatalf("expected 2 readings in memory and the others spilled, got %d in memory", len(s.queue))
+	}
+
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("expected flushing to fail while the database is down")
+	}
+
+	next.mu.Lock()
+	next.err = nil
+	next.mu.Unlock()
+
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	written := next.Written()
+	if len(written) != 5 {
+		t.Fatalf("expected 5 written readings, got %d", len(written))
+	}
+	seen := make(map[time.Time]bool)
+	for _, wd := range written {
+		seen[wd.Timestamp] = true
+	}
+	for i := 0; i < 5; i++ {
+		if ts := start.Add(time.Duration(i) * time.Minute); !seen[ts] {
+			t.Errorf("reading at %s was not written", ts)
+		}
+	}
+
+	if fileExists(filepath.Join(dir, "spill.jsonl")) || fileExists(filepath.Join(dir, "spill-replay.jsonl")) {
+		t.Error("expected the spill files to be removed")
+	}
+
+	// with the backlog cleared, readings are written directly
+	if err := s.Write(ctx, &WeatherData{Station: "station", Timestamp: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(next.Written()); n != 6 {
+		t.Errorf("expected 6 written readings, got %d", n)
+	}
+}
+
+func TestBufferedSinkFull(t *testing.T) {
+	next := &recordingSink{err: errors.New("database is down")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := newBufferedSink(logger, next, config.BufferConfig{MaxMemory: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := s.Write(ctx, &WeatherData{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, &WeatherData{}); err == nil {
+		t.Error("expected an error when the buffer is full and spilling is disabled")
+	}
+}
+
+func TestBufferedSinkShutdown(t *testing.T) {
+	dir := t.TempDir()
+	next := &recordingSink{err: errors.New("database is down")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := newBufferedSink(logger, next, config.BufferConfig{MaxMemory: 10, SpillDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Write(ctx, &WeatherData{Station: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the readings in memory are spilled on shutdown, and so are the ones
+	// buffered afterwards
+	cancel()
+	s.Run(ctx)
+	if err := s.Write(context.Background(), &WeatherData{Station: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.queue) != 0 {
+		t.Errorf("expected no readings left in memory, got %d", len(s.queue))
+	}
+
+	lines, err := readLines(filepath.Join(dir, "spill.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Errorf("expected 2 spilled readings, got %d", len(lines))
+	}
+}
+
+// duplicateSink is a recordingSink failing with a unique_violation for the
+// readings of station duplicate, once the database is up.
+type duplicateSink struct {
+	*recordingSink
+	duplicate string
+}
+
+func (s duplicateSink) Write(ctx context.Context, wd *WeatherData) error {
+	s.mu.Lock()
+	up := s.err == nil
+	s.mu.Unlock()
+
+	if up && wd.Station == s.duplicate {
+		return &pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint"}
+	}
+	return s.recordingSink.Write(ctx, wd)
+}
+
+func TestBufferedSinkPermanentError(t *testing.T) {
+	dir := t.TempDir()
+	next := duplicateSink{recordingSink: &recordingSink{err: errors.New("database is down")}, duplicate: "dup"}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := newBufferedSink(logger, next, config.BufferConfig{MaxMemory: 1, SpillDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the duplicate is buffered during the outage, in memory and spilled
+	ctx := context.Background()
+	for _, station := range []string{"dup", "a", "dup", "b"} {
+		if err := s.Write(ctx, &WeatherData{Station: station}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next.mu.Lock()
+	next.err = nil
+	next.mu.Unlock()
+
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(next.Written()); n != 2 {
+		t.Fatalf("expected the 2 other readings to be written, got %d", n)
+	}
+
+	// the backlog is cleared, and a duplicate is rejected without buffering
+	if err := s.Write(ctx, &WeatherData{Station: "dup"}); err == nil {
+		t.Error("expected the unique_violation to be returned")
+	}
+	if err := s.Write(ctx, &WeatherData{Station: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(next.Written()); n != 3 {
+		t.Errorf("expected the new reading to be written directly, got %d written", n)
+	}
+	if len(s.queue) != 0 || s.spilled || s.replaying {
+		t.Error("expected an empty buffer")
+	}
+}
+
+func TestBufferedSinkSpilledReading(t *testing.T) {
+	dir := t.TempDir()
+	next := &recordingSink{err: errors.New("database is down")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s, err := newBufferedSink(logger, next, config.BufferConfig{SpillDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	wd := &WeatherData{
+		Station:    "station",
+		Passkey:    "LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI",
+		unreported: map[string]bool{"pressure_relative": true, "temperature_indoor": true},
+	}
+	if err := s.Write(ctx, wd); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := readLines(filepath.Join(dir, "spill.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || strings.Contains(string(lines[0]), wd.Passkey) {
+		t.Fatalf("expected the reading to be spilled without the passkey, got %q", lines)
+	}
+
+	next.mu.Lock()
+	next.err = nil
+	next.mu.Unlock()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	written := next.Written()
+	if len(written) != 1 {
+		t.Fatalf("expected 1 written reading, got %d", len(written))
+	}
+	if got := written[0]; got.Station != "station" || !maps.Equal(got.unreported, wd.unreported) {
+		t.Errorf("expected the unreported columns to be kept, got %v", got.unreported)
+	}
+}
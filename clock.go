@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+// Clock is the source of the current time; it allows replacing the system
+// clock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is a Clock that returns the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
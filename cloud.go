@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+const (
+	defaultCloudURL = "https://api.ecowitt.net/api/v3/device/history"
+
+	// cloudCycle is the resolution of the historical data we request; the
+	// API allows querying at most one day of 5 minutes data per request.
+	cloudCycle    = "5min"
+	cloudInterval = 5 * time.Minute
+
+	// cloudMaxRetries is how many times a request is retried when the API
+	// reports that we're sending requests too often.
+	cloudMaxRetries = 5
+)
+
+// cloudSeries is a series of values returned by the Ecowitt cloud API, keyed
+// by their UNIX timestamp.
+type cloudSeries struct {
+	Unit string            `json:"unit"`
+	List map[string]string `json:"list"`
+}
+
+type cloudResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	// Data is an empty list instead of an object when there's no data.
+	Data json.RawMessage `json:"data"`
+}
+
+type cloudData struct {
+	Outdoor struct {
+		Temperature cloudSeries `json:"temperature"`
+		Humidity    cloudSeries `json:"humidity"`
+	} `json:"outdoor"`
+	Indoor struct {
+		Temperature cloudSeries `json:"temperature"`
+		Humidity    cloudSeries `json:"humidity"`
+	} `json:"indoor"`
+	SolarAndUVI struct {
+		Solar cloudSeries `json:"solar"`
+		UVI   cloudSeries `json:"uvi"`
+	} `json:"solar_and_uvi"`
+	Rainfall struct {
+		RainRate cloudSeries `json:"rain_rate"`
+		Daily    cloudSeries `json:"daily"`
+		Event    cloudSeries `json:"event"`
+		Hourly   cloudSeries `json:"hourly"`
+		Weekly   cloudSeries `json:"weekly"`
+		Monthly  cloudSeries `json:"monthly"`
+		Yearly   cloudSeries `json:"yearly"`
+	} `json:"rainfall"`
+	Wind struct {
+		WindSpeed     cloudSeries `json:"wind_speed"`
+		WindGust      cloudSeries `json:"wind_gust"`
+		WindDirection cloudSeries `json:"wind_direction"`
+	} `json:"wind"`
+	Pressure struct {
+		Relative cloudSeries `json:"relative"`
+		Absolute cloudSeries `json:"absolute"`
+	} `json:"pressure"`
+}
+
+// cloudClient fetches historical data from the Ecowitt cloud API.
+type cloudClient struct {
+	conf    config.CloudConfig
+	baseURL string
+	client  *http.Client
+	// delay is the pause between consecutive requests, to respect the API rate limits.
+	delay time.Duration
+}
+
+func newCloudClient(conf config.CloudConfig) *cloudClient {
+	return &cloudClient{
+		conf:    conf,
+		baseURL: defaultCloudURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		delay:   time.Second,
+	}
+}
+
+// FetchDay returns the readings recorded by the station during the given day,
+// converted to payloads in imperial units like the ones sent by the stations.
+func (c *cloudClient) FetchDay(ctx context.Context, day time.Time) ([]payload, error) {
+	params := url.Values{}
+	params.Set("application_key", c.conf.ApplicationKey)
+	params.Set("api_key", c.conf.APIKey)
+	params.Set("mac", c.conf.MAC)
+	params.Set("start_date", day.Format(time.DateTime))
+	params.Set("end_date", day.Add(24*time.Hour-time.Second).Format(time.DateTime))
+	params.Set("cycle_type", cloudCycle)
+	params.Set("call_back", "outdoor,indoor,solar_and_uvi,rainfall,wind,pressure")
+	// request the same units sent by the stations, so that the data goes
+	// through the same conversions.
+	params.Set("temp_unitid", "2")              // ºF
+	params.Set("pressure_unitid", "4")          // inHg
+	params.Set("wind_speed_unitid", "9")        // mph
+	params.Set("rainfall_unitid", "13")         // in
+	params.Set("solar_irradiance_unitid", "16") // W/m²
+
+	var resp cloudResponse
+	for attempt := 0; ; attempt++ {
+		var err error
+		resp, err = c.get(ctx, c.baseURL+"?"+params.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		// -1 is returned, among other cases, when requests are sent too often
+		if resp.Code != -1 || attempt >= cloudMaxRetries {
+			break
+		}
+
+		backoff := c.delay * time.Duration(1<<attempt)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("ecowitt API error %d: %s", resp.Code, resp.Msg)
+	}
+
+	var data cloudData
+	if len(resp.Data) > 0 && resp.Data[0] == '{' {
+		if err := json.Unmarshal(resp.Data, &data); err != nil {
+			return nil, fmt.Errorf("decoding ecowitt API data: %w", err)
+		}
+	}
+
+	return cloudPayloads(&data, c.conf.Station)
+}
+
+func (c *cloudClient) get(ctx context.Context, u string) (cloudResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return cloudResponse{}, err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return cloudResponse{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return cloudResponse{}, fmt.Errorf("ecowitt API returned status %s", res.Status)
+	}
+
+	var resp cloudResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return cloudResponse{}, fmt.Errorf("decoding ecowitt API response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// cloudPayloads maps the series returned by the cloud API to payloads, one for
+// each timestamp.
+func cloudPayloads(data *cloudData, station string) ([]payload, error) {
+	payloads := make(map[int64]*payload)
+
+	floatFields := []struct {
+		series *cloudSeries
+		field  func(p *payload) *float64
+	}{
+		{&data.Outdoor.Temperature, func(p *payload) *float64 { return &p.Tempf }},
+		{&data.Indoor.Temperature, func(p *payload) *float64 { return &p.TempInF }},
+		{&data.SolarAndUVI.Solar, func(p *payload) *float64 { return &p.SolarRadiation }},
+		{&data.SolarAndUVI.UVI, func(p *payload) *float64 { p.UV.Valid = true; return &p.UV.Value }},
+		{&data.Rainfall.RainRate, func(p *payload) *float64 { return &p.RainRateIn }},
+		{&data.Rainfall.Daily, func(p *payload) *float64 { return &p.DailyRainIn }},
+		{&data.Rainfall.Event, func(p *payload) *float64 { return &p.EventRainIn }},
+		{&data.Rainfall.Hourly, func(p *payload) *float64 { return &p.HourlyRainIn }},
+		{&data.Rainfall.Weekly, func(p *payload) *float64 { return &p.WeeklyRainIn }},
+		{&data.Rainfall.Monthly, func(p *payload) *float64 { return &p.MonthlyRainIn }},
+		{&data.Rainfall.Yearly, func(p *payload) *float64 { return &p.YearlyRainIn }},
+		{&data.Wind.WindSpeed, func(p *payload) *float64 { return &p.WindSpeedMph }},
+		{&data.Wind.WindGust, func(p *payload) *float64 { return &p.WindGustMph }},
+		{&data.Pressure.Relative, func(p *payload) *float64 { return &p.BaromRelIn }},
+		{&data.Pressure.Absolute, func(p *payload) *float64 { return &p.BaromAbsIn }},
+	}
+	intFields := []struct {
+		series *cloudSeries
+		field  func(p *payload) *optionalInt
+	}{
+		{&data.Outdoor.Humidity, func(p *payload) *optionalInt { return &p.Humidity }},
+		{&data.Indoor.Humidity, func(p *payload) *optionalInt { return &p.HumidityIn }},
+		{&data.Wind.WindDirection, func(p *payload) *optionalInt { return &p.WindDir }},
+	}
+
+	get := func(key string) (*payload, error) {
+		ts, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %w", key, err)
+		}
+
+		p, ok := payloads[ts]
+		if !ok {
+			p = &payload{
+				Passkey:     station,
+				DateUTC:     Time(time.Unix(ts, 0).UTC()),
+				StationType: "ecowitt_cloud",
+				Interval:    int(cloudInterval.Seconds()),
+			}
+			payloads[ts] = p
+		}
+		return p, nil
+	}
+
+	for _, f := range floatFields {
+		for key, value := range f.series.List {
+			p, err := get(key)
+			if err != nil {
+				return nil, err
+			}
+
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q at %s: %w", value, key, err)
+			}
+			*f.field(p) = v
+		}
+	}
+
+	for _, f := range intFields {
+		for key, value := range f.series.List {
+			p, err := get(key)
+			if err != nil {
+				return nil, err
+			}
+
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q at %s: %w", value, key, err)
+			}
+			*f.field(p) = optionalInt{Value: int(v), Valid: true}
+		}
+	}
+
+	timestamps := make([]int64, 0, len(payloads))
+	for ts := range payloads {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	result := make([]payload, 0, len(timestamps))
+	for _, ts := range timestamps {
+		result = append(result, *payloads[ts])
+	}
+
+	return result, nil
+}
+
+// cloudImport imports the historical data recorded between the from and to
+// dates (inclusive), one day at a time, writing it to sink.
+func cloudImport(ctx context.Context, logger *slog.Logger, client *cloudClient, sink MetricsSink, cal config.CalibrationConfig, from, to time.Time) error {
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		payloads, err := client.FetchDay(ctx, day)
+		if err != nil {
+			return fmt.Errorf("fetching data for %s: %w", day.Format(time.DateOnly), err)
+		}
+
+		for _, p := range payloads {
+			wd, err := NewWeatherData(p, cal)
+			if err != nil {
+				return fmt.Errorf("converting data for %s: %w", time.Time(p.DateUTC), err)
+			}
+			// the passkey of the payloads is cloud.station, stored as is
+			wd.Station = p.Passkey
+
+			if err := sink.Write(ctx, wd); err != nil {
+				return fmt.Errorf("storing data for %s: %w", wd.Timestamp, err)
+			}
+		}
+
+		if f, ok := sink.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				return fmt.Errorf("storing data for %s: %w", day.Format(time.DateOnly), err)
+			}
+		}
+
+		logger.Info("imported data from the ecowitt cloud", "day", day.Format(time.DateOnly), "readings", len(payloads))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(client.delay):
+		}
+	}
+
+	return nil
+}
+
+func runCloudImport(logger *slog.Logger, conf config.Config, fromDate, toDate string) error {
+	if conf.Cloud.ApplicationKey == "" || conf.Cloud.APIKey == "" || conf.Cloud.MAC == "" {
+		return fmt.Errorf("cloud.application_key, cloud.api_key and cloud.mac must be set")
+	}
+
+	from, err := time.Parse(time.DateOnly, fromDate)
+	if err != nil {
+		return fmt.Errorf("invalid start date: %w", err)
+	}
+
+	to, err := time.Parse(time.DateOnly, toDate)
+	if err != nil {
+		return fmt.Errorf("invalid end date: %w", err)
+	}
+
+	if conf.Cloud.Station == "" {
+		conf.Cloud.Station = conf.Cloud.MAC
+	}
+
+	ctx := context.Background()
+
+	pool, err := newPool(ctx, conf.Database)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	pg, err := newPgSink(pool, conf.Database)
+	if err != nil {
+		return err
+	}
+	sink := newCopySink(pg, defaultCopyBatchSize)
+
+	return cloudImport(ctx, logger, newCloudClient(conf.Cloud), sink, conf.Calibration, from, to)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+const cloudSampleResponse = `{
+  "code": 0,
+  "msg": "success",
+  "time": "1718582400",
+  "data": {
+    "outdoor": {
+      "temperature": {"unit": "ºF", "list": {"1718496000": "67.8", "1718496300": "68.0"}},
+      "humidity": {"unit": "%", "list": {"1718496000": "47", "1718496300": "46"}}
+    },
+    "wind": {
+      "wind_speed": {"unit": "mph", "list": {"1718496000": "0.22"}},
+      "wind_direction": {"unit": "º", "list": {"1718496000": "196"}}
+    },
+    "pressure": {
+      "relative": {"unit": "inHg", "list": {"1718496000": "29.920"}}
+    }
+  }
+}`
+
+func TestCloudImport(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request is rejected as too frequent
+		if requests.Add(1) == 1 {
+			fmt.Fprint(w, `{"code": -1, "msg": "Operation too frequent", "data": []}`)
+			return
+		}
+
+		if r.URL.Query().Get("mac") != "AA:BB:CC:DD:EE:FF" || r.URL.Query().Get("temp_unitid") != "2" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, cloudSampleResponse)
+	}))
+	defer srv.Close()
+
+	client := newCloudClient(config.CloudConfig{MAC: "AA:BB:CC:DD:EE:FF", Station: "station"})
+	client.baseURL = srv.URL
+	client.delay = time.Millisecond
+
+	sink := &recordingSink{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	day := time.Date(2024, 6, 16, 0, 0, 0, 0, time.UTC)
+	if err := cloudImport(context.Background(), logger, client, sink, config.CalibrationConfig{}, day, day); err != nil {
+		t.Fatal(err)
+	}
+
+	written := sink.Written()
+	if len(written) != 2 {
+		t.Fatalf("expected 2 readings, got %d", len(written))
+	}
+
+	wd := written[0]
+	if wd.Station != "station" || !wd.Timestamp.Equal(time.Unix(1718496000, 0)) {
+		t.Errorf("unexpected station or timestamp: %s %s", wd.Station, wd.Timestamp)
+	}
+	if math.Abs(wd.OutdoorTemperature-19.89) > 0.01 {
+		t.Errorf("expected outdoor temperature ~19.89, got %v", wd.OutdoorTemperature)
+	}
+	if *wd.OutdoorHumidity != 47 || *wd.WindDirection != 196 {
+		t.Errorf("unexpected humidity %d or wind direction %d", *wd.OutdoorHumidity, *wd.WindDirection)
+	}
+	if math.Abs(wd.RelativePressure-1013.2) > 0.1 {
+		t.Errorf("expected relative pressure ~1013.2, got %v", wd.RelativePressure)
+	}
+	if wd.Interval != cloudInterval {
+		t.Errorf("expected interval %s, got %s", cloudInterval, wd.Interval)
+	}
+	if *written[1].OutdoorHumidity != 46 {
+		t.Errorf("expected the second reading humidity to be 46, got %d", *written[1].OutdoorHumidity)
+	}
+}
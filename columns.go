@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// dbColumn describes a WeatherData field that is stored in a database column.
+type dbColumn struct {
+	Name      string
+	Index     int
+	OmitEmpty bool
+
+	// TimeStorage is how the time.Time values are stored, as in
+	// config.DatabaseConfig.TimeStorage.
+	TimeStorage string
+}
+
+// weatherDataColumns is the list of database columns, as described by the
+// `db` struct tags of WeatherData.
+var weatherDataColumns = parseColumns(reflect.TypeOf(WeatherData{}))
+
+// rainColumns are the columns replaced by the rain jsonb column when
+// database.rain_jsonb is set.
+var rainColumns = []string{
+	"daily_rain", "event_rain", "hourly_rain", "monthly_rain",
+	"rain_rate", "total_rain", "weekly_rain", "yearly_rain",
+}
+
+// ignoredColumns returns the columns that are not stored with conf: the
+// ignore_fields and, when the rain metrics are stored as jsonb, the rain
+// columns.
+func ignoredColumns(conf config.DatabaseConfig) []string {
+	if !conf.RainJSONB {
+		return conf.IgnoreFields
+	}
+
+	return append(slices.Clone(conf.IgnoreFields), rainColumns...)
+}
+
+// storedColumns returns the columns of weatherDataColumns that are not listed
+// in ignore, after checking that they are columns that can be dropped.
+func storedColumns(ignore []string) ([]dbColumn, error) {
+	ignored := make(map[string]bool, len(ignore))
+	for _, name := range ignore {
+		if notNullColumns[name] {
+			return nil, fmt.Errorf("the %s column can't be ignored", name)
+		}
+		if !slices.ContainsFunc(weatherDataColumns, func(col dbColumn) bool { return col.Name == name }) {
+			return nil, fmt.Errorf("unknown column %q in ignore_fields", name)
+		}
+		ignored[name] = true
+	}
+
+	var columns []dbColumn
+	for _, col := range weatherDataColumns {
+		if !ignored[col.Name] {
+			columns = append(columns, col)
+		}
+	}
+
+	return columns, nil
+}
+
+func parseColumns(t reflect.Type) []dbColumn {
+	var columns []dbColumn
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("db")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		columns = append(columns, dbColumn{
+			Name:      name,
+			Index:     i,
+			OmitEmpty: opts == "omitempty",
+		})
+	}
+
+	return columns
+}
+
+// columnValues returns the names and the values of columns for wd. Columns
+// tagged with "omitempty" are skipped when their value is nil, so that optional
+// columns only need to exist when the feature populating them is enabled.
+func (wd *WeatherData) columnValues(columns []dbColumn) ([]string, []any) {
+	v := reflect.ValueOf(wd).Elem()
+
+	names := make([]string, 0, len(columns))
+	values := make([]any, 0, len(columns))
+	for _, col := range columns {
+		field := v.Field(col.Index)
+		if col.OmitEmpty && field.Kind() == reflect.Pointer && field.IsNil() {
+			continue
+		}
+
+		names = append(names, col.Name)
+		values = append(values, columnValue(col, field))
+	}
+
+	return names, values
+}
+
+// columnValue returns the value stored in col for a WeatherData field; nil
+// pointers are stored as NULL.
+func columnValue(col dbColumn, field reflect.Value) any {
+	if field.Kind() == reflect.Pointer && field.IsNil() {
+		return nil
+	}
+
+	value := field.Interface()
+	switch v := value.(type) {
+	case time.Duration:
+		// durations are stored as seconds
+		return v.Seconds()
+	case time.Time:
+		switch col.TimeStorage {
+		case "epoch_seconds":
+			return v.Unix()
+		case "epoch_millis":
+			return v.UnixMilli()
+		}
+	}
+
+	return value
+}
+
+// columnExpr returns the SQL expression reading the column name back, for
+// the queries on the readings: the time stored as a Unix time is converted
+// back to a timestamptz, the rain columns are extracted from the rain jsonb
+// column when it replaces them, and the ignored columns, which might not
+// exist in the table, are read as NULL.
+func columnExpr(db config.DatabaseConfig, name string) string {
+	if db.RainJSONB && slices.Contains(rainColumns, name) {
+		return fmt.Sprintf("(rain->>'%s')::double precision", name)
+	}
+	if slices.Contains(db.IgnoreFields, name) {
+		t := reflect.TypeOf(WeatherData{})
+		for _, col := range weatherDataColumns {
+			if col.Name == name {
+				return "NULL::" + columnType(col, t.Field(col.Index).Type)
+			}
+		}
+	}
+
+	if name == "time" {
+		switch db.TimeStorage {
+		case "epoch_seconds":
+			return "to_timestamp(time)"
+		case "epoch_millis":
+			return "to_timestamp(time / 1000.0)"
+		}
+	}
+
+	return name
+}
+
+// timeBound returns t as compared with the time column, stored as set by
+// storage, so that the bounds of the queries can still use its index.
+func timeBound(t time.Time, storage string) any {
+	return columnValue(dbColumn{Name: "time", TimeStorage: storage}, reflect.ValueOf(t))
+}
+
+// withTimeStorage returns a copy of columns where the time column is stored
+// as set by storage, e.g. "epoch_seconds".
+func withTimeStorage(columns []dbColumn, storage string) []dbColumn {
+	columns = slices.Clone(columns)
+	for i := range columns {
+		if columns[i].Name == "time" {
+			columns[i].TimeStorage = storage
+		}
+	}
+
+	return columns
+}
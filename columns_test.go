@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestColumnValues(t *testing.T) {
+	wd := WeatherData{
+		Passkey:  "secret",
+		Station:  "station",
+		Interval: time.Minute,
+	}
+
+	names, values := wd.columnValues(weatherDataColumns)
+	if len(names) != len(values) {
+		t.Fatalf("got %d names and %d values", len(names), len(values))
+	}
+
+	if slices.Contains(names, "wind_gust_smoothed") {
+		t.Errorf("nil optional column should be omitted")
+	}
+
+	for i, name := range names {
+		if name == "interval" && values[i] != 60.0 {
+			t.Errorf("interval: got %v, want 60", values[i])
+		}
+		if values[i] == "secret" {
+			t.Errorf("passkey should not be stored, found in column %s", name)
+		}
+	}
+
+	gust := 3.5
+	wd.WindGustSmoothed = &gust
+	names, _ = wd.columnValues(weatherDataColumns)
+	if !slices.Contains(names, "wind_gust_smoothed") {
+		t.Errorf("non-nil optional column should be included")
+	}
+}
+
+func TestStoredColumns(t *testing.T) {
+	columns, err := storedColumns([]string{"heap", "runtime", "temperature_indoor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != len(weatherDataColumns)-3 {
+		t.Errorf("expected %d columns, got %d", len(weatherDataColumns)-3, len(columns))
+	}
+
+	wd := WeatherData{Station: "station", Heap: 1024, Runtime: 3600}
+	names, _ := wd.columnValues(columns)
+	for _, name := range []string{"heap", "runtime", "temperature_indoor"} {
+		if slices.Contains(names, name) {
+			t.Errorf("ignored column %s should not be stored", name)
+		}
+	}
+	if !slices.Contains(names, "temperature_outdoor") {
+		t.Errorf("column temperature_outdoor should be stored")
+	}
+
+	for _, ignore := range []string{"indoor_temperature", "time", "station"} {
+		if _, err := storedColumns([]string{ignore}); err == nil {
+			t.Errorf("expected an error ignoring %q", ignore)
+		}
+	}
+}
+
+func TestRainJSONBColumns(t *testing.T) {
+	columns, err := storedColumns(ignoredColumns(config.DatabaseConfig{IgnoreFields: []string{"heap"}, RainJSONB: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := WeatherData{Station: "station", DailyRain: 1.2}
+	wd.Rain = newRainData(&wd)
+	names, _ := wd.columnValues(columns)
+	for _, name := range append([]string{"heap"}, rainColumns...) {
+		if slices.Contains(names, name) {
+			t.Errorf("column %s should not be stored", name)
+		}
+	}
+	if !slices.Contains(names, "rain") {
+		t.Errorf("column rain should be stored")
+	}
+}
+
+func TestRainDataRoundTrip(t *testing.T) {
+	wd := WeatherData{
+		DailyRain:   1.5,
+		EventRain:   2.5,
+		HourlyRain:  0.3,
+		MonthlyRain: 42.1,
+		RainRate:    3.6,
+		TotalRain:   812.7,
+		WeeklyRain:  10.2,
+		YearlyRain:  301.4,
+	}
+
+	b, err := json.Marshal(newRainData(&wd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys are the names of the flat columns
+	var byName map[string]float64
+	if err := json.Unmarshal(b, &byName); err != nil {
+		t.Fatal(err)
+	}
+	if len(byName) != len(rainColumns) {
+		t.Errorf("expected %d keys, got %v", len(rainColumns), byName)
+	}
+	names, values := wd.columnValues(weatherDataColumns)
+	for _, name := range rainColumns {
+		i := slices.Index(names, name)
+		if got, ok := byName[name]; !ok || got != values[i] {
+			t.Errorf("%s: got %v, want %v", name, got, values[i])
+		}
+	}
+
+	var got rainData
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != *newRainData(&wd) {
+		t.Errorf("got %+v, want %+v", got, *newRainData(&wd))
+	}
+}
+
+func TestColumnExpr(t *testing.T) {
+	db := config.DatabaseConfig{RainJSONB: true, IgnoreFields: []string{"heap", "temperature_indoor"}, TimeStorage: "epoch_seconds"}
+
+	for name, want := range map[string]string{
+		"station":            "station",
+		"time":               "to_timestamp(time)",
+		"daily_rain":         "(rain->>'daily_rain')::double precision",
+		"heap":               "NULL::integer",
+		"temperature_indoor": "NULL::double precision",
+	} {
+		if got := columnExpr(db, name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+
+	if got := columnExpr(config.DatabaseConfig{}, "daily_rain"); got != "daily_rain" {
+		t.Errorf("expected the daily_rain column, got %q", got)
+	}
+}
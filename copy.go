@@ -0,0 +1,144 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultCopyBatchSize is the number of readings written by each COPY.
+const defaultCopyBatchSize = 1000
+
+// copyColumns returns the columns to be copied for rows, among stored: all the
+// mandatory columns and the optional ones that are set in at least one of the
+// rows.
+func copyColumns(rows []*WeatherData, stored []dbColumn) []dbColumn {
+	var columns []dbColumn
+	for _, col := range stored {
+		if !col.OmitEmpty {
+			columns = append(columns, col)
+			continue
+		}
+
+		for _, wd := range rows {
+			field := reflect.ValueOf(wd).Elem().Field(col.Index)
+			if field.Kind() != reflect.Pointer || !field.IsNil() {
+				columns = append(columns, col)
+				break
+			}
+		}
+	}
+
+	return columns
+}
+
+// weatherDataCopySource is a pgx.CopyFromSource reading the given columns of
+// a slice of WeatherData; nil optional values are copied as NULL.
+type weatherDataCopySource struct {
+	rows    []*WeatherData
+	columns []dbColumn
+	pos     int
+}
+
+func newWeatherDataCopySource(rows []*WeatherData, columns []dbColumn) *weatherDataCopySource {
+	return &weatherDataCopySource{rows: rows, columns: columns, pos: -1}
+}
+
+func (s *weatherDataCopySource) Next() bool {
+	s.pos++
+	return s.pos < len(s.rows)
+}
+
+func (s *weatherDataCopySource) Values() ([]any, error) {
+	v := reflect.ValueOf(s.rows[s.pos]).Elem()
+
+	values := make([]any, len(s.columns))
+	for i, col := range s.columns {
+		values[i] = columnValue(col, v.Field(col.Index))
+	}
+
+	return values, nil
+}
+
+func (s *weatherDataCopySource) Err() error {
+	return nil
+}
+
+// copyMetrics stores rows in table with a single COPY, which is much faster
+// than inserting them one at a time.
+func copyMetrics(ctx context.Context, rows []*WeatherData, stored []dbColumn, pool *pgxpool.Pool, table string) error {
+	columns := copyColumns(rows, stored)
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	if _, err := pool.CopyFrom(ctx, pgx.Identifier(strings.Split(table, ".")), names, newWeatherDataCopySource(rows, columns)); err != nil {
+		return fmt.Errorf("executing COPY: %w", err)
+	}
+
+	return nil
+}
+
+// batchWriter is implemented by *pgSink; it allows replacing the database in
+// tests.
+type batchWriter interface {
+	WriteBatch(ctx context.Context, rows []*WeatherData) error
+}
+
+// copySink collects the readings written to it and stores them in batches
+// with WriteBatch; it's used by the replay and backfill commands, where the
+// readings don't need to be stored right away. Flush must be called once
+// done, to store the last batch. When a batch can't be stored the error is
+// returned by the Write or Flush call that triggered it, and the batch is
+// dropped.
+//
+// Each batch is stored sorted by station and time, so that the readings of a
+// station are inserted in time order even when they were written out of
+// order, e.g. by concurrent writers; the order across stations, and across
+// batches, isn't guaranteed.
+type copySink struct {
+	next    batchWriter
+	size    int
+	pending []*WeatherData
+}
+
+func newCopySink(next batchWriter, size int) *copySink {
+	if size <= 0 {
+		size = defaultCopyBatchSize
+	}
+	return &copySink{next: next, size: size}
+}
+
+func (s *copySink) Write(ctx context.Context, wd *WeatherData) error {
+	s.pending = append(s.pending, wd)
+	if len(s.pending) >= s.size {
+		return s.Flush(ctx)
+	}
+
+	return nil
+}
+
+func (s *copySink) Flush(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	slices.SortStableFunc(s.pending, func(a, b *WeatherData) int {
+		return cmp.Or(strings.Compare(a.Station, b.Station), a.Timestamp.Compare(b.Timestamp))
+	})
+	err := s.next.WriteBatch(ctx, s.pending)
+	s.pending = s.pending[:0]
+
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestCopyColumns(t *testing.T) {
+	gust := 3.5
+	rows := []*WeatherData{
+		{Station: "a"},
+		{Station: "b", WindGustSmoothed: &gust},
+	}
+
+	var names []string
+	for _, col := range copyColumns(rows, weatherDataColumns) {
+		names = append(names, col.Name)
+	}
+
+	if !slices.Contains(names, "wind_gust_smoothed") {
+		t.Errorf("optional column set in one row should be copied")
+	}
+	if slices.Contains(names, "solar_lux") {
+		t.Errorf("optional column unset in all rows should be skipped")
+	}
+	if !slices.Contains(names, "time") {
+		t.Errorf("mandatory column should be copied")
+	}
+}
+
+func TestWeatherDataCopySource(t *testing.T) {
+	gust := 3.5
+	rows := []*WeatherData{
+		{Station: "a", Interval: time.Minute},
+		{Station: "b", WindGustSmoothed: &gust},
+	}
+	columns := copyColumns(rows, weatherDataColumns)
+
+	var got [][]any
+	src := newWeatherDataCopySource(rows, columns)
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, values)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(got))
+	}
+
+	for i, col := range columns {
+		switch col.Name {
+		case "interval":
+			if got[0][i] != 60.0 {
+				t.Errorf("interval: got %v, want 60", got[0][i])
+			}
+		case "wind_gust_smoothed":
+			if got[0][i] != nil {
+				t.Errorf("unset optional value should be NULL, got %v", got[0][i])
+			}
+			if v, ok := got[1][i].(*float64); !ok || *v != gust {
+				t.Errorf("wind_gust_smoothed: got %v, want %v", got[1][i], gust)
+			}
+		}
+	}
+}
+
+// recordingBatchWriter records the batches written to it.
+type recordingBatchWriter struct {
+	batches [][]*WeatherData
+}
+
+func (w *recordingBatchWriter) WriteBatch(ctx context.Context, rows []*WeatherData) error {
+	w.batches = append(w.batches, slices.Clone(rows))
+	return nil
+}
+
+func TestCopySinkOrder(t *testing.T) {
+	start := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC)
+	var rows []*WeatherData
+	for _, station := range []string{"a", "b"} {
+		for i := range 5 {
+			rows = append(rows, &WeatherData{Station: station, Timestamp: start.Add(time.Duration(i) * time.Minute)})
+		}
+	}
+	shuffled := slices.Clone(rows)
+	rand.New(rand.NewPCG(1, 2)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	next := &recordingBatchWriter{}
+	sink := newCopySink(next, len(rows))
+	for _, wd := range shuffled {
+		if err := sink.Write(context.Background(), wd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(next.batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(next.batches))
+	}
+	if !slices.Equal(next.batches[0], rows) {
+		t.Error("expected the batch to be sorted by station and time")
+	}
+}
+
+// BenchmarkInsert compares inserting the readings one at a time with COPY;
+// it needs a database, whose DSN is read from ECOWITT_TEST_DSN.
+func BenchmarkInsert(b *testing.B) {
+	dsn := os.Getenv("ECOWITT_TEST_DSN")
+	if dsn == "" {
+		b.Skip("ECOWITT_TEST_DSN is not set")
+	}
+
+	ctx := context.Background()
+	pool, err := newPool(ctx, config.DatabaseConfig{DSN: dsn})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+
+	const table = "ecowitt_collector_bench"
+	if _, err := pool.Exec(ctx, createTableStatement(table, weatherDataColumns)); err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Exec(ctx, "DROP TABLE "+table)
+
+	rows := make([]*WeatherData, 1000)
+	start := time.Date(2024, 6, 16, 0, 0, 0, 0, time.UTC)
+	for i := range rows {
+		rows[i] = &WeatherData{
+			Timestamp:          start.Add(time.Duration(i) * time.Minute),
+			Station:            "bench",
+			Interval:           time.Minute,
+			OutdoorTemperature: 20 + float64(i%10),
+		}
+	}
+
+	b.Run(fmt.Sprintf("insert-%d", len(rows)), func(b *testing.B) {
+		for range b.N {
+			for _, wd := range rows {
+				if err := sendMetrics(ctx, wd, weatherDataColumns, pool, table); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run(fmt.Sprintf("copy-%d", len(rows)), func(b *testing.B) {
+		for range b.N {
+			if err := copyMetrics(ctx, rows, weatherDataColumns, pool, table); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// dailySummary is the summary of a station's readings over a day.
+type dailySummary struct {
+	Station               string   `json:"station"`
+	Date                  string   `json:"date"`
+	Timezone              string   `json:"timezone"`
+	Readings              int      `json:"readings"`
+	TemperatureMin        *float64 `json:"temperature_min"`
+	TemperatureMax        *float64 `json:"temperature_max"`
+	TemperatureAvg        *float64 `json:"temperature_avg"`
+	WindGustMax           *float64 `json:"wind_gust_max"`
+	Rainfall              *float64 `json:"rainfall"`
+	DominantWindDirection *string  `json:"wind_direction_dominant"`
+
+	// only set when the degree days are enabled
+	HeatingDegreeDays *float64 `json:"heating_degree_days,omitempty"`
+	CoolingDegreeDays *float64 `json:"cooling_degree_days,omitempty"`
+
+	// only set when http.api_units is enabled
+	Units map[string]string `json:"units,omitempty"`
+}
+
+// dayRange returns the start and the end, in UTC, of the given date
+// (formatted as YYYY-MM-DD) in the location loc.
+func dayRange(date string, loc *time.Location) (time.Time, time.Time, error) {
+	day, err := time.ParseInLocation(time.DateOnly, date, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return day.UTC(), day.AddDate(0, 0, 1).UTC(), nil
+}
+
+// stationLocation returns the timezone configured for station, defaulting to UTC.
+func stationLocation(stations map[string]config.StationConfig, station string) (*time.Location, error) {
+	if tz := stations[station].Timezone; tz != "" {
+		return time.LoadLocation(tz)
+	}
+
+	return time.UTC, nil
+}
+
+func queryDailySummary(ctx context.Context, pool *pgxpool.Pool, db config.DatabaseConfig, station string, start, end time.Time) (dailySummary, error) {
+	var (
+		summary    dailySummary
+		dailyRain  *float64
+		totalDelta *float64
+		sector     *int
+	)
+
+	// the dominant wind direction is the most frequent of the 16 compass sectors
+	err := pool.QueryRow(ctx, fmt.Sprintf(
+		`SELECT count(*), min(%[1]s), max(%[1]s), avg(%[1]s),
+		max(%[2]s), max(%[3]s), max(%[4]s) - min(%[4]s),
+		mode() WITHIN GROUP (ORDER BY floor(%[5]s / 22.5 + 0.5)::int %% 16)
+		FROM %[6]s WHERE station = $1 AND time >= $2 AND time < $3`,
+		columnExpr(db, "temperature_outdoor"), columnExpr(db, "wind_gust"), columnExpr(db, "daily_rain"),
+		columnExpr(db, "total_rain"), columnExpr(db, "wind_direction"), db.Table),
+		station, timeBound(start, db.TimeStorage), timeBound(end, db.TimeStorage),
+	).Scan(&summary.Readings, &summary.TemperatureMin, &summary.TemperatureMax, &summary.TemperatureAvg,
+		&summary.WindGustMax, &dailyRain, &totalDelta, &sector)
+	if err != nil {
+		return dailySummary{}, err
+	}
+
+	// the delta of the total rain counter doesn't depend on when the station
+	// resets its daily counter, but it can't be used if the counter was reset.
+	if totalDelta != nil && *totalDelta >= 0 {
+		summary.Rainfall = totalDelta
+	} else {
+		summary.Rainfall = dailyRain
+	}
+
+	if sector != nil {
+		summary.DominantWindDirection = &WindDirections[*sector]
+	}
+
+	return summary, nil
+}
+
+// queryDegreeDays returns the sum of the degree days contributions stored for
+// station between start and end.
+func queryDegreeDays(ctx context.Context, pool *pgxpool.Pool, db config.DatabaseConfig, station string, start, end time.Time) (heating, cooling *float64, err error) {
+	err = pool.QueryRow(ctx, fmt.Sprintf(
+		`SELECT sum(%s), sum(%s)
+		FROM %s WHERE station = $1 AND time >= $2 AND time < $3`,
+		columnExpr(db, "heating_degree_days"), columnExpr(db, "cooling_degree_days"), db.Table),
+		station, timeBound(start, db.TimeStorage), timeBound(end, db.TimeStorage),
+	).Scan(&heating, &cooling)
+
+	return heating, cooling, err
+}
+
+// addDegreeDays sets the degree days of summary, computed with the method
+// configured in conf.
+func addDegreeDays(ctx context.Context, summary *dailySummary, conf config.DegreeDaysConfig, pool *pgxpool.Pool, db config.DatabaseConfig, start, end time.Time) error {
+	if conf.Method == "mean" {
+		if summary.TemperatureMin != nil && summary.TemperatureMax != nil {
+			heating, cooling := meanDegreeDays(*summary.TemperatureMin, *summary.TemperatureMax, conf.BaseTemperature())
+			summary.HeatingDegreeDays, summary.CoolingDegreeDays = &heating, &cooling
+		}
+		return nil
+	}
+
+	var err error
+	summary.HeatingDegreeDays, summary.CoolingDegreeDays, err = queryDegreeDays(ctx, pool, db, summary.Station, start, end)
+	return err
+}
+
+func (s dailySummary) CSV() ([]string, [][]string) {
+	header := []string{
+		"station", "date", "timezone", "readings", "temperature_min", "temperature_max", "temperature_avg",
+		"wind_gust_max", "rainfall", "wind_direction_dominant",
+	}
+	if s.HeatingDegreeDays != nil {
+		header = append(header, "heating_degree_days", "cooling_degree_days")
+	}
+
+	var direction string
+	if s.DominantWindDirection != nil {
+		direction = *s.DominantWindDirection
+	}
+
+	row := []string{
+		s.Station, s.Date, s.Timezone, strconv.Itoa(s.Readings),
+		formatOptionalFloat(s.TemperatureMin), formatOptionalFloat(s.TemperatureMax), formatOptionalFloat(s.TemperatureAvg),
+		formatOptionalFloat(s.WindGustMax), formatOptionalFloat(s.Rainfall), direction,
+	}
+	if s.HeatingDegreeDays != nil {
+		row = append(row, formatOptionalFloat(s.HeatingDegreeDays), formatOptionalFloat(s.CoolingDegreeDays))
+	}
+
+	return header, [][]string{row}
+}
+
+func makeDailyHandler(logger *slog.Logger, pool *pgxpool.Pool, db config.DatabaseConfig, stations map[string]config.StationConfig, degreeDays config.DegreeDaysConfig, units bool) http.Handler {
+	dailyUnits := withRainUnit(dailyUnits, db.RainUnit)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		station := r.URL.Query().Get("station")
+		date := r.URL.Query().Get("date")
+		if station == "" || date == "" {
+			writeJSONError(w, http.StatusBadRequest, "the station and date parameters are required")
+			return
+		}
+
+		loc, err := stationLocation(stations, station)
+		if err != nil {
+			logger.Error("invalid station timezone", "station", station, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "invalid station timezone")
+			return
+		}
+
+		start, end, err := dayRange(date, loc)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid date, expected YYYY-MM-DD")
+			return
+		}
+
+		summary, err := queryDailySummary(r.Context(), pool, db, station, start, end)
+		if err != nil {
+			logger.Error("error querying daily summary", "station", station, "date", date, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "error querying the database")
+			return
+		}
+
+		if summary.Readings == 0 {
+			writeJSONError(w, http.StatusNotFound, "no readings found")
+			return
+		}
+
+		summary.Station = station
+		summary.Date = date
+		summary.Timezone = loc.String()
+
+		if degreeDays.Enabled {
+			if err := addDegreeDays(r.Context(), &summary, degreeDays, pool, db, start, end); err != nil {
+				logger.Error("error querying degree days", "station", station, "date", date, "err", err)
+				writeJSONError(w, http.StatusInternalServerError, "error querying the database")
+				return
+			}
+		}
+
+		if units {
+			summary.Units = dailyUnits
+			if summary.HeatingDegreeDays != nil {
+				summary.Units = maps.Clone(dailyUnits)
+				maps.Copy(summary.Units, degreeDaysUnits)
+			}
+		}
+
+		writeAPIResponse(w, r, logger, summary)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestDayRange(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skipf("timezone data not available: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		date      string
+		loc       *time.Location
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "utc",
+			date:      "2024-06-16",
+			loc:       time.UTC,
+			wantStart: time.Date(2024, 6, 16, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 6, 17, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "summer time",
+			date:      "2024-06-16",
+			loc:       rome,
+			wantStart: time.Date(2024, 6, 15, 22, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 6, 16, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "23 hours day",
+			date:      "2024-03-31",
+			loc:       rome,
+			wantStart: time.Date(2024, 3, 30, 23, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := dayRange(tt.date, tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("got %s - %s, want %s - %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+
+	if _, _, err := dayRange("16/06/2024", time.UTC); err == nil {
+		t.Errorf("expected an error for an invalid date")
+	}
+}
+
+func TestStationLocation(t *testing.T) {
+	stations := map[string]config.StationConfig{
+		"a": {Timezone: "Europe/Rome"},
+	}
+
+	loc, err := stationLocation(stations, "b")
+	if err != nil || loc != time.UTC {
+		t.Errorf("expected UTC for an unconfigured station, got %v (%v)", loc, err)
+	}
+
+	loc, err = stationLocation(stations, "a")
+	if err != nil {
+		t.Skipf("timezone data not available: %s", err)
+	}
+	if loc.String() != "Europe/Rome" {
+		t.Errorf("expected Europe/Rome, got %s", loc)
+	}
+}
+
+func TestDailyHandlerErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := makeDailyHandler(logger, nil, config.DatabaseConfig{Table: "weather"}, nil, config.DegreeDaysConfig{}, false)
+
+	for _, query := range []string{"", "?station=a", "?station=a&date=yesterday"} {
+		req := httptest.NewRequest(http.MethodGet, "/daily"+query, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status %d, got %d", query, http.StatusBadRequest, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%q: expected a JSON error, got %s", query, ct)
+		}
+
+		var body apiError
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Code != http.StatusBadRequest {
+			t.Errorf("%q: unexpected error body %+v (%v)", query, body, err)
+		}
+	}
+}
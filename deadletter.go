@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultDeadLetterMaxSize is the size after which the dead-letter file is rotated.
+const defaultDeadLetterMaxSize = 10 * 1024 * 1024
+
+// deadLetter is an entry of the dead-letter file; Body is the raw form body
+// sent by the station, so that the entry can be fed back to replay.
+type deadLetter struct {
+	Time    time.Time `json:"time"`
+	Station string    `json:"station"`
+	Error   string    `json:"error"`
+	Body    string    `json:"body"`
+}
+
+// deadLetterFile appends the reports that couldn't be stored to a file, as JSON
+// lines. When the file grows over maxSize it is renamed with a ".1" suffix,
+// replacing the previous one, and a new file is started.
+type deadLetterFile struct {
+	path    string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+func newDeadLetterFile(path string, maxSize int64) *deadLetterFile {
+	if maxSize <= 0 {
+		maxSize = defaultDeadLetterMaxSize
+	}
+	return &deadLetterFile{path: path, maxSize: maxSize}
+}
+
+func (f *deadLetterFile) Write(entry deadLetter) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fi, err := os.Stat(f.path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > f.maxSize {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return fmt.Errorf("rotating dead-letter file: %w", err)
+		}
+	}
+
+	fh, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fh.Write(line); err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
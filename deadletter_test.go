@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestDeadLetterReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	conf := config.Config{Database: config.DatabaseConfig{DeadLetterFile: path}}
+	in := newTestIngester(t, conf, &recordingSink{err: errors.New("database is down")})
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Ingest(context.Background(), form); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	var entry deadLetter
+	scanner := bufio.NewScanner(fh)
+	if !scanner.Scan() {
+		t.Fatal("expected a dead-letter entry")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Error != "database is down" || entry.Body != form.Encode() {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+
+	sink := &recordingSink{}
+	in = newTestIngester(t, config.Config{}, sink)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := replay(context.Background(), logger, in, path); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sink.Written()); n != 1 {
+		t.Errorf("expected 1 replayed reading, got %d", n)
+	}
+}
+
+func TestDeadLetterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	f := newDeadLetterFile(path, 150)
+
+	for i := 0; i < 3; i++ {
+		if err := f.Write(deadLetter{Station: "station", Body: "passkey=station&tempf=70.0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 150 {
+			t.Errorf("%s is %d bytes, over the limit", p, fi.Size())
+		}
+	}
+}
+
+func TestDeadLetterRawBody(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	conf := config.Config{Database: config.DatabaseConfig{DeadLetterFile: path}}
+	in := newTestIngester(t, conf, &recordingSink{err: errors.New("database is down")})
+	handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+	// stored as sent, unlike the re-encoded form, and even when it can't
+	// be parsed
+	bodies := []string{sampleQuery, "PASSKEY=LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI&tempf=%zz"}
+	for _, body := range bodies {
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for _, body := range bodies {
+		var entry deadLetter
+		if !scanner.Scan() {
+			t.Fatalf("expected a dead-letter entry for %q", body)
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Body != body {
+			t.Errorf("expected the body %q, got %q", body, entry.Body)
+		}
+	}
+}
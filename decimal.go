@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// numericFields are the form fields decoded as numbers, in lower case, as the
+// decoder matches them regardless of the case.
+var numericFields = parseNumericFields(reflect.TypeOf(payload{}))
+
+func parseNumericFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		switch field.Type {
+		case reflect.TypeOf(optionalFloat{}), reflect.TypeOf(optionalInt{}):
+		default:
+			switch field.Type.Kind() {
+			case reflect.Float64, reflect.Int:
+			default:
+				continue
+			}
+		}
+
+		name := field.Tag.Get("schema")
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = true
+	}
+
+	return fields
+}
+
+// withDecimalPoints returns a copy of form where the commas of the numeric
+// fields are replaced by points, for the stations using a comma as the
+// decimal separator.
+func withDecimalPoints(form url.Values) url.Values {
+	result := make(url.Values, len(form))
+	for key, values := range form {
+		if numericFields[strings.ToLower(key)] {
+			converted := make([]string, len(values))
+			for i, v := range values {
+				converted[i] = strings.ReplaceAll(v, ",", ".")
+			}
+			values = converted
+		}
+		result[key] = values
+	}
+
+	return result
+}
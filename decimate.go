@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errThrottled is returned for the readings dropped because of the
+// min_store_interval of their station, which are not failures.
+var errThrottled = errors.New("reading received before min_store_interval")
+
+var readingsThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecowitt_collector_throttled_readings_total",
+	Help: "The number of readings dropped because of min_store_interval",
+}, []string{"station"})
+
+// storeThrottle limits how often the readings of each station are stored,
+// for stations reporting more often than needed; the extra readings are
+// dropped.
+type storeThrottle struct {
+	intervals map[string]time.Duration
+
+	mu      sync.Mutex
+	last    map[string]time.Time
+	dropped map[string]int
+}
+
+// newStoreThrottle returns a storeThrottle for the stations configured with a
+// min_store_interval, or nil if there are none.
+func newStoreThrottle(conf map[string]config.StationConfig) *storeThrottle {
+	intervals := make(map[string]time.Duration)
+	for station, sc := range conf {
+		if sc.MinStoreInterval > 0 {
+			intervals[station] = sc.MinStoreInterval
+		}
+	}
+	if len(intervals) == 0 {
+		return nil
+	}
+
+	return &storeThrottle{
+		intervals: intervals,
+		last:      make(map[string]time.Time),
+		dropped:   make(map[string]int),
+	}
+}
+
+// Allow reports whether the reading taken by station at t should be stored;
+// when it should, it also returns the number of readings dropped since the
+// previous one was stored.
+func (s *storeThrottle) Allow(station string, t time.Time) (bool, int) {
+	interval, ok := s.intervals[station]
+	if !ok {
+		return true, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.last[station]; ok && t.Sub(last) < interval && !t.Before(last) {
+		s.dropped[station]++
+		return false, 0
+	}
+
+	dropped := s.dropped[station]
+	s.last[station] = t
+	s.dropped[station] = 0
+
+	return true, dropped
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestStoreThrottle(t *testing.T) {
+	if newStoreThrottle(map[string]config.StationConfig{"a": {Name: "garden"}}) != nil {
+		t.Fatal("expected a nil throttle when no station has a min_store_interval")
+	}
+
+	throttle := newStoreThrottle(map[string]config.StationConfig{
+		"fast": {MinStoreInterval: time.Minute},
+	})
+	start := time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		station     string
+		offset      time.Duration
+		want        bool
+		wantDropped int
+	}{
+		{"fast", 0, true, 0},
+		{"fast", 16 * time.Second, false, 0},
+		{"fast", 32 * time.Second, false, 0},
+		{"fast", 48 * time.Second, false, 0},
+		{"fast", 64 * time.Second, true, 3},
+		{"fast", 80 * time.Second, false, 0},
+		{"other", 0, true, 0},
+		{"other", time.Second, true, 0},
+	}
+
+	for _, tt := range tests {
+		ok, dropped := throttle.Allow(tt.station, start.Add(tt.offset))
+		if ok != tt.want || dropped != tt.wantDropped {
+			t.Errorf("%s at +%s: expected (%v, %d), got (%v, %d)", tt.station, tt.offset, tt.want, tt.wantDropped, ok, dropped)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// defaultLuxCoefficient is the factor commonly used (e.g. by Ecowitt) to
+// approximate the illuminance, in lux, from the solar radiation in W/m².
+const defaultLuxCoefficient = 126.7
+
+// solarLux estimates the illuminance from the solar radiation; the result is
+// only an approximation, as the ratio depends on the spectrum of the light.
+func solarLux(radiation, coefficient float64) float64 {
+	return radiation * coefficient
+}
+
+// Weather conditions returned by classifyCondition.
+const (
+	conditionClear     = "Clear"
+	conditionCloudy    = "Cloudy"
+	conditionRain      = "Rain"
+	conditionHeavyRain = "Heavy Rain"
+)
+
+// conditionDefaults returns conf with the unset thresholds replaced by their
+// default values.
+func conditionDefaults(conf config.ConditionConfig) config.ConditionConfig {
+	if conf.RainRate == 0 {
+		conf.RainRate = 0.1
+	}
+	if conf.HeavyRainRate == 0 {
+		conf.HeavyRainRate = 7.6
+	}
+	if conf.DaylightRadiation == 0 {
+		conf.DaylightRadiation = 10
+	}
+	if conf.CloudyRadiation == 0 {
+		conf.CloudyRadiation = 200
+	}
+	if conf.CloudyHumidity == 0 {
+		conf.CloudyHumidity = 90
+	}
+	return conf
+}
+
+// classifyCondition derives a coarse weather condition from the rain rate, the
+// solar radiation and the humidity. It's a heuristic: the solar radiation also
+// depends on the season and on the time of the day, so a clear sky at dawn is
+// reported as "Cloudy", and at night only the humidity is available.
+func classifyCondition(wd *WeatherData, conf config.ConditionConfig) string {
+	switch {
+	case wd.RainRate >= conf.HeavyRainRate:
+		return conditionHeavyRain
+	case wd.RainRate >= conf.RainRate:
+		return conditionRain
+	case wd.SolarRadiation >= conf.DaylightRadiation:
+		if wd.SolarRadiation < conf.CloudyRadiation {
+			return conditionCloudy
+		}
+		return conditionClear
+	case wd.OutdoorHumidity != nil && *wd.OutdoorHumidity >= conf.CloudyHumidity:
+		return conditionCloudy
+	default:
+		return conditionClear
+	}
+}
+
+// The methods used to compute the feels-like temperature.
+const (
+	feelsLikeUS = "us" // wind chill and heat index
+	feelsLikeAU = "au" // Steadman's apparent temperature
+)
+
+// feelsLike returns the feels-like temperature, in °C, computed with method
+// from the temperature (°C), the relative humidity (%) and the wind speed (m/s).
+func feelsLike(method string, temp float64, humidity int, wind float64) float64 {
+	if method == feelsLikeAU {
+		return apparentTemperature(temp, humidity, wind)
+	}
+
+	switch {
+	case temp <= 10 && wind > 4.8/3.6:
+		return windChill(temp, wind)
+	case temp >= 26.7:
+		return heatIndex(temp, humidity)
+	default:
+		return temp
+	}
+}
+
+// windChill is the North American wind chill index, valid for temperatures up
+// to 10°C and wind speeds above 4.8km/h.
+func windChill(temp, wind float64) float64 {
+	v := math.Pow(wind*3.6, 0.16)
+	return 13.12 + 0.6215*temp - 11.37*v + 0.3965*temp*v
+}
+
+// heatIndex is the heat index as computed by the US National Weather Service,
+// valid for temperatures above 26.7°C (80°F).
+func heatIndex(temp float64, humidity int) float64 {
+	t := temp*9/5 + 32
+	rh := float64(humidity)
+
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh - 0.00683783*t*t -
+			0.05481717*rh*rh + 0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+		switch {
+		case rh < 13 && t >= 80 && t <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case rh > 85 && t >= 80 && t <= 87:
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9
+}
+
+// apparentTemperature is Steadman's apparent temperature, as used by the
+// Australian Bureau of Meteorology.
+func apparentTemperature(temp float64, humidity int, wind float64) float64 {
+	e := float64(humidity) / 100 * 6.105 * math.Exp(17.27*temp/(237.7+temp))
+	return temp + 0.33*e - 0.70*wind - 4.00
+}
+
+// The battery status stored in the battery_status_text column.
+const (
+	batteryOK  = "OK"
+	batteryLow = "LOW"
+)
+
+// defaultLowVoltage is the voltage below which a battery is low; Ecowitt
+// sensors run on 1.5V cells.
+const defaultLowVoltage = 1.2
+
+// batteryStatus maps the battery value reported by a sensor to batteryOK or
+// batteryLow, according to the encoding used by the sensor:
+//
+//   - "binary": 0 is OK and 1 is LOW;
+//   - "level": a 0-5 level, LOW at 1 or below;
+//   - "voltage": LOW below the configured voltage;
+//   - "" (auto): 0 and 1 are read as binary, other values as voltages.
+func batteryStatus(value float64, enc config.BatteryEncoding) string {
+	lowVoltage := enc.LowVoltage
+	if lowVoltage == 0 {
+		lowVoltage = defaultLowVoltage
+	}
+
+	var low bool
+	switch enc.Type {
+	case "binary":
+		low = value != 0
+	case "level":
+		low = value <= 1
+	case "voltage":
+		low = value < lowVoltage
+	default:
+		if value == 0 || value == 1 {
+			low = value == 1
+		} else {
+			low = value < lowVoltage
+		}
+	}
+
+	if low {
+		return batteryLow
+	}
+	return batteryOK
+}
+
+// degreeDays returns the contribution of a reading of temp (°C), covering
+// interval, to the heating and cooling degree days over base: the distance
+// from the base temperature weighted by the fraction of the day covered by
+// the reading, so that the sum over a day approximates the integral of the
+// temperature curve.
+func degreeDays(temp, base float64, interval time.Duration) (heating, cooling float64) {
+	day := interval.Hours() / 24
+	return max(base-temp, 0) * day, max(temp-base, 0) * day
+}
+
+// meanDegreeDays returns the heating and cooling degree days of a day from its
+// minimum and maximum temperature, using their mean.
+func meanDegreeDays(tmin, tmax, base float64) (heating, cooling float64) {
+	mean := (tmin + tmax) / 2
+	return max(base-mean, 0), max(mean-base, 0)
+}
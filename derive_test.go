@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestSolarLux(t *testing.T) {
+	got := solarLux(142.55, defaultLuxCoefficient)
+	if want := 18061.085; math.Abs(got-want) > 0.001 {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if got := solarLux(100, 120); got != 12000 {
+		t.Fatalf("expected 12000 with a custom coefficient, got %v", got)
+	}
+}
+
+func TestClassifyCondition(t *testing.T) {
+	conf := conditionDefaults(config.ConditionConfig{})
+
+	tests := []struct {
+		name      string
+		rainRate  float64
+		radiation float64
+		humidity  int
+		want      string
+	}{
+		{"heavy rain", 10, 50, 95, conditionHeavyRain},
+		{"rain", 1.2, 50, 95, conditionRain},
+		{"sunny day", 0, 650, 40, conditionClear},
+		{"overcast day", 0, 80, 70, conditionCloudy},
+		{"humid night", 0, 0, 95, conditionCloudy},
+		{"dry night", 0, 0, 60, conditionClear},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd := WeatherData{RainRate: tt.rainRate, SolarRadiation: tt.radiation, OutdoorHumidity: &tt.humidity}
+			if got := classifyCondition(&wd, conf); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClassifyConditionThresholds(t *testing.T) {
+	conf := conditionDefaults(config.ConditionConfig{HeavyRainRate: 20})
+
+	wd := WeatherData{RainRate: 10}
+	if got := classifyCondition(&wd, conf); got != conditionRain {
+		t.Errorf("expected %q with a custom threshold, got %q", conditionRain, got)
+	}
+}
+
+func TestFeelsLike(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		temp     float64
+		humidity int
+		wind     float64
+		want     float64
+	}{
+		// Environment Canada's wind chill table: -10°C at 20km/h
+		{"us wind chill", feelsLikeUS, -10, 50, 20 / 3.6, -17.86},
+		// NWS heat index table: 90°F at 60% is 100°F, rounded from 99.7°F
+		{"us heat index", feelsLikeUS, 32.22, 60, 1, 37.6},
+		{"us mild", feelsLikeUS, 18, 60, 5, 18},
+		{"us calm and cold", feelsLikeUS, 5, 60, 1, 5},
+		{"au", feelsLikeAU, 30, 50, 2, 31.58},
+		{"au cold and windy", feelsLikeAU, 5, 80, 10, -3.7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := feelsLike(tt.method, tt.temp, tt.humidity, tt.wind)
+			if math.Abs(got-tt.want) > 0.1 {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBatteryStatus(t *testing.T) {
+	tests := []struct {
+		value float64
+		enc   config.BatteryEncoding
+		want  string
+	}{
+		{0, config.BatteryEncoding{Type: "binary"}, batteryOK},
+		{1, config.BatteryEncoding{Type: "binary"}, batteryLow},
+		{5, config.BatteryEncoding{Type: "level"}, batteryOK},
+		{2, config.BatteryEncoding{Type: "level"}, batteryOK},
+		{1, config.BatteryEncoding{Type: "level"}, batteryLow},
+		{1.3, config.BatteryEncoding{Type: "voltage"}, batteryOK},
+		{1.1, config.BatteryEncoding{Type: "voltage"}, batteryLow},
+		{3.0, config.BatteryEncoding{Type: "voltage", LowVoltage: 2.4}, batteryOK},
+		{2.3, config.BatteryEncoding{Type: "voltage", LowVoltage: 2.4}, batteryLow},
+		{0, config.BatteryEncoding{}, batteryOK},
+		{1, config.BatteryEncoding{}, batteryLow},
+		{1.4, config.BatteryEncoding{}, batteryOK},
+		{1.19, config.BatteryEncoding{}, batteryLow},
+	}
+
+	for _, tt := range tests {
+		if got := batteryStatus(tt.value, tt.enc); got != tt.want {
+			t.Errorf("%v with %+v: expected %s, got %s", tt.value, tt.enc, tt.want, got)
+		}
+	}
+}
+
+func TestDegreeDays(t *testing.T) {
+	tests := []struct {
+		name        string
+		temp        float64
+		interval    time.Duration
+		wantHeating float64
+		wantCooling float64
+	}{
+		{"cold minute", 8, time.Minute, 10.0 / 1440, 0},
+		{"hot hour", 27, time.Hour, 0, 9.0 / 24},
+		{"at the base", 18, time.Minute, 0, 0},
+		{"cold day", 3, 24 * time.Hour, 15, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			heating, cooling := degreeDays(tt.temp, 18, tt.interval)
+			if math.Abs(heating-tt.wantHeating) > 1e-9 || math.Abs(cooling-tt.wantCooling) > 1e-9 {
+				t.Errorf("got %v, %v, want %v, %v", heating, cooling, tt.wantHeating, tt.wantCooling)
+			}
+		})
+	}
+
+	// a day of readings every minute at a constant temperature adds up to
+	// the degree days of the day
+	var total float64
+	for range 1440 {
+		heating, _ := degreeDays(10, 18, time.Minute)
+		total += heating
+	}
+	if math.Abs(total-8) > 1e-9 {
+		t.Errorf("expected 8 heating degree days over a day, got %v", total)
+	}
+}
+
+func TestMeanDegreeDays(t *testing.T) {
+	if heating, cooling := meanDegreeDays(4, 14, 18); heating != 9 || cooling != 0 {
+		t.Errorf("got %v, %v, want 9, 0", heating, cooling)
+	}
+	if heating, cooling := meanDegreeDays(20, 30, 18); heating != 0 || cooling != 7 {
+		t.Errorf("got %v, %v, want 0, 7", heating, cooling)
+	}
+}
@@ -27,7 +27,57 @@ CREATE TABLE IF NOT EXISTS weather_station (
     wind_max_daily_gust double precision,
     wind_direction integer,
     wind_gust double precision,
-    wind_speed double precision
+    wind_speed double precision,
+    temperature_probe_ch1 double precision,
+    temperature_probe_ch2 double precision,
+    temperature_probe_ch3 double precision,
+    temperature_probe_ch4 double precision,
+    temperature_probe_ch5 double precision,
+    temperature_probe_ch6 double precision,
+    temperature_probe_ch7 double precision,
+    temperature_probe_ch8 double precision,
+    temperature_probe_battery_ch1 double precision,
+    temperature_probe_battery_ch2 double precision,
+    temperature_probe_battery_ch3 double precision,
+    temperature_probe_battery_ch4 double precision,
+    temperature_probe_battery_ch5 double precision,
+    temperature_probe_battery_ch6 double precision,
+    temperature_probe_battery_ch7 double precision,
+    temperature_probe_battery_ch8 double precision,
+    station_pressure_trend text,
+    station_weather text,
+    wind_gust_smoothed double precision,
+    wind_direction_avg double precision,
+    solar_lux double precision,
+    solar_elevation double precision,
+    is_daytime boolean,
+    condition TEXT,
+    feels_like double precision,
+    pressure_tendency text,
+    forecast text,
+    battery_status_text text,
+    heating_degree_days double precision,
+    cooling_degree_days double precision,
+    daily_rain_mismatch boolean,
+    model_base text,
+    model_version text,
+    station_type_base text,
+    station_type_version text,
+    station_name text,
+    received_at TIMESTAMP,
+    raw_query text,
+    source text,
+    vpd double precision, -- kPa, or hPa with database.vpd_unit: hPa
+    latitude double precision,
+    longitude double precision,
+    altitude double precision,
+    pressure_absolute_inhg double precision,
+    pressure_relative_inhg double precision,
+    rain jsonb
 );
 CREATE EXTENSION IF NOT EXISTS timescaledb;
 SELECT create_hypertable('weather_station', 'time');
+-- Optional: required by DELETE /readings and database.merge; mind that with this index
+-- the duplicate reports fail to be inserted, unless database.merge is enabled or
+-- database.insert_sql uses ON CONFLICT DO NOTHING.
+-- CREATE UNIQUE INDEX ON weather_station (station, time);
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// The defaults of the Elasticsearch sink.
+const (
+	defaultESBatchSize     = 500
+	defaultESFlushInterval = 10 * time.Second
+)
+
+// esShutdownTimeout bounds the last flush of the pending documents.
+const esShutdownTimeout = 10 * time.Second
+
+type esDocument struct {
+	index string
+	body  []byte
+}
+
+// esSink indexes each reading as a document in Elasticsearch or OpenSearch,
+// before writing it to the wrapped sink. The documents are sent in batches with
+// the bulk API, every flush interval or when a batch is full; like for StatsD,
+// indexing is best effort and doesn't affect the storage of the data, and the
+// documents of a failed batch are kept for the next one, up to 10 batches.
+type esSink struct {
+	next   MetricsSink
+	logger *slog.Logger
+	client *http.Client
+
+	url     string
+	indices *partitionNamer
+	conf    config.ElasticsearchConfig
+
+	flush chan struct{}
+
+	mu      sync.Mutex
+	pending []esDocument
+}
+
+func newESSink(logger *slog.Logger, next MetricsSink, conf config.ElasticsearchConfig) (*esSink, error) {
+	index := conf.Index
+	if index == "" {
+		index = "weather-%Y.%m"
+	}
+	indices, err := newPartitionNamer(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultESBatchSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = defaultESFlushInterval
+	}
+
+	return &esSink{
+		next:    next,
+		logger:  logger,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		url:     strings.TrimSuffix(conf.URL, "/"),
+		indices: indices,
+		conf:    conf,
+		flush:   make(chan struct{}, 1),
+	}, nil
+}
+
+// esDocumentBody returns the JSON document for wd: its columns, with the time
+// as @timestamp for Kibana.
+func esDocumentBody(wd *WeatherData) ([]byte, error) {
+	names, values := wd.columnValues(weatherDataColumns)
+
+	doc := make(map[string]any, len(names))
+	for i, name := range names {
+		if name == "time" {
+			name = "@timestamp"
+		}
+		doc[name] = values[i]
+	}
+
+	return json.Marshal(doc)
+}
+
+func (s *esSink) Write(ctx context.Context, wd *WeatherData) error {
+	if body, err := esDocumentBody(wd); err != nil {
+		s.logger.Error("error encoding Elasticsearch document", "err", err)
+	} else {
+		s.mu.Lock()
+		s.pending = append(s.pending, esDocument{index: s.indices.Name(wd.Timestamp), body: body})
+		full := len(s.pending) >= s.conf.BatchSize
+		s.mu.Unlock()
+
+		if full {
+			select {
+			case s.flush <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	return s.next.Write(ctx, wd)
+}
+
+// Run sends the pending documents every flush interval, or as soon as a batch
+// is full, until ctx is cancelled; then it sends the documents left, waiting
+// up to esShutdownTimeout.
+func (s *esSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), esShutdownTimeout)
+			defer cancel()
+			if err := s.Flush(flushCtx); err != nil {
+				s.logger.Error("error indexing documents in Elasticsearch", "err", err)
+			}
+			return
+		case <-ticker.C:
+		case <-s.flush:
+		}
+
+		if err := s.Flush(ctx); err != nil {
+			s.logger.Error("error indexing documents in Elasticsearch", "err", err)
+		}
+	}
+}
+
+// Flush sends the pending documents, in batches.
+func (s *esSink) Flush(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		n := min(len(s.pending), s.conf.BatchSize)
+		batch := s.pending[:n:n]
+		s.pending = s.pending[n:]
+		s.mu.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		if err := s.bulk(ctx, batch); err != nil {
+			s.mu.Lock()
+			s.pending = append(batch, s.pending...)
+			if extra := len(s.pending) - 10*s.conf.BatchSize; extra > 0 {
+				s.logger.Warn("dropping the oldest Elasticsearch documents", "dropped", extra)
+				s.pending = s.pending[extra:]
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// esBulkResponse is the part of the bulk API response we care about.
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (s *esSink) bulk(ctx context.Context, batch []esDocument) error {
+	var body bytes.Buffer
+	for _, doc := range batch {
+		action, err := json.Marshal(map[string]any{"index": map[string]string{"_index": doc.index}})
+		if err != nil {
+			return err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.body)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/_bulk", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case s.conf.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.conf.APIKey)
+	case s.conf.Username != "":
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bulk request returned status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decoding bulk response: %w", err)
+	}
+
+	// documents rejected individually, e.g. because of a mapping conflict,
+	// would fail again if retried
+	if result.Errors {
+		var failed int
+		var reason string
+		for _, item := range result.Items {
+			for _, r := range item {
+				if r.Error != nil {
+					failed++
+					reason = r.Error.Type + ": " + r.Error.Reason
+				}
+			}
+		}
+		s.logger.Error("Elasticsearch rejected some documents", "failed", failed, "documents", len(batch), "last_error", reason)
+	}
+
+	return nil
+}
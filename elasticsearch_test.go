@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestESSink(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []map[string]any
+		auth  string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			lines = append(lines, line)
+		}
+		io.WriteString(w, `{"errors": false, "items": []}`)
+	}))
+	defer srv.Close()
+
+	next := &recordingSink{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	es, err := newESSink(logger, next, config.ElasticsearchConfig{URL: srv.URL + "/", APIKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC)
+	wd := &WeatherData{Timestamp: ts, Station: "station", OutdoorTemperature: 19.9}
+	if err := es.Write(context.Background(), wd); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Written()) != 1 {
+		t.Fatalf("the reading should be written to the wrapped sink")
+	}
+
+	if err := es.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if auth != "ApiKey key" {
+		t.Errorf("unexpected Authorization header %q", auth)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected an action and a document, got %d lines", len(lines))
+	}
+
+	action, _ := lines[0]["index"].(map[string]any)
+	if action["_index"] != "weather-2024.06" {
+		t.Errorf("expected index weather-2024.06, got %v", lines[0])
+	}
+	doc := lines[1]
+	if doc["@timestamp"] != "2024-06-16T16:32:08Z" || doc["station"] != "station" || doc["temperature_outdoor"] != 19.9 {
+		t.Errorf("unexpected document %v", doc)
+	}
+	if _, ok := doc["time"]; ok {
+		t.Errorf("the time should be stored as @timestamp")
+	}
+}
+
+func TestESSinkRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"errors": false, "items": []}`)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	es, err := newESSink(logger, &recordingSink{}, config.ElasticsearchConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := es.Write(context.Background(), &WeatherData{Station: "station"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Flush(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(es.pending) != 1 {
+		t.Fatalf("the failed document should be kept, got %d pending", len(es.pending))
+	}
+	if err := es.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.pending) != 0 {
+		t.Errorf("expected no pending documents, got %d", len(es.pending))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// The defaults of the Graphite sink.
+const (
+	defaultGraphitePrefix = "weather.{station}."
+	graphiteQueueSize     = 100
+	graphiteTimeout       = 5 * time.Second
+)
+
+// graphiteUnsafe matches the characters that can't be part of a node of a
+// Graphite metric path.
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// graphiteSink sends the numeric values of each reading as Graphite plaintext
+// metrics ("path value timestamp") to a carbon endpoint, before writing it to
+// the wrapped sink. The metrics are sent by Run, so that a slow or
+// unreachable endpoint doesn't delay the stations; when the queue is full
+// the readings are dropped. Like for StatsD, sending is best effort: the
+// errors are logged without affecting the storage of the data, and the
+// connection is opened again for the next reading.
+type graphiteSink struct {
+	next    MetricsSink
+	logger  *slog.Logger
+	network string
+	address string
+	prefix  string
+	queue   chan []string
+
+	// conn is only used by Run; nil when disconnected
+	conn net.Conn
+}
+
+func newGraphiteSink(logger *slog.Logger, next MetricsSink, conf config.GraphiteConfig) *graphiteSink {
+	network := conf.Protocol
+	if network == "" {
+		network = "tcp"
+	}
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = defaultGraphitePrefix
+	}
+
+	return &graphiteSink{
+		next:    next,
+		logger:  logger,
+		network: network,
+		address: conf.Address,
+		prefix:  prefix,
+		queue:   make(chan []string, graphiteQueueSize),
+	}
+}
+
+func (s *graphiteSink) Write(ctx context.Context, wd *WeatherData) error {
+	select {
+	case s.queue <- s.lines(wd):
+	default:
+		s.logger.Warn("Graphite queue is full, dropping the reading", "station", wd.Station)
+	}
+
+	return s.next.Write(ctx, wd)
+}
+
+// lines formats the metrics for wd, named with the prefix, where {station}
+// is replaced by the station, followed by the column name.
+func (s *graphiteSink) lines(wd *WeatherData) []string {
+	prefix := strings.ReplaceAll(s.prefix, "{station}", graphiteUnsafe.ReplaceAllString(wd.Station, "_"))
+	timestamp := strconv.FormatInt(wd.Timestamp.Unix(), 10)
+
+	var lines []string
+	names, values := wd.columnValues(weatherDataColumns)
+	for i, name := range names {
+		value, ok := statsdValue(values[i])
+		if !ok {
+			continue
+		}
+		lines = append(lines, prefix+name+" "+value+" "+timestamp+"\n")
+	}
+
+	return lines
+}
+
+// Run sends the queued metrics until ctx is cancelled, then sends the ones
+// left in the queue.
+func (s *graphiteSink) Run(ctx context.Context) {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case lines := <-s.queue:
+					s.sendLogged(lines)
+				default:
+					return
+				}
+			}
+		case lines := <-s.queue:
+			s.sendLogged(lines)
+		}
+	}
+}
+
+func (s *graphiteSink) sendLogged(lines []string) {
+	if err := s.send(lines); err != nil {
+		s.logger.Error("error sending metrics to Graphite", "address", s.address, "err", err)
+	}
+}
+
+// send writes lines to the endpoint, connecting first if needed; a failed
+// write is retried once on a new connection, in case the endpoint closed the
+// previous one, e.g. after a restart.
+func (s *graphiteSink) send(lines []string) error {
+	if s.conn != nil && s.network == "tcp" && closedByPeer(s.conn) {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	var err error
+	for range 2 {
+		if s.conn == nil {
+			if s.conn, err = net.DialTimeout(s.network, s.address, graphiteTimeout); err != nil {
+				return err
+			}
+		}
+
+		if err = s.write(lines); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+// closedByPeer reports whether the endpoint closed conn, which otherwise is
+// only noticed after a write is lost: carbon never sends anything, so a
+// read returns before its deadline only at the end of the stream.
+func closedByPeer(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	_, err := conn.Read(make([]byte, 1))
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (s *graphiteSink) write(lines []string) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout)); err != nil {
+		return err
+	}
+
+	// the datagrams are kept within the usual network MTU, like the
+	// StatsD packets
+	maxPacket := statsdMaxPacket
+	if s.network == "tcp" {
+		maxPacket = 0
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if maxPacket > 0 && buf.Len() > 0 && buf.Len()+len(line) > maxPacket {
+			if _, err := s.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
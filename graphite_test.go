@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestGraphiteSink(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	next := &recordingSink{}
+	sink := newGraphiteSink(logger, next, config.GraphiteConfig{Address: server.Addr().String()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.Run(ctx)
+
+	wd := WeatherData{
+		Station:            "station.1",
+		Timestamp:          time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC),
+		OutdoorTemperature: 19.9,
+		OutdoorHumidity:    ptr(47),
+	}
+
+	// readLines accepts a connection and returns the metrics sent on it
+	readLines := func() map[string]bool {
+		t.Helper()
+		_ = server.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		lines := make(map[string]bool)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines[scanner.Text()] = true
+			if strings.HasPrefix(scanner.Text(), "weather.station_1.wind_speed ") {
+				break
+			}
+		}
+		return lines
+	}
+
+	if err := sink.Write(ctx, &wd); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Written()) != 1 {
+		t.Error("expected the reading to be written to the wrapped sink")
+	}
+
+	lines := readLines()
+	for _, want := range []string{
+		"weather.station_1.temperature_outdoor 19.9 1718555528",
+		"weather.station_1.humidity_outdoor 47 1718555528",
+	} {
+		if !lines[want] {
+			t.Errorf("expected %q in %v", want, lines)
+		}
+	}
+	// the timestamp, strings and missing values are not sent
+	for line := range lines {
+		if strings.HasPrefix(line, "weather.station_1.time ") || strings.HasPrefix(line, "weather.station_1.model ") ||
+			strings.HasPrefix(line, "weather.station_1.uv ") {
+			t.Errorf("unexpected metric %q", line)
+		}
+	}
+
+	// the connection was closed by readLines: the sink reconnects
+	wd.OutdoorTemperature = 20.1
+	if err := sink.Write(ctx, &wd); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLines(); !lines["weather.station_1.temperature_outdoor 20.1 1718555528"] {
+		t.Errorf("expected the second reading after reconnecting, got %v", lines)
+	}
+}
+
+func TestGraphiteSinkUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sink := newGraphiteSink(logger, discardSink{}, config.GraphiteConfig{
+		Address:  server.LocalAddr().String(),
+		Protocol: "udp",
+		Prefix:   "home.{station}.",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.Run(ctx)
+
+	wd := WeatherData{Station: "station", Timestamp: time.Unix(1718555528, 0), OutdoorTemperature: 19.9}
+	if err := sink.Write(ctx, &wd); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > statsdMaxPacket {
+		t.Errorf("datagram of %d bytes exceeds the limit", n)
+	}
+	if !strings.Contains(string(buf[:n]), "home.station.temperature_outdoor 19.9 1718555528\n") {
+		t.Errorf("unexpected datagram %q", buf[:n])
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type gustSample struct {
+	Time time.Time
+	Gust float64
+}
+
+// gustSmoother keeps, for each station, the wind gust readings received within
+// a time window and reports the maximum among them.
+//
+// The buffers only live in memory: after a restart the smoothed value is
+// computed over the readings received since then, until the window is full again.
+type gustSmoother struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	samples *lruMap[[]gustSample]
+}
+
+func newGustSmoother(window time.Duration, maxStations int) *gustSmoother {
+	return &gustSmoother{
+		window:  window,
+		samples: newLRUMap[[]gustSample](maxStations),
+	}
+}
+
+// Add records a gust reading for station and returns the maximum gust seen
+// within the window ending at t. A delayed reading doesn't see the newer
+// ones, which are kept for the readings that follow.
+func (g *gustSmoother) Add(station string, t time.Time, gust float64) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cutoff := t.Add(-g.window)
+	previous, _ := g.samples.Get(station)
+	samples := previous[:0]
+	for _, s := range previous {
+		if s.Time.After(cutoff) {
+			samples = append(samples, s)
+		}
+	}
+	samples = append(samples, gustSample{Time: t, Gust: gust})
+	g.samples.Put(station, samples)
+
+	result := gust
+	for _, s := range samples {
+		if !s.Time.After(t) {
+			result = max(result, s.Gust)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGustSmoother(t *testing.T) {
+	g := newGustSmoother(10*time.Minute, 0)
+	start := time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		station string
+		offset  time.Duration
+		gust    float64
+		want    float64
+	}{
+		{"a", 0, 5.0, 5.0},
+		{"a", time.Minute, 2.0, 5.0},
+		{"b", time.Minute, 1.0, 1.0},
+		{"a", 9 * time.Minute, 3.0, 5.0},
+		// the first sample falls out of the window
+		{"a", 10 * time.Minute, 1.0, 3.0},
+		{"a", 30 * time.Minute, 0.5, 0.5},
+		// a delayed reading doesn't see the newer ones, nor drop them
+		{"c", 0, 2.0, 2.0},
+		{"c", 5 * time.Minute, 8.0, 8.0},
+		{"c", 2 * time.Minute, 1.0, 2.0},
+		{"c", 6 * time.Minute, 1.0, 8.0},
+	}
+
+	for _, tt := range tests {
+		got := g.Add(tt.station, start.Add(tt.offset), tt.gust)
+		if got != tt.want {
+			t.Errorf("station %s at +%s: got %v, want %v", tt.station, tt.offset, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// insertHealth tracks whether the reports received are being stored, to
+// detect the failures where the database answers but the inserts fail, e.g. a
+// missing permission: the collector is unhealthy when the first report
+// received since the last successful insert is older than window.
+type insertHealth struct {
+	window time.Duration
+	clock  Clock
+
+	// pending is the time, in unix nanoseconds, of the first report received
+	// since the last insert, or zero when all were stored.
+	pending atomic.Int64
+}
+
+func newInsertHealth(window time.Duration, clock Clock) *insertHealth {
+	return &insertHealth{window: window, clock: clock}
+}
+
+// Received records that a report is about to be stored.
+func (h *insertHealth) Received() {
+	h.pending.CompareAndSwap(0, h.clock.Now().UnixNano())
+}
+
+// Inserted records that a reading was stored.
+func (h *insertHealth) Inserted() {
+	h.pending.Store(0)
+}
+
+// Check reports whether the reports are being stored; when not, reason
+// describes the failure. The check is disabled when window is zero.
+func (h *insertHealth) Check() (ok bool, reason string) {
+	pending := h.pending.Load()
+	if h.window <= 0 || pending == 0 {
+		return true, ""
+	}
+
+	since := time.Unix(0, pending)
+	if h.clock.Now().Sub(since) <= h.window {
+		return true, ""
+	}
+
+	return false, fmt.Sprintf("no report stored since %s, despite receiving reports", since.UTC().Format(time.RFC3339))
+}
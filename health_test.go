@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInsertHealth(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC))
+	health := newInsertHealth(5*time.Minute, clock)
+	var m maintenanceMode
+	handler := makeHealthHandler(&m, health)
+
+	check := func(want int) maintenanceStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != want {
+			t.Errorf("expected status %d, got %d: %s", want, rec.Code, rec.Body)
+		}
+		var status maintenanceStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	// no reports, nothing to store
+	clock.Advance(time.Hour)
+	check(http.StatusOK)
+
+	health.Received()
+	health.Inserted()
+	clock.Advance(10 * time.Minute)
+	check(http.StatusOK)
+
+	// the reports keep failing to be stored
+	health.Received()
+	clock.Advance(4 * time.Minute)
+	health.Received()
+	check(http.StatusOK)
+	clock.Advance(2 * time.Minute)
+	if status := check(http.StatusServiceUnavailable); status.Status != "unhealthy" || status.Reason == "" {
+		t.Errorf("expected an unhealthy status with a reason, got %+v", status)
+	}
+
+	health.Inserted()
+	check(http.StatusOK)
+
+	// the check is disabled by default
+	health = newInsertHealth(0, clock)
+	health.Received()
+	clock.Advance(time.Hour)
+	if ok, _ := health.Check(); !ok {
+		t.Errorf("expected the check to be disabled")
+	}
+}
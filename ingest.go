@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ingestError is an error returned by the ingest pipeline; Kind is the stage
+// that failed, and is used as the error_type label of the errors metric.
+type ingestError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ingestError) Error() string {
+	return e.Kind + ": " + e.Err.Error()
+}
+
+func (e *ingestError) Unwrap() error {
+	return e.Err
+}
+
+// The values of the source column, telling how a reading arrived.
+const (
+	sourceHTTP     = "ecowitt_http"
+	sourceTempest  = "tempest_udp"
+	sourceReplay   = "replay"
+	sourceSelftest = "selftest"
+)
+
+type ingestSourceKey struct{}
+
+// withIngestSource returns a copy of ctx carrying the source of the readings
+// ingested with it.
+func withIngestSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, ingestSourceKey{}, source)
+}
+
+// ingestSourceFromContext returns the source set with withIngestSource; the
+// readings come from the HTTP endpoint otherwise.
+func ingestSourceFromContext(ctx context.Context) string {
+	if source, ok := ctx.Value(ingestSourceKey{}).(string); ok {
+		return source
+	}
+	return sourceHTTP
+}
+
+// The default range of the reporting intervals accepted from the stations.
+const (
+	defaultMinInterval = 16 * time.Second
+	defaultMaxInterval = time.Hour
+)
+
+// ingester decodes the form data sent by the weather stations, converts it to
+// WeatherData and writes it to a MetricsSink.
+type ingester struct {
+	logger     *slog.Logger
+	sink       MetricsSink
+	stations   *stationTracker
+	clock      Clock
+	windOffset int
+
+	// passkeyID is nil unless the stations are identified by their passkey
+	passkeyID func(passkey string) string
+
+	decoder     *schema.Decoder
+	calibration config.CalibrationConfig
+	interval    config.IntervalConfig
+
+	// the derivations; gusts, directions and pressures are nil when disabled
+	gusts      *gustSmoother
+	directions *directionAverager
+	pressures  *pressureTracker
+	solar      config.SolarConfig
+	condition  config.ConditionConfig
+	feelsLike  string
+	forecast   config.ForecastConfig
+	battery    config.BatteryConfig
+
+	// degreeDays is false unless the degree days use the integration method
+	degreeDays     bool
+	degreeDaysBase float64
+
+	// storeTendency is false when the pressures are only tracked for the
+	// forecast
+	storeTendency bool
+
+	// rain is nil unless the rain reconciliation is enabled
+	rain *rainReconciler
+
+	// models is nil unless the model versions are enabled
+	models *modelSplitter
+
+	// positions are the stations with a location
+	positions map[string]geoPosition
+
+	// throttle is nil when no station has a min_store_interval
+	throttle *storeThrottle
+
+	validators    []Validator
+	floorNegative bool
+
+	// health is nil unless the reports received are tracked
+	health *insertHealth
+
+	storeStationName bool
+	storeReceivedAt  bool
+	storeRaw         bool
+	storeSource      bool
+	storeInHg        bool
+	storeLocation    bool
+	storeVPD         bool
+	vpdHectopascals  bool
+	storeRainJSONB   bool
+	merge            bool
+	decimalComma     bool
+	rainInches       bool
+	maxTextLength    int
+	redactRaw        bool
+	deadLetters      *deadLetterFile
+}
+
+func newIngester(logger *slog.Logger, conf config.Config, sink MetricsSink, stations *stationTracker, clock Clock, windOffset int) *ingester {
+	in := ingester{
+		logger:     logger,
+		stations:   stations,
+		clock:      clock,
+		windOffset: windOffset,
+		sink:       sink,
+		decoder:    schema.NewDecoder(),
+		solar:      conf.Solar,
+		condition:  conditionDefaults(conf.Condition),
+		interval:   conf.Interval,
+		feelsLike:  conf.FeelsLikeMethod,
+		forecast:   conf.Forecast,
+		battery:    conf.Battery,
+
+		calibration: conf.Calibration,
+
+		degreeDays:     conf.DegreeDays.Enabled && conf.DegreeDays.Method != "mean",
+		degreeDaysBase: conf.DegreeDays.BaseTemperature(),
+
+		storeReceivedAt:  conf.Database.StoreReceivedAt,
+		storeRaw:         conf.Database.StoreRaw,
+		storeSource:      conf.Database.StoreSource,
+		storeInHg:        conf.Database.StorePressureInHg,
+		storeLocation:    conf.Database.StoreLocation,
+		storeVPD:         conf.Database.StoreVPD,
+		vpdHectopascals:  conf.Database.VPDUnit == "hPa",
+		storeRainJSONB:   conf.Database.RainJSONB,
+		merge:            conf.Database.Merge,
+		decimalComma:     conf.DecimalSeparator == ",",
+		rainInches:       conf.Database.RainUnit == "in",
+		maxTextLength:    conf.Database.MaxTextLength,
+		redactRaw:        conf.Database.RedactRawPasskey,
+		storeStationName: conf.StationName.Source != "",
+		positions:        stationPositions(conf.Stations),
+		throttle:         newStoreThrottle(conf.Stations),
+		validators:       validators(conf.Validation, clock),
+		floorNegative:    conf.Validation.FloorNegative,
+	}
+
+	if conf.StationID == "passkey" {
+		in.passkeyID = conf.PasskeyID
+	}
+
+	if in.maxTextLength <= 0 {
+		in.maxTextLength = defaultMaxTextLength
+	}
+
+	// stations may send fields we don't know about; they are reported by
+	// checkModelFields instead of failing the whole payload.
+	in.decoder.IgnoreUnknownKeys(true)
+
+	if conf.Database.DeadLetterFile != "" {
+		in.deadLetters = newDeadLetterFile(conf.Database.DeadLetterFile, conf.Database.DeadLetterMaxSize)
+	}
+
+	if in.interval.Min == 0 {
+		in.interval.Min = defaultMinInterval
+	}
+	if in.interval.Max == 0 {
+		in.interval.Max = defaultMaxInterval
+	}
+
+	if conf.RainReconciliation.Enabled {
+		in.rain = newRainReconciler(conf.RainReconciliation, conf.Stations, conf.MaxTrackedStations)
+	}
+
+	if conf.ModelVersion.Enabled {
+		in.models = newModelSplitter(conf.ModelVersion.Pattern)
+	}
+
+	if conf.Wind.GustWindow > 0 {
+		in.gusts = newGustSmoother(conf.Wind.GustWindow, conf.MaxTrackedStations)
+	}
+	if conf.Wind.DirectionWindow > 0 {
+		in.directions = newDirectionAverager(conf.Wind.DirectionWindow, conf.MaxTrackedStations)
+	}
+
+	// the forecast needs the tendency even when it isn't stored
+	if conf.Pressure.Tendency || conf.Forecast.Enabled {
+		in.storeTendency = conf.Pressure.Tendency
+		window, threshold := conf.Pressure.TendencyWindow, conf.Pressure.TendencyThreshold
+		if window == 0 {
+			window = defaultTendencyWindow
+		}
+		if threshold == 0 {
+			threshold = defaultTendencyThreshold
+		}
+		in.pressures = newPressureTracker(window, threshold, conf.MaxTrackedStations)
+	}
+
+	return &in
+}
+
+// Ingest runs form through the decode, convert and insert pipeline, returning
+// the stored WeatherData; the error is errThrottled, along with the reading,
+// when min_store_interval drops it.
+func (in *ingester) Ingest(ctx context.Context, form url.Values) (*WeatherData, error) {
+	logger := requestLogger(ctx, in.logger)
+	now := in.clock.Now()
+
+	// the body as sent, for the raw_query column and the dead-letter file;
+	// it's not available when the report didn't come from the HTTP handler,
+	// e.g. when replayed
+	body, ok := rawBodyFromContext(ctx)
+	if !ok {
+		body = form.Encode()
+	}
+
+	decoded := form
+	if in.decimalComma {
+		decoded = withDecimalPoints(form)
+	}
+
+	var p payload
+	_, span := startSpan(ctx, "decode")
+	err := validatePayload(&p, in.decoder.Decode(&p, decoded))
+	endSpan(span, err)
+	if err != nil {
+		in.deadLetter(logger, now, in.station(&p), err, body)
+		return nil, in.failed(in.station(&p), now, &ingestError{Kind: "decoder", Err: err})
+	}
+
+	if unexpected, missing, ok := checkModelFields(p.Model, form); ok {
+		if len(unexpected) > 0 {
+			logger.Warn("station sent fields unknown for its model, possible firmware change",
+				"station", in.station(&p), "model", p.Model, "fields", unexpected)
+		}
+		if len(missing) > 0 {
+			logger.Warn("station didn't send fields expected for its model, possible sensor failure",
+				"station", in.station(&p), "model", p.Model, "fields", missing)
+		}
+	}
+
+	if in.windOffset != 0 && p.WindDir.Valid {
+		p.WindDir.Value = offsetDegrees(p.WindDir.Value, in.windOffset)
+	}
+
+	_, span = startSpan(ctx, "convert")
+	wd, err := NewWeatherData(p, in.calibration)
+	endSpan(span, err)
+	if err != nil {
+		return nil, in.failed(in.station(&p), now, &ingestError{Kind: "converter", Err: err})
+	}
+	wd.Station = in.station(&p)
+
+	if in.storeInHg {
+		// the Tempest reports the pressures in hPa, so they are only
+		// available for the Ecowitt stations
+		absolute, relative := p.BaromAbsIn, p.BaromRelIn
+		wd.AbsolutePressureInHg = &absolute
+		wd.RelativePressureInHg = &relative
+	}
+
+	if in.storeVPD && p.VPD.Valid {
+		vpd := p.VPD.Value
+		if in.vpdHectopascals {
+			vpd *= hectopascalsPerKilopascal
+		}
+		wd.VPD = &vpd
+	}
+
+	wd.unreported = unreportedColumns(form)
+
+	if in.storeRaw {
+		raw := body
+		if in.redactRaw {
+			raw = redactPasskey(raw)
+		}
+		wd.RawQuery = &raw
+	}
+
+	return wd, in.store(ctx, logger, wd, now, body)
+}
+
+// store runs the converted wd through the derivations and writes it to the
+// sink; body is the raw report, stored in the dead-letter file when the write
+// fails, if not empty. It returns errThrottled, without writing wd, when
+// min_store_interval drops it.
+func (in *ingester) store(ctx context.Context, logger *slog.Logger, wd *WeatherData, now time.Time, body string) error {
+	// a firmware bug could send a bogus interval, which would also break the
+	// staleness detection
+	if wd.Interval < in.interval.Min || wd.Interval > in.interval.Max {
+		clamped := min(max(wd.Interval, in.interval.Min), in.interval.Max)
+		logger.Warn("station sent an interval out of range, clamping it",
+			"station", wd.Station, "interval", wd.Interval, "clamped", clamped)
+		wd.Interval = clamped
+	}
+
+	if in.storeStationName {
+		name := stationNameFromContext(ctx)
+		if name == "" {
+			name = in.stations.Name(wd.Station)
+		}
+		if name == "" {
+			name = wd.Station
+		}
+		wd.StationName = &name
+	}
+
+	if truncated := truncateText(wd, in.maxTextLength); len(truncated) > 0 {
+		logger.Warn("station sent text values over the maximum length, truncating them",
+			"station", wd.Station, "fields", truncated, "max_length", in.maxTextLength)
+	}
+
+	// the negative values are floored before any derivation or metric uses
+	// them, rather than being rejected by the validators
+	if in.floorNegative {
+		if floored := floorNegative(wd); len(floored) > 0 {
+			logger.Warn("station sent negative values, storing them as zero",
+				"station", wd.Station, "fields", floored)
+		}
+	}
+
+	if in.storeReceivedAt {
+		receivedAt := now.UTC()
+		wd.ReceivedAt = &receivedAt
+	}
+
+	if in.storeSource {
+		source := ingestSourceFromContext(ctx)
+		wd.Source = &source
+	}
+
+	updateStationMetrics(wd, now)
+	if in.stations.Seen(wd, now) {
+		logger.Info("station is back online", "station", wd.Station)
+	}
+
+	if in.gusts != nil && wd.reported("wind_gust") {
+		smoothed := in.gusts.Add(wd.Station, wd.Timestamp, wd.WindGust)
+		wd.WindGustSmoothed = &smoothed
+	}
+
+	if in.directions != nil && wd.WindDirection != nil {
+		if avg, ok := in.directions.Add(wd.Station, wd.Timestamp, *wd.WindDirection); ok {
+			wd.WindDirectionAvg = &avg
+		}
+	}
+
+	if in.pressures != nil && wd.reported("pressure_relative") {
+		if tendency, ok := in.pressures.Add(wd.Station, wd.Timestamp, wd.RelativePressure); ok {
+			if in.storeTendency {
+				wd.PressureTendency = &tendency
+			}
+			if in.forecast.Enabled {
+				// without the wind, the forecast is made as if it was calm
+				windSpeed, windDir := wd.WindSpeed, 0
+				if wd.WindDirection != nil && wd.reported("wind_speed") {
+					windDir = *wd.WindDirection
+				} else {
+					windSpeed = 0
+				}
+				forecast := zambretti(wd.RelativePressure, tendency, windDir, windSpeed, wd.Timestamp, in.forecast.SouthernHemisphere)
+				wd.Forecast = &forecast
+			}
+		}
+	}
+
+	if in.solar.Lux && wd.reported("solar_radiation") {
+		coefficient := in.solar.LuxCoefficient
+		if coefficient == 0 {
+			coefficient = defaultLuxCoefficient
+		}
+		lux := solarLux(wd.SolarRadiation, coefficient)
+		wd.SolarLux = &lux
+	}
+
+	pos := in.positions[wd.Station]
+	if in.storeLocation {
+		wd.Latitude, wd.Longitude, wd.Altitude = pos.latitude, pos.longitude, pos.altitude
+	}
+	if pos.located() {
+		elevation := solarElevation(wd.Timestamp, *pos.latitude, *pos.longitude)
+		daytime := isDaytime(elevation)
+		wd.SolarElevation, wd.IsDaytime = &elevation, &daytime
+	}
+
+	if in.condition.Enabled && wd.reported("rain_rate", "solar_radiation") {
+		condition := classifyCondition(wd, in.condition)
+		wd.Condition = &condition
+	}
+
+	// the feels-like temperature can't be computed without the humidity
+	if in.feelsLike != "" && wd.OutdoorHumidity != nil && wd.reported("temperature_outdoor", "wind_speed") {
+		fl := feelsLike(in.feelsLike, wd.OutdoorTemperature, *wd.OutdoorHumidity, wd.WindSpeed)
+		wd.FeelsLike = &fl
+	}
+
+	if in.battery.StatusText && wd.reported("battery") {
+		// the battery column is the one of the WH65 sensor array
+		status := batteryStatus(wd.BatteryLevel, in.battery.Sensors["wh65"])
+		wd.BatteryStatus = &status
+	}
+
+	if in.degreeDays && wd.reported("temperature_outdoor") {
+		heating, cooling := degreeDays(wd.OutdoorTemperature, in.degreeDaysBase, wd.Interval)
+		wd.HeatingDegreeDays, wd.CoolingDegreeDays = &heating, &cooling
+	}
+
+	if in.rain != nil && wd.reported("daily_rain", "total_rain") {
+		fromTotal, mismatch, started, ok := in.rain.Add(wd.Station, wd.Timestamp, wd.DailyRain, wd.TotalRain)
+		if ok {
+			wd.DailyRainMismatch = &mismatch
+		}
+		if started {
+			logger.Warn("station's daily rain differs from the increase of the total rain since midnight",
+				"station", wd.Station, "daily_rain", wd.DailyRain, "from_total", fromTotal)
+		}
+	}
+
+	if in.models != nil {
+		wd.ModelBase, wd.ModelVersion = in.models.Columns(wd.Model)
+		wd.StationTypeBase, wd.StationTypeVersion = in.models.Columns(wd.StationType)
+	}
+
+	if err := validateReading(in.validators, wd); err != nil {
+		return in.failed(wd.Station, now, &ingestError{Kind: "validator", Err: err})
+	}
+
+	// the derivations and the metrics use mm, so the conversion comes last
+	if in.rainInches {
+		wd.rainToInches()
+	}
+
+	if in.storeRainJSONB {
+		wd.Rain = newRainData(wd)
+	}
+
+	if in.throttle != nil {
+		ok, dropped := in.throttle.Allow(wd.Station, wd.Timestamp)
+		if !ok {
+			readingsThrottled.With(prometheus.Labels{"station": wd.Station}).Inc()
+			return errThrottled
+		}
+		if dropped > 0 {
+			logger.Info("dropped readings received before min_store_interval", "station", wd.Station, "dropped", dropped)
+		}
+	}
+
+	if in.health != nil {
+		in.health.Received()
+	}
+
+	writeCtx, span := startSpan(ctx, "write", attribute.String("station", wd.Station))
+	err := in.sink.Write(writeCtx, wd)
+	endSpan(span, err)
+	if err != nil {
+		if errors.Is(err, errSinkBusy) {
+			return in.failed(wd.Station, now, &ingestError{Kind: "busy", Err: err})
+		}
+		in.deadLetter(logger, now, wd.Station, err, body)
+		return in.failed(wd.Station, now, &ingestError{Kind: "db", Err: err})
+	}
+
+	return nil
+}
+
+// station returns the value of the station column for the reports sent with
+// p: the station type or, with station_id "passkey", the identifier derived
+// from the passkey, which is never published as is.
+func (in *ingester) station(p *payload) string {
+	if in.passkeyID != nil {
+		return in.passkeyID(p.Passkey)
+	}
+	return p.StationType
+}
+
+// deadLetter appends body, the raw report of station that couldn't be
+// stored because of err, to the dead-letter file, if any.
+func (in *ingester) deadLetter(logger *slog.Logger, now time.Time, station string, err error, body string) {
+	if in.deadLetters == nil || body == "" {
+		return
+	}
+
+	entry := deadLetter{Time: now.UTC(), Station: station, Error: err.Error(), Body: body}
+	if dlErr := in.deadLetters.Write(entry); dlErr != nil {
+		logger.Error("error writing to the dead-letter file", "err", dlErr)
+	}
+}
+
+// failed records err as the last error of station, shown by /stations, and
+// returns it.
+func (in *ingester) failed(station string, now time.Time, err *ingestError) error {
+	in.stations.Failed(station, now, err)
+	return err
+}
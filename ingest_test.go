@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const sampleQuery = `PASSKEY=LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI&stationtype=EasyWeatherPro_V5.1.3&runtime=1240&dateutc=2024-06-16+16:32:08&tempinf=70.0&humidityin=48&baromrelin=29.920&baromabsin=29.565&tempf=67.8&humidity=47&winddir=196&windspeedmph=0.22&windgustmph=1.12&maxdailygust=4.47&solarradiation=142.55&uv=1&rainratein=0.000&eventrainin=0.000&hourlyrainin=0.000&dailyrainin=0.000&weeklyrainin=0.000&monthlyrainin=0.000&yearlyrainin=0.000&totalrainin=0.000&vpd=0.153&wh65batt=0&freq=868M&model=WS2900_V2.02.03&interval=60`
+
+func newTestIngester(t *testing.T, conf config.Config, sink MetricsSink) *ingester {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	clock := newFakeClock(time.Date(2024, 6, 16, 16, 32, 10, 0, time.UTC))
+	return newIngester(logger, conf, sink, newStationTracker(conf.Stations, conf.MaxTrackedStations), clock, -90)
+}
+
+func TestIngest(t *testing.T) {
+	sink := &recordingSink{}
+	in := newTestIngester(t, config.Config{}, sink)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if written := sink.Written(); len(written) != 1 || written[0] != wd {
+		t.Fatalf("the returned WeatherData was not stored")
+	}
+
+	if wd.Station != "EasyWeatherPro_V5.1.3" {
+		t.Errorf("unexpected station %q", wd.Station)
+	}
+	if want := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC); !wd.Timestamp.Equal(want) {
+		t.Errorf("expected timestamp %s, got %s", want, wd.Timestamp)
+	}
+	if math.Abs(wd.OutdoorTemperature-19.89) > 0.01 {
+		t.Errorf("expected outdoor temperature ~19.89, got %v", wd.OutdoorTemperature)
+	}
+	if math.Abs(wd.RelativePressure-1013.2) > 0.1 {
+		t.Errorf("expected relative pressure ~1013.2, got %v", wd.RelativePressure)
+	}
+	// the wind direction is corrected by the -90 degrees offset
+	if *wd.WindDirection != 106 {
+		t.Errorf("expected wind direction 106, got %d", *wd.WindDirection)
+	}
+	if wd.Interval != time.Minute {
+		t.Errorf("expected interval 1m, got %s", wd.Interval)
+	}
+}
+
+func TestIngestErrors(t *testing.T) {
+	in := newTestIngester(t, config.Config{}, &recordingSink{err: errors.New("database is down")})
+
+	tests := []struct {
+		name  string
+		query string
+		kind  string
+	}{
+		{"decoder", "dateutc=yesterday", "decoder"},
+		{"db", sampleQuery, "db"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = in.Ingest(context.Background(), form)
+			var ie *ingestError
+			if !errors.As(err, &ie) {
+				t.Fatalf("expected an ingestError, got %v", err)
+			}
+			if ie.Kind != tt.kind {
+				t.Errorf("expected kind %q, got %q", tt.kind, ie.Kind)
+			}
+		})
+	}
+}
+
+func TestIngestReceivedAt(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		conf := config.Config{Database: config.DatabaseConfig{StoreReceivedAt: enabled}}
+		in := newTestIngester(t, conf, &recordingSink{})
+
+		wd, err := in.Ingest(context.Background(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !enabled {
+			if wd.ReceivedAt != nil {
+				t.Errorf("expected no received_at when disabled, got %s", wd.ReceivedAt)
+			}
+			continue
+		}
+
+		if wd.ReceivedAt == nil || !wd.ReceivedAt.Equal(in.clock.Now()) {
+			t.Errorf("expected received_at %s, got %v", in.clock.Now(), wd.ReceivedAt)
+		}
+	}
+}
+
+func TestIngestIntervalClamp(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+	}{
+		{"60", 60 * time.Second},
+		{"0", defaultMinInterval},
+		{"86400", defaultMaxInterval},
+	}
+
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+	for _, tt := range tests {
+		form, err := url.ParseQuery(sampleQuery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		form.Set("interval", tt.interval)
+
+		wd, err := in.Ingest(context.Background(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wd.Interval != tt.want {
+			t.Errorf("interval %s: expected %s, got %s", tt.interval, tt.want, wd.Interval)
+		}
+	}
+}
+
+func TestIngestPasskeyStationID(t *testing.T) {
+	conf := config.Config{StationID: "passkey", StationIDKey: "key"}
+	in := newTestIngester(t, conf, &recordingSink{})
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := conf.PasskeyID("LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI"); wd.Station != want {
+		t.Errorf("expected station %q, got %q", want, wd.Station)
+	}
+}
+
+func TestIngestMinStoreInterval(t *testing.T) {
+	sink := &recordingSink{}
+	conf := config.Config{
+		Stations: map[string]config.StationConfig{
+			"EasyWeatherPro_V5.1.3": {MinStoreInterval: time.Minute},
+		},
+	}
+	in := newTestIngester(t, conf, sink)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := in.Ingest(context.Background(), form); err != nil {
+		t.Fatal(err)
+	}
+
+	before := testutil.ToFloat64(readingsThrottled.WithLabelValues("EasyWeatherPro_V5.1.3"))
+	if wd, err := in.Ingest(context.Background(), form); !errors.Is(err, errThrottled) || wd == nil {
+		t.Fatalf("expected the second reading to be throttled, got %v", err)
+	}
+	if got := testutil.ToFloat64(readingsThrottled.WithLabelValues("EasyWeatherPro_V5.1.3")); got != before+1 {
+		t.Errorf("expected 1 throttled reading, got %v", got-before)
+	}
+
+	if written := sink.Written(); len(written) != 1 {
+		t.Errorf("expected 1 stored reading, got %d", len(written))
+	}
+}
+
+func TestIngestSolarElevation(t *testing.T) {
+	const station = "EasyWeatherPro_V5.1.3"
+	conf := config.Config{Stations: map[string]config.StationConfig{
+		station: {Latitude: ptr(51.5074), Longitude: ptr(-0.1278)},
+	}}
+	sink := &recordingSink{}
+	in := newTestIngester(t, conf, sink)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mid-afternoon in London
+	if wd.IsDaytime == nil || !*wd.IsDaytime || wd.SolarElevation == nil || *wd.SolarElevation < 30 {
+		t.Errorf("expected a daytime reading, got %v and %v", wd.IsDaytime, wd.SolarElevation)
+	}
+
+	// the stations without a location don't have the columns
+	form.Set("stationtype", "other")
+	wd, err = in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := wd.columnValues(weatherDataColumns)
+	if slices.Contains(names, "is_daytime") || slices.Contains(names, "solar_elevation") {
+		t.Errorf("unexpected solar columns for a station without a location: %v", names)
+	}
+}
+
+func TestIngestLocation(t *testing.T) {
+	const station = "EasyWeatherPro_V5.1.3"
+	conf := config.Config{
+		Database: config.DatabaseConfig{StoreLocation: true},
+		Stations: map[string]config.StationConfig{
+			station: {Latitude: ptr(51.5074), Longitude: ptr(-0.1278), Altitude: ptr(11.0)},
+		},
+	}
+	in := newTestIngester(t, conf, &recordingSink{})
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd.Latitude == nil || *wd.Latitude != 51.5074 || wd.Longitude == nil || *wd.Longitude != -0.1278 ||
+		wd.Altitude == nil || *wd.Altitude != 11 {
+		t.Errorf("unexpected location %v, %v, %v", wd.Latitude, wd.Longitude, wd.Altitude)
+	}
+
+	// the stations without a location don't have the columns
+	form.Set("stationtype", "other")
+	wd, err = in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := wd.columnValues(weatherDataColumns)
+	if slices.Contains(names, "latitude") || slices.Contains(names, "altitude") {
+		t.Errorf("unexpected location columns for a station without a location: %v", names)
+	}
+}
+
+func TestIngestDerivations(t *testing.T) {
+	conf := config.Config{Derivations: []string{"solar_lux", "feels_like"}}
+	if err := conf.ApplyDerivations(); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	in := newTestIngester(t, conf, sink)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := wd.columnValues(weatherDataColumns)
+	for _, name := range []string{"solar_lux", "feels_like"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("requested derivation %s should be stored", name)
+		}
+	}
+	for _, name := range []string{"condition", "pressure_tendency", "forecast", "battery_status_text", "wind_gust_smoothed", "heating_degree_days"} {
+		if slices.Contains(names, name) {
+			t.Errorf("derivation %s was not requested and should not be stored", name)
+		}
+	}
+
+	for _, derivations := range [][]string{{"dew_point"}, {"wind_gust_smoothed"}} {
+		conf := config.Config{Derivations: derivations}
+		if err := conf.ApplyDerivations(); err == nil {
+			t.Errorf("expected an error for derivations %v", derivations)
+		}
+	}
+}
+
+func TestIngestSource(t *testing.T) {
+	conf := config.Config{Database: config.DatabaseConfig{StoreSource: true}}
+	in := newTestIngester(t, conf, &recordingSink{})
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), "ecowitt_http"},
+		{withIngestSource(context.Background(), sourceReplay), "replay"},
+	}
+	for _, tt := range tests {
+		wd, err := in.Ingest(tt.ctx, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wd.Source == nil || *wd.Source != tt.want {
+			t.Errorf("expected source %q, got %v", tt.want, wd.Source)
+		}
+	}
+
+	stored, err := in.IngestTempest(context.Background(), []byte(tempestSamplePacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].Source == nil || *stored[0].Source != "tempest_udp" {
+		t.Errorf("expected the tempest_udp source, got %+v", stored)
+	}
+
+	// the column is not written unless enabled
+	in = newTestIngester(t, config.Config{}, &recordingSink{})
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd.Source != nil {
+		t.Errorf("expected no source, got %q", *wd.Source)
+	}
+}
+
+func TestIngestPressureInHg(t *testing.T) {
+	conf := config.Config{Database: config.DatabaseConfig{StorePressureInHg: true}}
+	in := newTestIngester(t, conf, &recordingSink{})
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(wd.AbsolutePressure-1001.2) > 0.1 || math.Abs(wd.RelativePressure-1013.2) > 0.1 {
+		t.Errorf("expected the pressures in hPa, got %.1f and %.1f", wd.AbsolutePressure, wd.RelativePressure)
+	}
+	if wd.AbsolutePressureInHg == nil || *wd.AbsolutePressureInHg != 29.565 {
+		t.Errorf("expected an absolute pressure of 29.565 inHg, got %v", wd.AbsolutePressureInHg)
+	}
+	if wd.RelativePressureInHg == nil || *wd.RelativePressureInHg != 29.920 {
+		t.Errorf("expected a relative pressure of 29.920 inHg, got %v", wd.RelativePressureInHg)
+	}
+}
+
+func TestIngestVPD(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		conf config.DatabaseConfig
+		want *float64
+	}{
+		{config.DatabaseConfig{}, nil},
+		{config.DatabaseConfig{StoreVPD: true}, ptr(0.153)},
+		{config.DatabaseConfig{StoreVPD: true, VPDUnit: "kPa"}, ptr(0.153)},
+		{config.DatabaseConfig{StoreVPD: true, VPDUnit: "hPa"}, ptr(1.53)},
+	} {
+		in := newTestIngester(t, config.Config{Database: tt.conf}, &recordingSink{})
+		wd, err := in.Ingest(context.Background(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (wd.VPD == nil) != (tt.want == nil) || (wd.VPD != nil && math.Abs(*wd.VPD-*tt.want) > 1e-9) {
+			t.Errorf("%+v: expected a VPD of %v, got %v", tt.conf, tt.want, wd.VPD)
+		}
+	}
+}
+
+func TestIngestTruncateText(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("model", "WS2900_"+strings.Repeat("V", 300))
+	form.Set("weather", strings.Repeat("é", 200))
+
+	tests := []struct {
+		maxLength int
+		want      int
+	}{
+		{0, defaultMaxTextLength},
+		{40, 40},
+	}
+	for _, tt := range tests {
+		conf := config.Config{Database: config.DatabaseConfig{MaxTextLength: tt.maxLength}}
+		in := newTestIngester(t, conf, &recordingSink{})
+
+		wd, err := in.Ingest(context.Background(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wd.Model) != tt.want || !strings.HasPrefix(wd.Model, "WS2900_") {
+			t.Errorf("max %d: expected the model to be truncated to %d characters, got %d", tt.maxLength, tt.want, len(wd.Model))
+		}
+		if n := utf8.RuneCountInString(*wd.StationWeather); n != tt.want || !utf8.ValidString(*wd.StationWeather) {
+			t.Errorf("max %d: expected the weather to be truncated to %d characters, got %d", tt.maxLength, tt.want, n)
+		}
+		if wd.StationType != "EasyWeatherPro_V5.1.3" {
+			t.Errorf("max %d: expected the station type not to be truncated, got %q", tt.maxLength, wd.StationType)
+		}
+	}
+}
+
+func TestIngestRainUnit(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("rainratein", "0.5")
+	form.Set("dailyrainin", "1.2")
+
+	tests := []struct {
+		unit      string
+		wantRate  float64
+		wantDaily float64
+	}{
+		{"", 12.7, 30.48},
+		{"mm", 12.7, 30.48},
+		{"in", 0.5, 1.2},
+	}
+	for _, tt := range tests {
+		conf := config.Config{Database: config.DatabaseConfig{RainUnit: tt.unit, RainJSONB: true}}
+		in := newTestIngester(t, conf, &recordingSink{})
+
+		wd, err := in.Ingest(context.Background(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(wd.RainRate-tt.wantRate) > 1e-9 || math.Abs(wd.DailyRain-tt.wantDaily) > 1e-9 {
+			t.Errorf("%q: expected a rate of %v and a daily rain of %v, got %v and %v", tt.unit, tt.wantRate, tt.wantDaily, wd.RainRate, wd.DailyRain)
+		}
+		if wd.Rain == nil || wd.Rain.RainRate != wd.RainRate {
+			t.Errorf("%q: expected the jsonb column in the same unit, got %+v", tt.unit, wd.Rain)
+		}
+	}
+}
+
+func TestIngestDecimalComma(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("baromabsin", "29,565")
+	form.Set("tempf", "67,8")
+	form.Set("vpd", "0,153")
+	form.Set("freq", "868,5M")
+
+	// the default is strict
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+	if _, err := in.Ingest(context.Background(), form); err == nil {
+		t.Fatal("expected the comma decimals to be rejected by default")
+	}
+
+	sink := &recordingSink{}
+	in = newTestIngester(t, config.Config{DecimalSeparator: ","}, sink)
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(wd.AbsolutePressure-1001.19) > 0.01 {
+		t.Errorf("expected an absolute pressure of 1001.19 hPa, got %v", wd.AbsolutePressure)
+	}
+	if math.Abs(wd.OutdoorTemperature-19.89) > 0.01 {
+		t.Errorf("expected an outdoor temperature of 19.89 °C, got %v", wd.OutdoorTemperature)
+	}
+	// the text fields are left alone
+	if wd.Frequency != "868,5M" {
+		t.Errorf("expected the frequency to be unchanged, got %q", wd.Frequency)
+	}
+	if got := form.Get("tempf"); got != "67,8" {
+		t.Errorf("expected the form to be unchanged, got tempf=%q", got)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// insertTemplate is a custom INSERT statement, configured with named
+// placeholders like :temperature_outdoor referencing the WeatherData columns,
+// converted to positional parameters.
+type insertTemplate struct {
+	sql     string
+	columns []dbColumn
+}
+
+// parseInsertTemplate converts the placeholders of tmpl to positional
+// parameters, checking that they reference known columns. Casts like
+// "::numeric" are left alone.
+func parseInsertTemplate(tmpl string) (*insertTemplate, error) {
+	var (
+		b       strings.Builder
+		columns []dbColumn
+	)
+
+	isNameChar := func(c byte) bool {
+		return c == '_' || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+	}
+
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		if c != ':' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 < len(tmpl) && tmpl[i+1] == ':' {
+			b.WriteString("::")
+			i++
+			continue
+		}
+
+		end := i + 1
+		for end < len(tmpl) && isNameChar(tmpl[end]) {
+			end++
+		}
+		if end == i+1 {
+			b.WriteByte(c)
+			continue
+		}
+
+		name := tmpl[i+1 : end]
+		idx := slices.IndexFunc(columns, func(col dbColumn) bool { return col.Name == name })
+		if idx < 0 {
+			col := slices.IndexFunc(weatherDataColumns, func(col dbColumn) bool { return col.Name == name })
+			if col < 0 {
+				return nil, fmt.Errorf("unknown column :%s in insert_sql", name)
+			}
+			columns = append(columns, weatherDataColumns[col])
+			idx = len(columns) - 1
+		}
+		fmt.Fprintf(&b, "$%d", idx+1)
+		i = end - 1
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("insert_sql doesn't reference any column")
+	}
+
+	return &insertTemplate{sql: b.String(), columns: columns}, nil
+}
+
+// args returns the values of the template's parameters for wd.
+func (t *insertTemplate) args(wd *WeatherData) []any {
+	v := reflect.ValueOf(wd).Elem()
+
+	args := make([]any, len(t.columns))
+	for i, col := range t.columns {
+		args[i] = columnValue(col, v.Field(col.Index))
+	}
+
+	return args
+}
+
+func (t *insertTemplate) exec(ctx context.Context, wd *WeatherData, db Execer) error {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	if _, err := db.Exec(ctx, t.sql, t.args(wd)...); err != nil {
+		return fmt.Errorf("executing insert_sql: %w", err)
+	}
+
+	return nil
+}
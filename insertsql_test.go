@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseInsertTemplate(t *testing.T) {
+	tmpl, err := parseInsertTemplate(
+		"INSERT INTO readings (ts, station, temp, temp_f, wind) VALUES (:time, :station, :temperature_outdoor, :temperature_outdoor * 9 / 5 + 32, :wind_speed::numeric) ON CONFLICT DO NOTHING")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "INSERT INTO readings (ts, station, temp, temp_f, wind) VALUES ($1, $2, $3, $3 * 9 / 5 + 32, $4::numeric) ON CONFLICT DO NOTHING"
+	if tmpl.sql != want {
+		t.Errorf("expected %q, got %q", want, tmpl.sql)
+	}
+
+	ts := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC)
+	wd := WeatherData{Timestamp: ts, Station: "station", OutdoorTemperature: 19.9, WindSpeed: 1.2}
+	db := &recordingExecer{}
+	if err := tmpl.exec(context.Background(), &wd, db); err != nil {
+		t.Fatal(err)
+	}
+
+	args := db.args[0]
+	if len(args) != 4 || args[0] != ts || args[1] != "station" || args[2] != 19.9 || args[3] != 1.2 {
+		t.Errorf("unexpected arguments %v", args)
+	}
+}
+
+func TestParseInsertTemplateErrors(t *testing.T) {
+	for _, tmpl := range []string{
+		"INSERT INTO readings (temp) VALUES (:outdoor_temperature)",
+		"INSERT INTO readings (temp) VALUES (1)",
+	} {
+		if _, err := parseInsertTemplate(tmpl); err == nil {
+			t.Errorf("expected an error for %q", tmpl)
+		}
+	}
+}
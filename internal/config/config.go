@@ -1,37 +1,1025 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	LogLevel string         `yaml:"log_level"`
-	Database DatabaseConfig `yaml:"database"`
-	HTTP     HTTPConfig     `yaml:"http"`
+	LogLevel string `yaml:"log_level"`
+
+	// InstanceName identifies this collector in the logs and in the
+	// instance_name label of the Prometheus metrics; the hostname when
+	// empty.
+	InstanceName string `yaml:"instance_name"`
+
+	Database  DatabaseConfig  `yaml:"database"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	UDP       UDPConfig       `yaml:"udp"`
+	Wind      WindConfig      `yaml:"wind"`
+	Solar     SolarConfig     `yaml:"solar"`
+	Pressure  PressureConfig  `yaml:"pressure"`
+	Condition ConditionConfig `yaml:"condition"`
+	Forecast  ForecastConfig  `yaml:"forecast"`
+	Battery   BatteryConfig   `yaml:"battery"`
+
+	DegreeDays DegreeDaysConfig `yaml:"degree_days"`
+
+	RainReconciliation RainReconciliationConfig `yaml:"rain_reconciliation"`
+
+	ModelVersion ModelVersionConfig `yaml:"model_version"`
+
+	// Derivations lists the derived columns to compute and store, as an
+	// alternative to enabling them one by one in their sections; see
+	// ApplyDerivations.
+	Derivations []string `yaml:"derivations"`
+
+	// FeelsLikeMethod enables storing the feels-like temperature in the
+	// feels_like column: "us" for the wind chill and heat index, "au" for
+	// the apparent temperature.
+	FeelsLikeMethod string `yaml:"feels_like_method"`
+
+	Staleness StalenessConfig `yaml:"staleness"`
+	Interval  IntervalConfig  `yaml:"interval"`
+
+	Calibration CalibrationConfig `yaml:"calibration"`
+	Validation  ValidationConfig  `yaml:"validation"`
+
+	// SnapshotFile enables writing the latest reading of each station to
+	// this JSON file, after each insert.
+	SnapshotFile string `yaml:"snapshot_file"`
+
+	Buffer        BufferConfig        `yaml:"buffer"`
+	WorkerPool    WorkerPoolConfig    `yaml:"worker_pool"`
+	StatsD        StatsDConfig        `yaml:"statsd"`
+	Graphite      GraphiteConfig      `yaml:"graphite"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+	Kafka         KafkaConfig         `yaml:"kafka"`
+	RemoteWrite   RemoteWriteConfig   `yaml:"remote_write"`
+	Sinks         SinksConfig         `yaml:"sinks"`
+	Archive       ArchiveConfig       `yaml:"archive"`
+	Cloud         CloudConfig         `yaml:"cloud"`
+	OTel          OTelConfig          `yaml:"otel"`
+
+	// StationID is what identifies a station in the station column, the
+	// metrics and the read API: "station_type" (default), the station type
+	// it sends, or "passkey", an identifier derived from its passkey with
+	// PasskeyID, which tells apart the stations of the same type without
+	// publishing their passkeys.
+	StationID string `yaml:"station_id"`
+
+	// StationIDKey is the key of the HMAC deriving the identifiers from the
+	// passkeys; without it, the passkeys could be recovered by hashing the
+	// MAC addresses of the vendor.
+	StationIDKey string `yaml:"station_id_key"`
+
+	// Stations maps a station to its configuration; the keys are the values
+	// of the station column, except with StationID "passkey", where they are
+	// the passkeys, replaced by their identifiers when loaded.
+	Stations map[string]StationConfig `yaml:"stations"`
+
+	StationName StationNameConfig `yaml:"station_name"`
+
+	// MaxTrackedStations is the number of stations whose state (last seen,
+	// wind gusts, pressure readings) is kept in memory; the least recently
+	// seen are forgotten. Defaults to 1000.
+	MaxTrackedStations int `yaml:"max_tracked_stations"`
+
+	// DecimalSeparator is the decimal separator of the numbers sent by the
+	// stations: "." (default) or ",", for the proxies and firmwares sending
+	// e.g. "29,565".
+	DecimalSeparator string `yaml:"decimal_separator"`
 }
 
 type DatabaseConfig struct {
 	DSN   string `yaml:"dsn"`
 	Table string `yaml:"table"`
+
+	// DSNFile is a file containing the DSN, e.g. a Docker or Kubernetes
+	// secret, read when loading the configuration; it can't be used
+	// together with DSN.
+	DSNFile string `yaml:"dsn_file"`
+
+	// PartitionTable, when set, is the name of the table where the readings
+	// are inserted, with strftime-like directives (%Y, %m, %d) resolved
+	// from each reading's time; Table is still used for queries.
+	PartitionTable string `yaml:"partition_table"`
+
+	// CreatePartitions enables creating the partition tables, inheriting
+	// from Table, when they don't exist.
+	CreatePartitions bool `yaml:"create_partitions"`
+
+	// MaxConns is the maximum size of the connection pool.
+	MaxConns int32 `yaml:"max_conns"`
+
+	// ApplicationName is reported to the server to identify the collector's
+	// connections; defaults to "ecowitt-collector".
+	ApplicationName string `yaml:"application_name"`
+
+	// StatementTimeout, when set, aborts the statements taking longer on
+	// the server side.
+	StatementTimeout time.Duration `yaml:"statement_timeout"`
+
+	// MaxInflight limits the number of concurrent inserts; when the limit is
+	// reached, new reports are rejected with 503 so that stations retry later.
+	MaxInflight int `yaml:"max_inflight"`
+
+	// QueueSize enables a queue of this many reports waiting to be stored,
+	// written by MaxInflight workers (4 by default); when the queue is full,
+	// new reports are rejected with 503.
+	QueueSize int `yaml:"queue_size"`
+
+	// StoreReceivedAt enables storing the time at which the collector received
+	// each report in the received_at column.
+	StoreReceivedAt bool `yaml:"store_received_at"`
+
+	// StoreSource enables storing how each reading arrived, e.g.
+	// "ecowitt_http" or "tempest_udp", in the source column.
+	StoreSource bool `yaml:"store_source"`
+
+	// StorePressureInHg enables storing the pressures as sent by the
+	// stations, in inHg, in the pressure_absolute_inhg and
+	// pressure_relative_inhg columns, alongside the converted ones.
+	StorePressureInHg bool `yaml:"store_pressure_inhg"`
+
+	// StoreVPD enables storing the Vapour Pressure Deficit sent by the
+	// stations in the vpd column, in VPDUnit: "kPa" (default), as sent, or
+	// "hPa".
+	StoreVPD bool   `yaml:"store_vpd"`
+	VPDUnit  string `yaml:"vpd_unit"`
+
+	// StoreLocation enables storing the latitude, longitude and altitude
+	// configured for the station in the latitude, longitude and altitude
+	// columns.
+	StoreLocation bool `yaml:"store_location"`
+
+	// StoreRaw enables storing the form body of each report, exactly as
+	// received, in the raw_query column.
+	StoreRaw bool `yaml:"store_raw"`
+
+	// RedactRawPasskey replaces the passkey in the raw_query column with
+	// "REDACTED".
+	RedactRawPasskey bool `yaml:"redact_raw_passkey"`
+
+	// DeadLetterFile is where the reports that couldn't be stored are
+	// appended, as JSON lines that can be fed to the replay command.
+	DeadLetterFile string `yaml:"dead_letter_file"`
+
+	// DeadLetterMaxSize is the size in bytes after which the dead-letter
+	// file is rotated; defaults to 10MiB.
+	DeadLetterMaxSize int64 `yaml:"dead_letter_max_size"`
+
+	// RainUnit is the unit of the rain columns: "mm" (default) stores the
+	// amounts in mm and the rate in mm/h, "in" in inches and in/h, as sent
+	// by the stations.
+	RainUnit string `yaml:"rain_unit"`
+
+	// TimeStorage is how the time column is written: "timestamptz"
+	// (default) passes the time, in UTC, to be stored in a timestamp column,
+	// while "epoch_seconds" and "epoch_millis" pass the Unix time, for the
+	// schemas storing it as an integer.
+	TimeStorage string `yaml:"time_storage"`
+
+	// MaxTextLength is the maximum length, in characters, of the text values
+	// sent by the stations, e.g. the model; longer values are truncated.
+	// Defaults to 128.
+	MaxTextLength int `yaml:"max_text_length"`
+
+	// IgnoreFields lists the columns that are not stored, e.g. the indoor
+	// sensors or the station diagnostics.
+	IgnoreFields []string `yaml:"ignore_fields"`
+
+	// RainJSONB stores the eight rain metrics in a single rain jsonb column
+	// instead of one column each.
+	RainJSONB bool `yaml:"rain_jsonb"`
+
+	// InsertSQL replaces the generated INSERT statement; the values are
+	// referenced with named placeholders like :temperature_outdoor.
+	InsertSQL string `yaml:"insert_sql"`
+
+	// Merge stores the reports of a station with the same time as a single
+	// row, for the stations splitting a reading across several reports:
+	// each one only updates the columns of the fields it has. It needs a
+	// unique index on (station, time), and the readings are stored one by
+	// one rather than with COPY.
+	Merge bool `yaml:"merge"`
 }
 
 type HTTPConfig struct {
 	Address string `yaml:"address"`
+
+	// IngestAddress, APIAddress and MetricsAddress are the addresses serving
+	// the ingest endpoint, the read API and the Prometheus metrics; each
+	// defaults to Address.
+	IngestAddress  string `yaml:"ingest_address"`
+	APIAddress     string `yaml:"api_address"`
+	MetricsAddress string `yaml:"metrics_address"`
+
+	// BasePath is the prefix of all the routes, e.g. "/ecowitt" when running
+	// behind a reverse proxy on a sub-path.
+	BasePath string `yaml:"base_path"`
+
+	// CORSAllowedOrigins lists the origins allowed to access the read API
+	// from a browser; "*" allows any origin.
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+
+	// APIUnits adds a units object to the JSON responses of the read API,
+	// mapping the fields to their units, e.g. "°C".
+	APIUnits bool `yaml:"api_units"`
+
+	// APILastError adds the last error of the ingest pipeline for each
+	// station, e.g. a rejected report or a failed insert, to /stations.
+	APILastError bool `yaml:"api_last_error"`
+
+	// HMACSecret, when set, requires the ingest requests to be signed with
+	// an HMAC-SHA256 of their body in the X-Signature header.
+	HMACSecret string `yaml:"hmac_secret"`
+
+	// IngestJSONErrors enables JSON bodies for the error responses of the
+	// ingest endpoint; the read API always returns JSON errors.
+	IngestJSONErrors bool `yaml:"ingest_json_errors"`
+
+	// RetryConversionErrors makes the ingest endpoint respond 500 to the
+	// reports that couldn't be converted, so that the stations retry them;
+	// by default they get a 200, as retrying usually fails again.
+	RetryConversionErrors bool `yaml:"retry_conversion_errors"`
+
+	// MaxFormValues is the maximum number of form fields of a report; the
+	// reports with more fields are rejected with 400. Defaults to 300.
+	MaxFormValues int `yaml:"max_form_values"`
+
+	// HandlerTimeout bounds the handling of each request, from the parsing
+	// of the report to the write to the last sink; the requests taking
+	// longer get a 503. Defaults to 30s.
+	HandlerTimeout time.Duration `yaml:"handler_timeout"`
+
+	// HealthInsertWindow makes /healthz fail when reports are received but
+	// none was stored for this long, e.g. because of a missing permission;
+	// disabled when zero.
+	HealthInsertWindow time.Duration `yaml:"health_insert_window"`
+
+	// ResponsePolicy is the response to the reports that couldn't be stored:
+	// "lenient" (default) always responds 200, relying on the buffer and the
+	// dead-letter file, while "strict" responds 503 so that the stations
+	// retry them.
+	ResponsePolicy string `yaml:"response_policy"`
+
+	// ResponseGracePeriod is how long, with the strict policy, the failures
+	// are still answered with 200 after the first one, so that the brief
+	// outages don't make the stations retry.
+	ResponseGracePeriod time.Duration `yaml:"response_grace_period"`
+
+	// ManagementToken enables the management endpoints (e.g. /config), and
+	// protects the read API and the metrics: they all require it as a bearer
+	// token, or in the token query parameter.
+	ManagementToken string `yaml:"management_token"`
+
+	// TLSCertFile and TLSKeyFile, when set, make all the addresses serve
+	// HTTPS with this certificate and key, in PEM format.
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+
+	// HTTPSRedirect is an address serving plain HTTP, redirecting every
+	// request to HTTPS on the port of the ingest address; disabled when
+	// empty, in which case the plain HTTP requests are rejected.
+	HTTPSRedirect string `yaml:"https_redirect"`
+
+	AccessLog AccessLogConfig `yaml:"access_log"`
+}
+
+// AccessLogConfig configures the access log, written in the Apache Combined
+// Log Format.
+type AccessLogConfig struct {
+	// Path of the access log; disabled when empty.
+	Path string `yaml:"path"`
+
+	// MaxSize is the size in bytes after which the file is rotated;
+	// defaults to 100MiB.
+	MaxSize int64 `yaml:"max_size"`
+
+	// MaxBackups is the number of rotated files that are kept; defaults
+	// to 3.
+	MaxBackups int `yaml:"max_backups"`
 }
 
-func Load(filename string) (Config, error) {
+// UDPConfig configures the listener for the WeatherFlow Tempest UDP
+// broadcasts.
+type UDPConfig struct {
+	// Address is the address to listen on, usually ":50222"; disabled when
+	// empty.
+	Address string `yaml:"address"`
+}
+
+type WindConfig struct {
+	// GustWindow enables storing the maximum wind gust seen over this window
+	// in the wind_gust_smoothed column; disabled when zero.
+	GustWindow time.Duration `yaml:"gust_window"`
+
+	// DirectionWindow enables storing the vector average of the wind
+	// direction over this window in the wind_direction_avg column; disabled
+	// when zero.
+	DirectionWindow time.Duration `yaml:"direction_window"`
+}
+
+type SolarConfig struct {
+	// Lux enables storing the solar radiation converted to lux in the
+	// solar_lux column.
+	Lux bool `yaml:"lux"`
+
+	// LuxCoefficient is the W/m² to lux conversion factor; defaults to 126.7.
+	LuxCoefficient float64 `yaml:"lux_coefficient"`
+}
+
+// Calibration corrects a sensor reading as value*Scale + Offset; a zero Scale
+// is treated as 1.
+type Calibration struct {
+	Offset float64 `yaml:"offset"`
+	Scale  float64 `yaml:"scale"`
+}
+
+// CalibrationConfig contains the calibrations applied to the sensor readings
+// after the conversion to metric units.
+type CalibrationConfig struct {
+	OutdoorTemperature Calibration `yaml:"temperature_outdoor"`
+	IndoorTemperature  Calibration `yaml:"temperature_indoor"`
+	OutdoorHumidity    Calibration `yaml:"humidity_outdoor"`
+	IndoorHumidity     Calibration `yaml:"humidity_indoor"`
+	AbsolutePressure   Calibration `yaml:"pressure_absolute"`
+	RelativePressure   Calibration `yaml:"pressure_relative"`
+
+	// FloorNegativeSolar replaces the negative solar radiation and UV
+	// readings, caused by sensor noise at night, with 0.
+	FloorNegativeSolar bool `yaml:"floor_negative_solar"`
+}
+
+// PressureConfig configures the pressure tendency.
+type PressureConfig struct {
+	// Tendency enables storing the pressure tendency ("rising", "falling"
+	// or "steady") in the pressure_tendency column.
+	Tendency bool `yaml:"tendency"`
+
+	// TendencyWindow is how far back the pressure is compared; defaults
+	// to 3h.
+	TendencyWindow time.Duration `yaml:"tendency_window"`
+
+	// TendencyThreshold is the change, in hPa over the window, above which
+	// the pressure is rising or falling; defaults to 1.
+	TendencyThreshold float64 `yaml:"tendency_threshold"`
+
+	// Seed enables loading the recent readings from the database on
+	// startup, so that the tendency is available right away.
+	Seed bool `yaml:"seed"`
+}
+
+// ForecastConfig configures the Zambretti forecast.
+type ForecastConfig struct {
+	// Enabled enables storing a short forecast, based on the pressure, its
+	// tendency and the wind, in the forecast column.
+	Enabled bool `yaml:"enabled"`
+
+	// SouthernHemisphere must be set for stations south of the equator,
+	// where the effect of the wind and the seasons are reversed.
+	SouthernHemisphere bool `yaml:"southern_hemisphere"`
+}
+
+// ConditionConfig contains the thresholds used to classify the weather
+// condition; zero values are replaced by the defaults.
+type ConditionConfig struct {
+	// Enabled enables storing the condition in the condition column.
+	Enabled bool `yaml:"enabled"`
+
+	// RainRate and HeavyRainRate, in mm/h, are the rain rates above which
+	// the condition is "Rain" and "Heavy Rain".
+	RainRate      float64 `yaml:"rain_rate"`
+	HeavyRainRate float64 `yaml:"heavy_rain_rate"`
+
+	// DaylightRadiation is the solar radiation, in W/m², above which it's
+	// considered day; during the day the condition is "Cloudy" when the
+	// radiation is below CloudyRadiation.
+	DaylightRadiation float64 `yaml:"daylight_radiation"`
+	CloudyRadiation   float64 `yaml:"cloudy_radiation"`
+
+	// CloudyHumidity is the outdoor humidity, in percent, above which the
+	// condition is "Cloudy" at night.
+	CloudyHumidity int `yaml:"cloudy_humidity"`
+}
+
+// BatteryConfig configures the battery_status_text column.
+type BatteryConfig struct {
+	// StatusText enables storing "OK" or "LOW" in the battery_status_text
+	// column, mapped from the battery value.
+	StatusText bool `yaml:"status_text"`
+
+	// Sensors maps a sensor type, e.g. "wh65", to the encoding of its
+	// battery value.
+	Sensors map[string]BatteryEncoding `yaml:"sensors"`
+}
+
+// ModelVersionConfig configures splitting the model and the station type in
+// their name and firmware version, stored in the model_base, model_version,
+// station_type_base and station_type_version columns.
+type ModelVersionConfig struct {
+	// Enabled enables the columns.
+	Enabled bool `yaml:"enabled"`
+
+	// Pattern is a regular expression with the "base" and "version" named
+	// groups; defaults to one matching e.g. "WS2900_V2.02.03" and
+	// "EasyWeatherV1.6.4".
+	Pattern string `yaml:"pattern"`
+}
+
+// DegreeDaysConfig configures the heating and cooling degree days.
+type DegreeDaysConfig struct {
+	// Enabled enables the degree days.
+	Enabled bool `yaml:"enabled"`
+
+	// Base is the base temperature, in °C; defaults to 18.
+	Base float64 `yaml:"base"`
+
+	// Method is "integration" (the default), which stores the contribution
+	// of each reading in the heating_degree_days and cooling_degree_days
+	// columns, or "mean", which computes the degree days of a day from its
+	// minimum and maximum temperature in the daily summary.
+	Method string `yaml:"method"`
+}
+
+// RainReconciliationConfig enables comparing the daily rain sent by the
+// stations with the increase of their total rain since the local midnight,
+// in the timezone of each station.
+type RainReconciliationConfig struct {
+	// Enabled enables the comparison, stored in the daily_rain_mismatch
+	// column.
+	Enabled bool `yaml:"enabled"`
+
+	// Threshold is the difference, in mm, above which the daily rain is
+	// flagged; defaults to 1.
+	Threshold float64 `yaml:"threshold"`
+}
+
+// BaseTemperature returns the base temperature, applying the default.
+func (c DegreeDaysConfig) BaseTemperature() float64 {
+	if c.Base == 0 {
+		return 18
+	}
+	return c.Base
+}
+
+// BatteryEncoding describes how a sensor encodes its battery status.
+type BatteryEncoding struct {
+	// Type is "binary" (0=OK, 1=LOW), "level" (0-5, LOW at 1 or below) or
+	// "voltage"; when empty, 0 and 1 are read as binary and other values
+	// as voltages.
+	Type string `yaml:"type"`
+
+	// LowVoltage is the voltage below which the battery is low; defaults
+	// to 1.2.
+	LowVoltage float64 `yaml:"low_voltage"`
+}
+
+// IntervalConfig is the range of the reporting intervals accepted from the
+// stations; intervals outside the range are clamped.
+type IntervalConfig struct {
+	// Min defaults to 16s, the shortest interval supported by the stations.
+	Min time.Duration `yaml:"min"`
+
+	// Max defaults to 1h.
+	Max time.Duration `yaml:"max"`
+}
+
+type StalenessConfig struct {
+	// Intervals is the number of reporting intervals after which a silent
+	// station is considered offline; disabled when zero.
+	Intervals  int    `yaml:"intervals"`
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// StationNameConfig configures storing the station name in the station_name
+// column.
+type StationNameConfig struct {
+	// Source is where the name is taken from: "config" for the configured
+	// station names, "header" for a request header set by a proxy, "dns"
+	// for the reverse DNS lookup of the client IP; the latter two fall back
+	// to the configured names. Disabled when empty.
+	Source string `yaml:"source"`
+
+	// Header is the request header used by the "header" source; defaults to
+	// X-Station-Name.
+	Header string `yaml:"header"`
+}
+
+type StationConfig struct {
+	Name string `yaml:"name"`
+
+	// Timezone is the IANA name of the station's timezone, used to compute
+	// daily summaries; defaults to UTC.
+	Timezone string `yaml:"timezone"`
+
+	// MinStoreInterval is the minimum time between two stored readings;
+	// the readings received in between are dropped.
+	MinStoreInterval time.Duration `yaml:"min_store_interval"`
+
+	// Latitude and Longitude are the station's location, in degrees (east
+	// positive); when set, the solar elevation and whether it's daytime are
+	// stored with each reading.
+	Latitude  *float64 `yaml:"latitude"`
+	Longitude *float64 `yaml:"longitude"`
+
+	// Altitude is the station's height above the sea level, in meters.
+	Altitude *float64 `yaml:"altitude"`
+}
+
+type ArchiveConfig struct {
+	Dir       string        `yaml:"dir"`
+	OlderThan time.Duration `yaml:"older_than"`
+	Delete    bool          `yaml:"delete"`
+}
+
+// BufferConfig configures the buffering of the readings that couldn't be
+// stored, written back once the database recovers.
+type BufferConfig struct {
+	// MaxMemory is the number of readings kept in memory; buffering is
+	// disabled when zero.
+	MaxMemory int `yaml:"max_memory"`
+
+	// SpillDir is where the readings are spilled when the memory buffer is
+	// full; when empty, the readings exceeding MaxMemory are not stored.
+	SpillDir string `yaml:"spill_dir"`
+}
+
+// OTelConfig configures exporting OpenTelemetry traces of the reports.
+type OTelConfig struct {
+	// Endpoint is the host and port of the OTLP/HTTP collector, e.g.
+	// "localhost:4318"; tracing is disabled when empty.
+	Endpoint string `yaml:"endpoint"`
+
+	// Insecure disables TLS when connecting to the endpoint.
+	Insecure bool `yaml:"insecure"`
+
+	// SamplingRatio is the fraction of the traces that are exported, between
+	// 0 and 1; defaults to 1.
+	SamplingRatio float64 `yaml:"sampling_ratio"`
+}
+
+// ValidationConfig configures the checks of the readings before they're
+// stored.
+type ValidationConfig struct {
+	// MaxClockSkew rejects the readings timestamped further than this in the
+	// future; disabled when zero.
+	MaxClockSkew time.Duration `yaml:"max_clock_skew"`
+
+	// FloorNegative stores the negative wind speed and rain rate as zero,
+	// instead of rejecting the reading; the negative UV is floored by
+	// CalibrationConfig.FloorNegativeSolar.
+	FloorNegative bool `yaml:"floor_negative"`
+}
+
+// WorkerPoolConfig configures a pool of workers writing the readings to the
+// sinks, so that the stations get a response without waiting for them.
+type WorkerPoolConfig struct {
+	// Size is the number of workers; the pool is disabled when zero.
+	Size int `yaml:"size"`
+
+	// QueueSize is the number of readings waiting for a worker; when the
+	// queue is full, new reports are rejected with 503. Defaults to 100.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// StatsDConfig configures sending the readings as StatsD gauges.
+type StatsDConfig struct {
+	// Address of the StatsD server, e.g. "127.0.0.1:8125"; disabled when
+	// empty.
+	Address string `yaml:"address"`
+
+	// Prefix is prepended to the gauge names, e.g. "weather.".
+	Prefix string `yaml:"prefix"`
+
+	// Tags are added to the station tag of every gauge, in the DogStatsD
+	// "key:value" format.
+	Tags []string `yaml:"tags"`
+}
+
+// GraphiteConfig configures sending the readings as Graphite plaintext
+// metrics.
+type GraphiteConfig struct {
+	// Address of the carbon endpoint, e.g. "127.0.0.1:2003"; disabled when
+	// empty.
+	Address string `yaml:"address"`
+
+	// Protocol is "tcp" (default) or "udp".
+	Protocol string `yaml:"protocol"`
+
+	// Prefix is prepended to the column names to name the metrics, with
+	// {station} replaced by the station; defaults to "weather.{station}.".
+	Prefix string `yaml:"prefix"`
+}
+
+// ElasticsearchConfig configures the indexing of the readings in
+// Elasticsearch or OpenSearch.
+type ElasticsearchConfig struct {
+	// URL of the cluster, e.g. "https://localhost:9200"; disabled when
+	// empty.
+	URL string `yaml:"url"`
+
+	// Index is the name of the index, which can contain the %Y, %m and %d
+	// directives; defaults to "weather-%Y.%m".
+	Index string `yaml:"index"`
+
+	// Username and Password, or APIKey, authenticate the requests.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	APIKey   string `yaml:"api_key"`
+
+	// BatchSize is the maximum number of documents sent per bulk request;
+	// defaults to 500.
+	BatchSize int `yaml:"batch_size"`
+
+	// FlushInterval is how often the documents are sent; defaults to 10s.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// KafkaConfig configures producing the readings to a Kafka topic.
+type KafkaConfig struct {
+	// Brokers are the addresses of the Kafka brokers, e.g. "localhost:9092";
+	// disabled when empty.
+	Brokers []string `yaml:"brokers"`
+
+	// Topic is the topic the readings are produced to.
+	Topic string `yaml:"topic"`
+
+	// Key is the message key: "station" (default) or "none" to spread the
+	// messages across the partitions.
+	Key string `yaml:"key"`
+
+	// BatchSize is the maximum number of messages sent at once; defaults to
+	// 100.
+	BatchSize int `yaml:"batch_size"`
+
+	// BatchTimeout is how long an incomplete batch waits before being sent;
+	// defaults to 1s.
+	BatchTimeout time.Duration `yaml:"batch_timeout"`
+}
+
+// RemoteWriteConfig configures pushing the readings to a Prometheus
+// remote-write endpoint.
+type RemoteWriteConfig struct {
+	// URL of the endpoint, e.g. "http://localhost:8428/api/v1/write";
+	// disabled when empty.
+	URL string `yaml:"url"`
+
+	// Username and Password, or BearerToken, authenticate the requests.
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearer_token"`
+
+	// Prefix is prepended to the column names to name the series; defaults
+	// to "weather_".
+	Prefix string `yaml:"prefix"`
+
+	// Labels are added to the station label of every series.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// SinksConfig configures how the readings are written when the database and
+// StatsD, Graphite, Elasticsearch, Kafka or remote write are enabled
+// together.
+type SinksConfig struct {
+	// Primary is the sink whose result decides the response to the station:
+	// "postgres" (default), "statsd", "graphite", "elasticsearch", "kafka"
+	// or "remote_write".
+	Primary string `yaml:"primary"`
+
+	// Timeout bounds each write to the other sinks; defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// CloudConfig contains the credentials used to import historical data from
+// the Ecowitt cloud API.
+type CloudConfig struct {
+	ApplicationKey string `yaml:"application_key"`
+	APIKey         string `yaml:"api_key"`
+	MAC            string `yaml:"mac"`
+
+	// Station is the value stored in the station column for the imported
+	// data, usually the station's passkey; defaults to the MAC address.
+	Station string `yaml:"station"`
+}
+
+// ApplyDerivations enables the derived columns listed in Derivations, using
+// the default settings of each unless configured in its own section.
+func (c *Config) ApplyDerivations() error {
+	for _, name := range c.Derivations {
+		switch name {
+		case "wind_gust_smoothed":
+			if c.Wind.GustWindow <= 0 {
+				return fmt.Errorf("the wind_gust_smoothed derivation requires wind.gust_window")
+			}
+		case "wind_direction_avg":
+			if c.Wind.DirectionWindow <= 0 {
+				return fmt.Errorf("the wind_direction_avg derivation requires wind.direction_window")
+			}
+		case "solar_lux":
+			c.Solar.Lux = true
+		case "pressure_tendency":
+			c.Pressure.Tendency = true
+		case "forecast":
+			c.Forecast.Enabled = true
+		case "condition":
+			c.Condition.Enabled = true
+		case "feels_like":
+			if c.FeelsLikeMethod == "" {
+				c.FeelsLikeMethod = "us"
+			}
+		case "battery_status_text":
+			c.Battery.StatusText = true
+		case "degree_days":
+			c.DegreeDays.Enabled = true
+		case "model_version":
+			c.ModelVersion.Enabled = true
+		default:
+			return fmt.Errorf("unknown derivation %q", name)
+		}
+	}
+
+	return nil
+}
+
+// labelNameRe matches the valid Prometheus label names.
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LoadWait is like Load but, while one of filenames doesn't exist, it checks
+// again every interval for up to wait; this covers deployments where the file
+// is mounted slightly after the process starts.
+func LoadWait(filenames []string, wait, interval time.Duration) (Config, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		config, err := Load(filenames...)
+		if !errors.Is(err, fs.ErrNotExist) || !time.Now().Before(deadline) {
+			return config, err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// configFiles returns the configuration files of path: path itself, or the
+// *.yml and *.yaml files it contains, in lexical order, when it's a directory.
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); !entry.IsDir() && (ext == ".yml" || ext == ".yaml") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no configuration files in %s", path)
+	}
+
+	return files, nil
+}
+
+// decodeFile decodes filename over config: the settings it contains replace
+// the ones of config, the maps are merged key by key, and the lists are
+// replaced as a whole.
+func decodeFile(filename string, config *Config) error {
 	fh, err := os.Open(filename)
 	if err != nil {
-		return Config{}, err
+		return err
 	}
 	defer fh.Close()
 
+	if err := yaml.NewDecoder(fh).Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// Load reads the configuration from filenames, each of which can be a file
+// or a directory of *.yml files; they are merged in order, so that each file
+// overrides the settings of the previous ones, e.g. a base configuration and
+// the overrides of an environment.
+func Load(filenames ...string) (Config, error) {
 	var config Config
-	if err := yaml.NewDecoder(fh).Decode(&config); err != nil {
+	for _, filename := range filenames {
+		files, err := configFiles(filename)
+		if err != nil {
+			return Config{}, err
+		}
+		for _, file := range files {
+			if err := decodeFile(file, &config); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+
+	if err := config.ApplyDerivations(); err != nil {
 		return Config{}, err
 	}
 
+	if config.Database.DSNFile != "" {
+		if config.Database.DSN != "" {
+			return Config{}, fmt.Errorf("database.dsn and database.dsn_file can't be both set")
+		}
+		b, err := os.ReadFile(config.Database.DSNFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading database.dsn_file: %w", err)
+		}
+		config.Database.DSN = strings.TrimSpace(string(b))
+	}
+
+	switch config.Database.RainUnit {
+	case "", "mm", "in":
+	default:
+		return Config{}, fmt.Errorf("invalid database.rain_unit %q, expected \"mm\" or \"in\"", config.Database.RainUnit)
+	}
+
+	if config.Database.Merge && config.Database.InsertSQL != "" {
+		return Config{}, errors.New("database.merge can't be used with database.insert_sql")
+	}
+
+	switch config.DecimalSeparator {
+	case "", ".", ",":
+	default:
+		return Config{}, fmt.Errorf("invalid decimal_separator %q, expected \".\" or \",\"", config.DecimalSeparator)
+	}
+
+	switch config.Database.VPDUnit {
+	case "", "kPa", "hPa":
+	default:
+		return Config{}, fmt.Errorf("invalid database.vpd_unit %q, expected \"kPa\" or \"hPa\"", config.Database.VPDUnit)
+	}
+
+	switch config.Database.TimeStorage {
+	case "", "timestamptz", "epoch_seconds", "epoch_millis":
+	default:
+		return Config{}, fmt.Errorf("invalid database.time_storage %q, expected \"timestamptz\", \"epoch_seconds\" or \"epoch_millis\"", config.Database.TimeStorage)
+	}
+
+	switch config.StationName.Source {
+	case "", "config", "header", "dns":
+	default:
+		return Config{}, fmt.Errorf("invalid station_name.source %q, expected \"config\", \"header\" or \"dns\"", config.StationName.Source)
+	}
+
+	if config.OTel.SamplingRatio < 0 || config.OTel.SamplingRatio > 1 {
+		return Config{}, fmt.Errorf("invalid otel.sampling_ratio %v, expected a value between 0 and 1", config.OTel.SamplingRatio)
+	}
+
+	switch config.HTTP.ResponsePolicy {
+	case "", "lenient", "strict":
+	default:
+		return Config{}, fmt.Errorf("invalid http.response_policy %q, expected \"lenient\" or \"strict\"", config.HTTP.ResponsePolicy)
+	}
+
+	// the stations get their response before the worker pool writes the
+	// readings, so the write errors can't be reported back to them, nor
+	// tied to the report to write to the dead-letter file
+	if config.WorkerPool.Size > 0 {
+		if config.HTTP.ResponsePolicy == "strict" {
+			return Config{}, errors.New("worker_pool can't be used with http.response_policy strict")
+		}
+		if config.Database.DeadLetterFile != "" {
+			return Config{}, errors.New("worker_pool can't be used with database.dead_letter_file")
+		}
+	}
+
+	switch config.FeelsLikeMethod {
+	case "", "us", "au":
+	default:
+		return Config{}, fmt.Errorf("invalid feels_like_method %q, expected \"us\" or \"au\"", config.FeelsLikeMethod)
+	}
+
+	if config.ModelVersion.Pattern != "" {
+		re, err := regexp.Compile(config.ModelVersion.Pattern)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid model_version.pattern: %w", err)
+		}
+		if !slices.Contains(re.SubexpNames(), "base") || !slices.Contains(re.SubexpNames(), "version") {
+			return Config{}, fmt.Errorf("invalid model_version.pattern: the base and version named groups are required")
+		}
+	}
+
+	switch config.Sinks.Primary {
+	case "", "postgres", "statsd", "graphite", "elasticsearch", "kafka", "remote_write":
+	default:
+		return Config{}, fmt.Errorf("invalid sinks.primary %q, expected \"postgres\", \"statsd\", \"graphite\", \"elasticsearch\", \"kafka\" or \"remote_write\"", config.Sinks.Primary)
+	}
+
+	if len(config.Kafka.Brokers) > 0 && config.Kafka.Topic == "" {
+		return Config{}, fmt.Errorf("kafka.topic must be set")
+	}
+	for name := range config.RemoteWrite.Labels {
+		if !labelNameRe.MatchString(name) || name == "station" || strings.HasPrefix(name, "__") {
+			return Config{}, fmt.Errorf("invalid remote_write.labels name %q", name)
+		}
+	}
+
+	if (config.HTTP.TLSCertFile == "") != (config.HTTP.TLSKeyFile == "") {
+		return Config{}, fmt.Errorf("http.tls_cert_file and http.tls_key_file must be set together")
+	}
+	if config.HTTP.HTTPSRedirect != "" {
+		if config.HTTP.TLSCertFile == "" {
+			return Config{}, fmt.Errorf("http.https_redirect requires http.tls_cert_file")
+		}
+		for _, addr := range []string{config.HTTP.Address, config.HTTP.IngestAddress, config.HTTP.APIAddress, config.HTTP.MetricsAddress} {
+			if addr == config.HTTP.HTTPSRedirect {
+				return Config{}, fmt.Errorf("http.https_redirect must be different from the HTTPS addresses")
+			}
+		}
+	}
+
+	switch config.Graphite.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return Config{}, fmt.Errorf("invalid graphite.protocol %q, expected \"tcp\" or \"udp\"", config.Graphite.Protocol)
+	}
+
+	switch config.Kafka.Key {
+	case "", "station", "none":
+	default:
+		return Config{}, fmt.Errorf("invalid kafka.key %q, expected \"station\" or \"none\"", config.Kafka.Key)
+	}
+
+	switch config.DegreeDays.Method {
+	case "", "integration", "mean":
+	default:
+		return Config{}, fmt.Errorf("invalid degree_days.method %q, expected \"integration\" or \"mean\"", config.DegreeDays.Method)
+	}
+
+	for passkey, st := range config.Stations {
+		if (st.Latitude == nil) != (st.Longitude == nil) {
+			return Config{}, fmt.Errorf("station %s: latitude and longitude must be set together", passkey)
+		}
+		if st.Latitude != nil && (*st.Latitude < -90 || *st.Latitude > 90 || *st.Longitude < -180 || *st.Longitude > 180) {
+			return Config{}, fmt.Errorf("station %s: invalid location %v, %v", passkey, *st.Latitude, *st.Longitude)
+		}
+		if st.Altitude != nil && (*st.Altitude < -500 || *st.Altitude > 9000) {
+			return Config{}, fmt.Errorf("station %s: invalid altitude %v, expected meters between -500 and 9000", passkey, *st.Altitude)
+		}
+		// the timezones are otherwise only loaded by the daily summary
+		if config.RainReconciliation.Enabled && st.Timezone != "" {
+			if _, err := time.LoadLocation(st.Timezone); err != nil {
+				return Config{}, fmt.Errorf("station %s: invalid timezone: %w", passkey, err)
+			}
+		}
+	}
+
+	if config.RainReconciliation.Threshold < 0 {
+		return Config{}, fmt.Errorf("invalid rain_reconciliation.threshold %v, expected a positive value", config.RainReconciliation.Threshold)
+	}
+
+	for sensor, enc := range config.Battery.Sensors {
+		switch enc.Type {
+		case "", "binary", "level", "voltage":
+		default:
+			return Config{}, fmt.Errorf("invalid battery type %q for sensor %s, expected \"binary\", \"level\" or \"voltage\"", enc.Type, sensor)
+		}
+	}
+
+	switch config.StationID {
+	case "", "station_type":
+	case "passkey":
+		stations := make(map[string]StationConfig, len(config.Stations))
+		for passkey, st := range config.Stations {
+			stations[config.PasskeyID(passkey)] = st
+		}
+		config.Stations = stations
+	default:
+		return Config{}, fmt.Errorf("invalid station_id %q, expected \"station_type\" or \"passkey\"", config.StationID)
+	}
+
 	return config, nil
 }
+
+// PasskeyID returns the identifier of the station sending passkey, with
+// StationID "passkey": the first 16 hex digits of the HMAC-SHA256 of the
+// passkey, keyed with StationIDKey.
+func (c Config) PasskeyID(passkey string) string {
+	mac := hmac.New(sha256.New, []byte(c.StationIDKey))
+	mac.Write([]byte(passkey))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// redactedValue replaces the secrets in a redacted Config.
+const redactedValue = "REDACTED"
+
+// dsnPassword matches the password in a keyword/value connection string.
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// Redacted returns a copy of c with the secrets replaced, so that it can be
+// shown to the user; any new secret added to Config must be redacted here.
+func (c Config) Redacted() Config {
+	c.Database.DSN = redactDSN(c.Database.DSN)
+
+	if c.HTTP.HMACSecret != "" {
+		c.HTTP.HMACSecret = redactedValue
+	}
+	if c.HTTP.ManagementToken != "" {
+		c.HTTP.ManagementToken = redactedValue
+	}
+	if c.StationIDKey != "" {
+		c.StationIDKey = redactedValue
+	}
+	c.Staleness.WebhookURL = redactURL(c.Staleness.WebhookURL)
+
+	if c.Elasticsearch.Password != "" {
+		c.Elasticsearch.Password = redactedValue
+	}
+	if c.Elasticsearch.APIKey != "" {
+		c.Elasticsearch.APIKey = redactedValue
+	}
+
+	if c.RemoteWrite.Password != "" {
+		c.RemoteWrite.Password = redactedValue
+	}
+	if c.RemoteWrite.BearerToken != "" {
+		c.RemoteWrite.BearerToken = redactedValue
+	}
+
+	if c.Cloud.ApplicationKey != "" {
+		c.Cloud.ApplicationKey = redactedValue
+	}
+	if c.Cloud.APIKey != "" {
+		c.Cloud.APIKey = redactedValue
+	}
+
+	return c
+}
+
+// redactDSN removes the password from a PostgreSQL connection string, either
+// in URL or in keyword/value format.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+		}
+		if q := u.Query(); q.Has("password") {
+			q.Set("password", redactedValue)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redactedValue)
+}
+
+// redactURL removes the credentials, the path and the query from a URL, e.g. a
+// Slack or Discord webhook whose path contains the token, keeping the host.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return redactedValue
+	}
+
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + redactedValue}).String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/segmentio/kafka-go"
+)
+
+// The defaults of the Kafka sink.
+const (
+	defaultKafkaBatchSize    = 100
+	defaultKafkaBatchTimeout = time.Second
+)
+
+// kafkaWriter is implemented by *kafka.Writer; it allows replacing the
+// producer in tests.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaSink produces each reading as a JSON message to a Kafka topic, before
+// writing it to the wrapped sink. The messages are keyed by station by
+// default, so that the readings of a station stay ordered in one partition.
+// They are sent asynchronously, in batches; like for StatsD and
+// Elasticsearch, producing is best effort and its errors are logged without
+// affecting the storage of the data.
+type kafkaSink struct {
+	next   MetricsSink
+	logger *slog.Logger
+	writer kafkaWriter
+	keyed  bool
+}
+
+func newKafkaSink(logger *slog.Logger, next MetricsSink, conf config.KafkaConfig) *kafkaSink {
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultKafkaBatchSize
+	}
+	batchTimeout := conf.BatchTimeout
+	if batchTimeout <= 0 {
+		batchTimeout = defaultKafkaBatchTimeout
+	}
+
+	keyed := conf.Key != "none"
+	var balancer kafka.Balancer = &kafka.LeastBytes{}
+	if keyed {
+		balancer = &kafka.Hash{}
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(conf.Brokers...),
+		Topic:        conf.Topic,
+		Balancer:     balancer,
+		BatchSize:    batchSize,
+		BatchTimeout: batchTimeout,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				logger.Error("error producing messages to Kafka", "topic", conf.Topic, "messages", len(messages), "err", err)
+			}
+		},
+	}
+
+	return &kafkaSink{
+		next:   next,
+		logger: logger,
+		writer: writer,
+		keyed:  keyed,
+	}
+}
+
+// kafkaMessage returns the message for wd: its columns as a JSON object,
+// keyed by station when keyed is set.
+func kafkaMessage(wd *WeatherData, keyed bool) (kafka.Message, error) {
+	names, values := wd.columnValues(weatherDataColumns)
+
+	doc := make(map[string]any, len(names))
+	for i, name := range names {
+		doc[name] = values[i]
+	}
+
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	msg := kafka.Message{Value: value, Time: wd.Timestamp}
+	if keyed {
+		msg.Key = []byte(wd.Station)
+	}
+
+	return msg, nil
+}
+
+func (s *kafkaSink) Write(ctx context.Context, wd *WeatherData) error {
+	if msg, err := kafkaMessage(wd, s.keyed); err != nil {
+		s.logger.Error("error encoding Kafka message", "err", err)
+	} else if err := s.writer.WriteMessages(ctx, msg); err != nil {
+		// the writer is asynchronous, so this only fails when it's closed
+		s.logger.Error("error producing message to Kafka", "err", err)
+	}
+
+	return s.next.Write(ctx, wd)
+}
+
+// Close sends the pending messages and closes the producer.
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/segmentio/kafka-go"
+)
+
+// recordingKafkaWriter is a kafkaWriter keeping the produced messages in
+// memory.
+type recordingKafkaWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+}
+
+func (w *recordingKafkaWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *recordingKafkaWriter) Close() error {
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, key := range []string{"", "none"} {
+		next := &recordingSink{}
+		sink := newKafkaSink(logger, next, config.KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "weather", Key: key})
+		writer := &recordingKafkaWriter{}
+		sink.writer = writer
+
+		wd := &WeatherData{
+			Timestamp:          time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC),
+			Station:            "station",
+			OutdoorTemperature: 19.9,
+		}
+		if err := sink.Write(context.Background(), wd); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(next.Written()) != 1 {
+			t.Errorf("expected the reading to be written to the next sink")
+		}
+		if len(writer.messages) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(writer.messages))
+		}
+
+		msg := writer.messages[0]
+		if wantKey := map[string]string{"": "station", "none": ""}[key]; string(msg.Key) != wantKey {
+			t.Errorf("key %q: expected message key %q, got %q", key, wantKey, msg.Key)
+		}
+		if !msg.Time.Equal(wd.Timestamp) {
+			t.Errorf("expected message time %s, got %s", wd.Timestamp, msg.Time)
+		}
+
+		var doc map[string]any
+		if err := json.Unmarshal(msg.Value, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc["station"] != "station" || doc["temperature_outdoor"] != 19.9 || doc["time"] != "2024-06-16T16:32:08Z" {
+			t.Errorf("unexpected message: %s", msg.Value)
+		}
+	}
+}
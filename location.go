@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// geoPosition is where a station is: the latitude and longitude in degrees,
+// east positive, and the altitude in meters above the sea level. Each is nil
+// when not configured; the latitude and longitude are set together.
+type geoPosition struct {
+	latitude  *float64
+	longitude *float64
+	altitude  *float64
+}
+
+// located reports whether the latitude and longitude are known.
+func (p geoPosition) located() bool {
+	return p.latitude != nil && p.longitude != nil
+}
+
+// stationPositions returns the positions of the stations configured with a
+// location, by station, for the derivations needing it.
+func stationPositions(stations map[string]config.StationConfig) map[string]geoPosition {
+	positions := make(map[string]geoPosition)
+	for station, st := range stations {
+		pos := geoPosition{latitude: st.Latitude, longitude: st.Longitude, altitude: st.Altitude}
+		if pos.located() || pos.altitude != nil {
+			positions[station] = pos
+		}
+	}
+	return positions
+}
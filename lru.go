@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/list"
+	"iter"
+)
+
+// defaultMaxTrackedStations is the number of stations whose state is kept in
+// memory when max_tracked_stations is not set.
+const defaultMaxTrackedStations = 1000
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// lruMap is a map holding at most max entries, evicting the least recently
+// used one when full; it bounds the per-station state, as anyone able to reach
+// the ingest endpoint can make up passkeys. It is not safe for concurrent use.
+type lruMap[V any] struct {
+	max   int
+	order *list.List // most recently used first
+	items map[string]*list.Element
+}
+
+func newLRUMap[V any](max int) *lruMap[V] {
+	if max <= 0 {
+		max = defaultMaxTrackedStations
+	}
+	return &lruMap[V]{
+		max:   max,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value of key, marking it as recently used.
+func (m *lruMap[V]) Get(key string) (V, bool) {
+	e, ok := m.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	m.order.MoveToFront(e)
+	return e.Value.(*lruEntry[V]).value, true
+}
+
+// Put sets the value of key, marking it as recently used; it returns the key
+// that was evicted to make room for it, if any.
+func (m *lruMap[V]) Put(key string, value V) (evicted string, ok bool) {
+	if e, found := m.items[key]; found {
+		e.Value.(*lruEntry[V]).value = value
+		m.order.MoveToFront(e)
+		return "", false
+	}
+
+	m.items[key] = m.order.PushFront(&lruEntry[V]{key: key, value: value})
+	if m.order.Len() <= m.max {
+		return "", false
+	}
+
+	oldest := m.order.Back()
+	m.order.Remove(oldest)
+	evicted = oldest.Value.(*lruEntry[V]).key
+	delete(m.items, evicted)
+
+	return evicted, true
+}
+
+func (m *lruMap[V]) Len() int {
+	return m.order.Len()
+}
+
+// All iterates over the entries, from the most recently used, without
+// changing their order.
+func (m *lruMap[V]) All() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		for e := m.order.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*lruEntry[V])
+			if !yield(entry.key, entry.value) {
+				return
+			}
+		}
+	}
+}
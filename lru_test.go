@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLRUMap(t *testing.T) {
+	m := newLRUMap[int](2)
+
+	m.Put("a", 1)
+	m.Put("b", 2)
+	// a is now the most recently used
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Fatalf("expected a=1, got %v, %v", v, ok)
+	}
+
+	evicted, ok := m.Put("c", 3)
+	if !ok || evicted != "b" {
+		t.Errorf("expected b to be evicted, got %q, %v", evicted, ok)
+	}
+	if _, ok := m.Get("b"); ok {
+		t.Errorf("b should have been evicted")
+	}
+	if m.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", m.Len())
+	}
+
+	var keys []string
+	for k := range m.All() {
+		keys = append(keys, k)
+	}
+	if !slices.Equal(keys, []string{"c", "a"}) {
+		t.Errorf("expected keys [c a], got %v", keys)
+	}
+}
+
+func TestStationTrackerEviction(t *testing.T) {
+	const maxStations = 3
+	tracker := newStationTracker(nil, maxStations)
+	now := time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC)
+
+	tracker.Seen(&WeatherData{Station: "legit"}, now)
+	for i := range 10 {
+		tracker.Seen(&WeatherData{Station: fmt.Sprintf("spoofed-%d", i)}, now)
+		// the legitimate station keeps reporting
+		if i%2 == 0 {
+			tracker.Seen(&WeatherData{Station: "legit"}, now)
+		}
+	}
+
+	list := tracker.List()
+	if len(list) != maxStations {
+		t.Fatalf("expected %d tracked stations, got %d", maxStations, len(list))
+	}
+	if !slices.ContainsFunc(list, func(s stationStatus) bool { return s.Station == "legit" }) {
+		t.Errorf("the recently seen station should not be evicted: %v", list)
+	}
+}
@@ -1,58 +1,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/schema"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/piger/ecowitt-collector/internal/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// version and commit are set at build time with:
+//
+//	go build -ldflags "-X main.version=... -X main.commit=..."
 var (
-	WindDirections = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+	version = "dev"
+	commit  = "unknown"
+)
 
-	ColumnNames = []string{
-		"time",
-		"station",
-		"pressure_absolute",
-		"pressure_relative",
-		"frequency",
-		"heap",
-		"daily_rain",
-		"event_rain",
-		"hourly_rain",
-		"monthly_rain",
-		"rain_rate",
-		"total_rain",
-		"weekly_rain",
-		"yearly_rain",
-		"humidity_outdoor",
-		"humidity_indoor",
-		"interval",
-		"model",
-		"runtime",
-		"solar_radiation",
-		"station_type",
-		"temperature_outdoor",
-		"temperature_indoor",
-		"uv",
-		"battery",
-		"wind_max_daily_gust",
-		"wind_direction",
-		"wind_gust",
-		"wind_speed",
-	}
+var (
+	WindDirections = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
 
 	reqProcessed = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "ecowitt_collector_requests_total",
@@ -98,44 +80,23 @@ func makeValuesString(names []string) string {
 	return strings.Join(result, ",")
 }
 
-func sendMetrics(wd *WeatherData, pool *pgxpool.Pool, table string) error {
-	columns := makeColumnString(ColumnNames)
-	values := makeValuesString(ColumnNames)
+// Execer executes a SQL statement; it's implemented by *pgxpool.Pool and
+// allows replacing the database in tests.
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func sendMetrics(ctx context.Context, wd *WeatherData, stored []dbColumn, db Execer, table string) error {
+	names, args := wd.columnValues(stored)
+	columns := makeColumnString(names)
+	values := makeValuesString(names)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
-	if _, err := pool.Exec(ctx,
+	if _, err := db.Exec(ctx,
 		fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", table, columns, values),
-		wd.Timestamp,
-		wd.StationType,
-		wd.AbsolutePressure,
-		wd.RelativePressure,
-		wd.Frequency,
-		wd.Heap,
-		wd.DailyRain,
-		wd.EventRain,
-		wd.HourlyRain,
-		wd.MonthlyRain,
-		wd.RainRate,
-		wd.TotalRain,
-		wd.WeeklyRain,
-		wd.YearlyRain,
-		wd.OutdoorHumidity,
-		wd.IndoorHumidity,
-		wd.Interval.Seconds(),
-		wd.Model,
-		wd.Runtime,
-		wd.SolarRadiation,
-		wd.StationType,
-		wd.OutdoorTemperature,
-		wd.IndoorTemperature,
-		wd.UV,
-		wd.BatteryLevel,
-		wd.MaxDailyGust,
-		wd.WindDirection,
-		wd.WindGust,
-		wd.WindSpeed,
+		args...,
 	); err != nil {
 		return fmt.Errorf("executing INSERT query: %w", err)
 	}
@@ -143,84 +104,487 @@ func sendMetrics(wd *WeatherData, pool *pgxpool.Pool, table string) error {
 	return nil
 }
 
-func makeHandler(logger *slog.Logger, conf config.Config, pool *pgxpool.Pool, windOffset int) http.Handler {
-	formDecoder := schema.NewDecoder()
+// ingestStatus returns the status code of the response to a report that failed
+// with an ingestError of the given kind. The stations retry the reports that
+// get an error response, so they only get one when retrying can help:
+//
+//   - "decoder": 400, the report is malformed;
+//   - "validator": 400, the reading was rejected by a validator;
+//   - "converter": 200, the failure is a bug of the collector and retrying
+//     would fail again, unless retryConversion is set (500);
+//   - "busy": 503, the station should retry later;
+//   - anything else, e.g. "db": 200, the report is written to the dead-letter
+//     file when configured, unless strict is set (503).
+func ingestStatus(kind string, retryConversion, strict bool) int {
+	switch kind {
+	case "decoder", "validator":
+		return http.StatusBadRequest
+	case "converter":
+		if retryConversion {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	case "busy":
+		return http.StatusServiceUnavailable
+	default:
+		if strict {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+}
+
+// failureGrace tracks since when the reports are failing to be stored, to
+// answer the failures of the first period with 200 under the strict response
+// policy.
+type failureGrace struct {
+	period time.Duration
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+// Fail records a failure at now, and reports whether the failures started
+// less than the grace period ago.
+func (g *failureGrace) Fail(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.since.IsZero() {
+		g.since = now
+	}
+	return now.Sub(g.since) < g.period
+}
+
+// Reset is called when a report is stored, ending the failures.
+func (g *failureGrace) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.since = time.Time{}
+}
+
+// defaultMaxFormValues is the maximum number of form fields of a report when
+// http.max_form_values is not set; the stations send well under 100.
+const defaultMaxFormValues = 300
+
+// makeHandler returns the handler for the reports sent by the stations; when
+// conf.IngestJSONErrors is set, error responses carry a JSON body describing
+// the error, otherwise the body is empty as the stations don't read it anyway.
+func makeHandler(logger *slog.Logger, in *ingester, conf config.HTTPConfig) http.Handler {
+	fail := func(w http.ResponseWriter, code int, msg string, fields []fieldError) {
+		if conf.IngestJSONErrors {
+			writeJSONFieldErrors(w, code, msg, fields)
+		} else {
+			w.WriteHeader(code)
+		}
+	}
+	grace := &failureGrace{period: conf.ResponseGracePeriod}
+	maxFormValues := conf.MaxFormValues
+	if maxFormValues <= 0 {
+		maxFormValues = defaultMaxFormValues
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger := logger.With("client", r.RemoteAddr)
+		logger := requestLogger(r.Context(), logger).With("client", r.RemoteAddr)
 		logger.Debug("station sent request")
 
-		if err := r.ParseForm(); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			logger.Warn("error parsing form data", "err", err)
-			reqErrors.With(prometheus.Labels{"error_type": "parser"}).Inc()
+		body := &countingBody{ReadCloser: r.Body}
+		if in.storeRaw || in.deadLetters != nil {
+			body.raw = &bytes.Buffer{}
+		}
+		r.Body = body
+		_, span := startSpan(r.Context(), "parse")
+		err := r.ParseForm()
+		endSpan(span, err)
+		if err != nil {
+			fail(w, http.StatusBadRequest, "invalid form data", nil)
+			reportBodyError(logger, r, body, err)
+			if body.raw != nil {
+				in.deadLetter(logger, in.clock.Now(), "", fmt.Errorf("invalid form data: %w", err), body.raw.String())
+			}
 			return
 		}
-
-		var p payload
-		if err := formDecoder.Decode(&p, r.Form); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			logger.Error("error deserializing payload", "err", err)
-			reqErrors.With(prometheus.Labels{"error_type": "decoder"}).Inc()
+		// guard the decoder, and the logging of the unknown fields, against
+		// reports with a huge number of fields
+		if len(r.Form) > maxFormValues {
+			fail(w, http.StatusBadRequest, "too many form fields", nil)
+			logger.Warn("station sent too many form fields", "fields", len(r.Form), "max", maxFormValues)
+			reqErrors.With(prometheus.Labels{"error_type": "parser"}).Inc()
 			return
 		}
-
-		if windOffset != 0 {
-			p.WindDir = offsetDegrees(p.WindDir, windOffset)
+		if body.raw != nil {
+			r = r.WithContext(context.WithValue(r.Context(), rawBodyKey{}, body.raw.String()))
 		}
 
-		wd, err := NewWeatherData(p)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logger.Error("error converting payload to WeatherData", "err", err)
-			reqErrors.With(prometheus.Labels{"error_type": "converter"}).Inc()
+		wd, err := in.Ingest(r.Context(), r.Form)
+		if errors.Is(err, errThrottled) {
+			grace.Reset()
+			logger.Debug("dropped weather data received before min_store_interval", "station", wd.Station, "time", wd.Timestamp)
+			reqProcessed.Inc()
 			return
 		}
-
-		if err := sendMetrics(wd, pool, conf.Database.Table); err != nil {
-			logger.Error("error sending metrics", "err", err)
-			reqErrors.With(prometheus.Labels{"error_type": "db"}).Inc()
+		if err != nil {
+			var ie *ingestError
+			if errors.As(err, &ie) {
+				var (
+					msg    string
+					fields []fieldError
+				)
+				switch ie.Kind {
+				case "decoder":
+					msg = "invalid payload"
+					var ve *validationError
+					if errors.As(ie.Err, &ve) {
+						fields = ve.Fields
+					}
+					logger.Error("error deserializing payload", "err", ie.Err)
+				case "validator":
+					msg = "invalid reading"
+					var ve *validationError
+					if errors.As(ie.Err, &ve) {
+						fields = ve.Fields
+					}
+					logger.Warn("reading rejected by a validator", "err", ie.Err)
+				case "converter":
+					msg = "error converting payload"
+					logger.Error("error converting payload to WeatherData", "err", ie.Err)
+				case "busy":
+					msg = "too many concurrent requests"
+					logger.Warn("too many concurrent inserts, rejecting request")
+				default:
+					msg = "error storing the report"
+					logger.Error("error sending metrics", "err", ie.Err)
+				}
+				strict := conf.ResponsePolicy == "strict" && ie.Kind == "db" && !grace.Fail(in.clock.Now())
+				if status := ingestStatus(ie.Kind, conf.RetryConversionErrors, strict); status != http.StatusOK {
+					fail(w, status, msg, fields)
+				}
+				reqErrors.With(prometheus.Labels{"error_type": ie.Kind}).Inc()
+			}
 			return
 		}
 
+		grace.Reset()
+		logger.Debug("stored weather data", "station", wd.Station, "time", wd.Timestamp)
 		reqProcessed.Inc()
 	})
 }
 
+// defaultApplicationName identifies the collector's connections, e.g. in
+// pg_stat_activity.
+const defaultApplicationName = "ecowitt-collector"
+
+func poolConfig(conf config.DatabaseConfig) (*pgxpool.Config, error) {
+	pgConfig, err := pgxpool.ParseConfig(conf.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.MaxConns > 0 {
+		pgConfig.MaxConns = conf.MaxConns
+	}
+
+	params := pgConfig.ConnConfig.RuntimeParams
+	if conf.ApplicationName != "" {
+		params["application_name"] = conf.ApplicationName
+	} else if params["application_name"] == "" {
+		params["application_name"] = defaultApplicationName
+	}
+	if conf.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.FormatInt(conf.StatementTimeout.Milliseconds(), 10)
+	}
+
+	return pgConfig, nil
+}
+
+func newPool(ctx context.Context, conf config.DatabaseConfig) (*pgxpool.Pool, error) {
+	pgConfig, err := poolConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgxpool.NewWithConfig(ctx, pgConfig)
+}
+
 func run(logger *slog.Logger, conf config.Config) error {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if conf.OTel.Endpoint != "" {
+		shutdown, err := setupTracing(ctx, conf.OTel)
+		if err != nil {
+			return fmt.Errorf("setting up tracing: %w", err)
+		}
+		// send the pending spans when shutting down
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := shutdown(shutdownCtx); err != nil {
+				logger.Error("error exporting traces", "err", err)
+			}
+		}()
+	}
 
-	pgConfig, err := pgxpool.ParseConfig(conf.Database.DSN)
+	pool, err := newPool(ctx, conf.Database)
 	if err != nil {
 		return err
 	}
 
-	pool, err := pgxpool.NewWithConfig(ctx, pgConfig)
+	clock := realClock{}
+
+	stations := newStationTracker(conf.Stations, conf.MaxTrackedStations)
+	if err := stations.Load(ctx, pool, conf.Database, clock.Now()); err != nil {
+		logger.Warn("error loading known stations", "err", err)
+	}
+	if conf.Staleness.Intervals > 0 {
+		go watchStaleness(ctx, logger, stations, clock, conf.Staleness)
+	}
+
+	pg, err := newPgSink(pool, conf.Database)
 	if err != nil {
 		return err
 	}
+	var sink MetricsSink = pg
+
+	// the sinks outlive ctx, so that the readings still queued in the worker
+	// pool when shutting down can be written: they stop after the pool, and
+	// run returns once they flushed or spilled what they hold
+	sinkCtx, stopSinks := context.WithCancel(context.WithoutCancel(ctx))
+	var sinksDone sync.WaitGroup
+	runSink := func(run func(context.Context)) {
+		sinksDone.Add(1)
+		go func() {
+			defer sinksDone.Done()
+			run(sinkCtx)
+		}()
+	}
+	defer func() {
+		stopSinks()
+		sinksDone.Wait()
+	}()
+
+	if conf.Buffer.MaxMemory > 0 {
+		buffered, err := newBufferedSink(logger, sink, conf.Buffer)
+		if err != nil {
+			return err
+		}
+		runSink(buffered.Run)
+		sink = buffered
+	}
+	if conf.Database.QueueSize > 0 {
+		queued := newQueuedSink(sink, conf.Database.QueueSize, conf.Database.MaxInflight)
+		runSink(queued.Run)
+		sink = queued
+	} else if conf.Database.MaxInflight > 0 {
+		sink = newLimitedSink(sink, conf.Database.MaxInflight)
+	}
 
-	http.Handle("POST /data/report/", makeHandler(logger, conf, pool, -90))
-	http.Handle("/metrics", promhttp.Handler())
+	if conf.SnapshotFile != "" {
+		sink = newSnapshotSink(logger, sink, conf.SnapshotFile)
+	}
 
-	logger.Info("starting server", "addr", conf.HTTP.Address)
-	if err := http.ListenAndServe(conf.HTTP.Address, nil); err != nil {
-		return err
+	sinks := []namedSink{{name: "postgres", sink: sink}}
+	if conf.StatsD.Address != "" {
+		statsd, err := newStatsdSink(discardSink{}, conf.StatsD)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, namedSink{name: "statsd", sink: statsd})
+	}
+	if conf.Graphite.Address != "" {
+		graphite := newGraphiteSink(logger, discardSink{}, conf.Graphite)
+		runSink(graphite.Run)
+		sinks = append(sinks, namedSink{name: "graphite", sink: graphite})
+	}
+	if conf.Elasticsearch.URL != "" {
+		es, err := newESSink(logger, discardSink{}, conf.Elasticsearch)
+		if err != nil {
+			return err
+		}
+		runSink(es.Run)
+		sinks = append(sinks, namedSink{name: "elasticsearch", sink: es})
+	}
+	if len(conf.Kafka.Brokers) > 0 {
+		kafka := newKafkaSink(logger, discardSink{}, conf.Kafka)
+		// send the pending messages when shutting down
+		defer func() {
+			if err := kafka.Close(); err != nil {
+				logger.Error("error producing messages to Kafka", "err", err)
+			}
+		}()
+		sinks = append(sinks, namedSink{name: "kafka", sink: kafka})
+	}
+	if conf.RemoteWrite.URL != "" {
+		sinks = append(sinks, namedSink{name: "remote_write", sink: newRemoteWriteSink(logger, discardSink{}, conf.RemoteWrite)})
+	}
+	if len(sinks) > 1 || conf.Sinks.Primary != "" {
+		fanout, err := newFanoutSink(logger, sinks, conf.Sinks)
+		if err != nil {
+			return err
+		}
+		// run after the worker pool drained, and before the sinks are
+		// flushed and stopped by the deferred calls above
+		defer fanout.Wait()
+		sink = fanout
+	}
+
+	if conf.WorkerPool.Size > 0 {
+		workers := newWorkerPoolSink(logger, sink, conf.WorkerPool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers.Run(ctx)
+		}()
+		// run after the servers stopped, and before the secondary writes
+		// are waited for and the sinks flushed and stopped by the deferred
+		// calls above
+		defer wg.Wait()
+		sink = workers
 	}
 
+	health := newInsertHealth(conf.HTTP.HealthInsertWindow, clock)
+	pg.health = health
+
+	in := newIngester(logger, conf, sink, stations, clock, -90)
+	in.health = health
+	if in.pressures != nil && conf.Pressure.Seed {
+		if err := in.pressures.Seed(ctx, pool, conf.Database, clock.Now()); err != nil {
+			logger.Warn("error loading recent pressure readings", "err", err)
+		}
+	}
+
+	if conf.UDP.Address != "" {
+		conn, err := net.ListenPacket("udp", conf.UDP.Address)
+		if err != nil {
+			return err
+		}
+		logger.Info("listening for Tempest broadcasts", "addr", conf.UDP.Address)
+		go serveTempest(ctx, logger, conn, in)
+	}
+
+	var maintenance maintenanceMode
+	ingest := maintenance.Middleware(conf.HTTP, makeHandler(logger, in, conf.HTTP))
+	if src := conf.StationName.Source; src == "header" || src == "dns" {
+		ingest = newStationNameResolver(conf.StationName, clock).Middleware(ingest)
+	}
+	if conf.HTTP.HMACSecret != "" {
+		ingest = withSignature(logger, conf.HTTP.HMACSecret, ingest)
+	}
+
+	servers := newServerMuxes(conf.HTTP.Address, conf.HTTP.BasePath)
+	if conf.HTTP.AccessLog.Path != "" {
+		accessLog, err := newAccessLog(conf.HTTP.AccessLog)
+		if err != nil {
+			return fmt.Errorf("opening the access log: %w", err)
+		}
+		defer accessLog.Close()
+		servers.accessLog = accessLog
+	}
+	servers.handlerTimeout = conf.HTTP.HandlerTimeout
+	if conf.HTTP.TLSCertFile != "" {
+		servers.certFile, servers.keyFile = conf.HTTP.TLSCertFile, conf.HTTP.TLSKeyFile
+	}
+	if conf.HTTP.HTTPSRedirect != "" {
+		ingestAddr := conf.HTTP.IngestAddress
+		if ingestAddr == "" {
+			ingestAddr = conf.HTTP.Address
+		}
+		_, port, err := net.SplitHostPort(ingestAddr)
+		if err != nil {
+			return fmt.Errorf("invalid ingest address %q: %w", ingestAddr, err)
+		}
+		servers.redirectAddr, servers.redirectPort = conf.HTTP.HTTPSRedirect, port
+	}
+	servers.Mux(conf.HTTP.IngestAddress).Handle("POST /data/report/", withTracing("POST /data/report/", ingest))
+
+	// the read API and the metrics expose the stations and the state of the
+	// collector, so they are protected by the management token, when set;
+	// /healthz stays open for the probes
+	protect := func(h http.Handler) http.Handler {
+		if conf.HTTP.ManagementToken == "" {
+			return h
+		}
+		return withManagementToken(conf.HTTP.ManagementToken, h)
+	}
+
+	apiMux := servers.Mux(conf.HTTP.APIAddress)
+	handleAPI(apiMux, "/stations", protect(makeStationsHandler(stations, conf.Database.RainUnit, conf.HTTP.APIUnits, conf.HTTP.APILastError)), conf.HTTP.CORSAllowedOrigins)
+	handleAPI(apiMux, "/daily", protect(makeDailyHandler(logger, pool, conf.Database, conf.Stations, conf.DegreeDays, conf.HTTP.APIUnits)), conf.HTTP.CORSAllowedOrigins)
+	if conf.HTTP.ManagementToken != "" {
+		apiMux.Handle("GET /config", withManagementToken(conf.HTTP.ManagementToken, makeConfigHandler(conf)))
+		apiMux.Handle("POST /selftest", withManagementToken(conf.HTTP.ManagementToken, makeSelftestHandler(logger, pg, pg.remove, clock, conf.Database.StoreSource)))
+		maintenanceHandler := withManagementToken(conf.HTTP.ManagementToken, makeMaintenanceHandler(logger, &maintenance))
+		apiMux.Handle("PUT /maintenance", maintenanceHandler)
+		apiMux.Handle("DELETE /maintenance", maintenanceHandler)
+		apiMux.Handle("DELETE /readings", withManagementToken(conf.HTTP.ManagementToken, makeDeleteReadingHandler(logger, pool, pg.tableFor, conf.Database.TimeStorage)))
+	}
+
+	setBuildInfo(version, commit)
+	servers.Mux(conf.HTTP.MetricsAddress).Handle("/metrics", protect(metricsHandler(conf.InstanceName)))
+	servers.Mux(conf.HTTP.MetricsAddress).Handle("GET /healthz", makeHealthHandler(&maintenance, health))
+
+	return servers.Serve(ctx, logger)
+}
+
+// configFlag collects the paths of the -config flags, which can be repeated.
+type configFlag []string
+
+func (f *configFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configFlag) Set(value string) error {
+	*f = append(*f, value)
 	return nil
 }
 
 func main() {
-	var flagConfigFilename string
-	flag.StringVar(&flagConfigFilename, "config", "config.yml", "Path to the configuration file")
+	var flagConfig configFlag
+	var flagVersion bool
+	var flagConfigWait time.Duration
+	flag.Var(&flagConfig, "config", "Path to the configuration file, or a directory of *.yml files; can be repeated, the later files override the earlier ones (default config.yml)")
+	flag.DurationVar(&flagConfigWait, "config-wait", 0, "How long to wait for the configuration file to exist, e.g. when it's mounted after startup")
+	flag.BoolVar(&flagVersion, "version", false, "Print the version and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  serve\tcollect data sent by the weather stations (default)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  archive\tmove old rows to Parquet files\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  replay <file>\tingest the raw form bodies stored in file, one per line\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  cloud-import <from> <to>\timport the data stored in the Ecowitt cloud between two dates (YYYY-MM-DD)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  print-schema\tprint the CREATE TABLE statement for the configured table\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	conf, err := config.Load(flagConfigFilename)
+	if flagVersion {
+		fmt.Printf("ecowitt-collector %s (%s)\n", version, commit)
+		return
+	}
+
+	if len(flagConfig) == 0 {
+		flagConfig = configFlag{"config.yml"}
+	}
+	flagConfigFilename := flagConfig.String()
+
+	conf, err := config.LoadWait(flagConfig, flagConfigWait, time.Second)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: failed to load configuration file %s: %s\n", flagConfigFilename, err)
 		os.Exit(1)
 	}
+	if _, err := storedColumns(ignoredColumns(conf.Database)); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid configuration file %s: %s\n", flagConfigFilename, err)
+		os.Exit(1)
+	}
+	if conf.Database.InsertSQL != "" {
+		if _, err := parseInsertTemplate(conf.Database.InsertSQL); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid configuration file %s: %s\n", flagConfigFilename, err)
+			os.Exit(1)
+		}
+	}
 
 	var logLevel slog.Level
 	if err := logLevel.UnmarshalText([]byte(conf.LogLevel)); err != nil {
@@ -228,10 +592,44 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	if conf.InstanceName == "" {
+		// an error leaves the name empty, which only omits the label value
+		conf.InstanceName, _ = os.Hostname()
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})).
+		With("instance", conf.InstanceName)
 	slog.SetDefault(logger)
 
-	if err := run(logger, conf); err != nil {
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		err = run(logger, conf)
+	case "archive":
+		err = runArchive(logger, conf)
+	case "replay":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = runReplay(logger, conf, flag.Arg(1))
+	case "cloud-import":
+		if flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = runCloudImport(logger, conf, flag.Arg(1), flag.Arg(2))
+	case "print-schema":
+		var columns []dbColumn
+		if columns, err = storedColumns(ignoredColumns(conf.Database)); err == nil {
+			fmt.Print(createTableStatement(conf.Database.Table, withTimeStorage(columns, conf.Database.TimeStorage)))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
 		logger.Error("fatal error", "err", err)
 		os.Exit(1)
 	}
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/schema"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestParsePayload(t *testing.T) {
@@ -92,3 +105,554 @@ func TestWindDegreesToName(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		sinkErr    error
+		wantStatus int
+		wantStored int
+	}{
+		{"ok", sampleQuery, nil, http.StatusOK, 1},
+		{"bad payload", "dateutc=yesterday", nil, http.StatusBadRequest, 0},
+		{"sink error", sampleQuery, errors.New("database is down"), http.StatusOK, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{err: tt.sinkErr}
+			in := newTestIngester(t, config.Config{}, sink)
+			handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+			req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			written := sink.Written()
+			if len(written) != tt.wantStored {
+				t.Fatalf("expected %d stored readings, got %d", tt.wantStored, len(written))
+			}
+
+			if tt.wantStored > 0 {
+				form, _ := url.ParseQuery(tt.body)
+				wd := written[0]
+				if wd.Station != form.Get("stationtype") || wd.Model != form.Get("model") || *wd.OutdoorHumidity != 47 {
+					t.Errorf("stored data doesn't match the posted form: %+v", wd)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerThrottled(t *testing.T) {
+	sink := &recordingSink{}
+	conf := config.Config{Stations: map[string]config.StationConfig{
+		"EasyWeatherPro_V5.1.3": {MinStoreInterval: time.Minute},
+	}}
+	in := newTestIngester(t, conf, sink)
+	handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+	before := testutil.ToFloat64(reqProcessed)
+	// the station isn't told to retry the readings dropped on purpose
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	if got := testutil.ToFloat64(reqProcessed); got != before+2 {
+		t.Errorf("expected 2 processed requests, got %v", got-before)
+	}
+	if written := sink.Written(); len(written) != 1 {
+		t.Errorf("expected 1 stored reading, got %d", len(written))
+	}
+}
+
+// blockingSink is a MetricsSink whose writes block until release is closed.
+type blockingSink struct {
+	release  chan struct{}
+	inflight atomic.Int32
+	maxSeen  atomic.Int32
+}
+
+func (s *blockingSink) Write(ctx context.Context, wd *WeatherData) error {
+	n := s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+
+	for {
+		seen := s.maxSeen.Load()
+		if n <= seen || s.maxSeen.CompareAndSwap(seen, n) {
+			break
+		}
+	}
+
+	<-s.release
+	return nil
+}
+
+func TestHandlerConcurrencyLimit(t *testing.T) {
+	const (
+		limit    = 2
+		requests = 10
+	)
+
+	sink := &blockingSink{release: make(chan struct{})}
+	in := newTestIngester(t, config.Config{}, newLimitedSink(sink, limit))
+	handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			codes <- rec.Code
+		}()
+	}
+
+	// the requests exceeding the limit are rejected without waiting
+	for i := 0; i < requests-limit; i++ {
+		if code := <-codes; code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+		}
+	}
+
+	close(sink.release)
+	for i := 0; i < limit; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	if got := sink.maxSeen.Load(); got > limit {
+		t.Errorf("expected at most %d concurrent writes, got %d", limit, got)
+	}
+}
+
+func TestHandlerQueue(t *testing.T) {
+	const (
+		queueSize = 2
+		requests  = 10
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &blockingSink{release: make(chan struct{})}
+	queued := newQueuedSink(sink, queueSize, 1)
+	go queued.Run(ctx)
+	in := newTestIngester(t, config.Config{}, queued)
+	handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+	codes := make(chan int, requests)
+	send := func() {
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		codes <- rec.Code
+	}
+
+	// the first request keeps the only worker busy
+	go send()
+	for sink.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < requests; i++ {
+		go send()
+	}
+
+	// the requests that don't fit in the queue are rejected without waiting
+	for i := 0; i < requests-queueSize-1; i++ {
+		if code := <-codes; code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+		}
+	}
+	if depth := testutil.ToFloat64(queueDepth); depth != queueSize {
+		t.Errorf("expected queue depth %d, got %v", queueSize, depth)
+	}
+
+	close(sink.release)
+	for i := 0; i < queueSize+1; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	if got := sink.maxSeen.Load(); got > 1 {
+		t.Errorf("expected at most 1 concurrent write, got %d", got)
+	}
+}
+
+func TestIngestStatus(t *testing.T) {
+	tests := []struct {
+		kind            string
+		retryConversion bool
+		strict          bool
+		want            int
+	}{
+		{"decoder", false, false, http.StatusBadRequest},
+		{"converter", false, false, http.StatusOK},
+		{"converter", true, false, http.StatusInternalServerError},
+		{"busy", false, false, http.StatusServiceUnavailable},
+		{"db", false, false, http.StatusOK},
+		{"db", false, true, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		if got := ingestStatus(tt.kind, tt.retryConversion, tt.strict); got != tt.want {
+			t.Errorf("%s (retry %v, strict %v): expected %d, got %d", tt.kind, tt.retryConversion, tt.strict, tt.want, got)
+		}
+	}
+}
+
+func TestHandlerResponsePolicy(t *testing.T) {
+	sink := &recordingSink{err: errors.New("connection refused")}
+	in := newTestIngester(t, config.Config{}, sink)
+	clock := in.clock.(*fakeClock)
+	start := clock.Now()
+
+	post := func(handler http.Handler) int {
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(makeHandler(in.logger, in, config.HTTPConfig{})); code != http.StatusOK {
+		t.Errorf("lenient: expected 200, got %d", code)
+	}
+
+	handler := makeHandler(in.logger, in, config.HTTPConfig{ResponsePolicy: "strict", ResponseGracePeriod: time.Minute})
+	tests := []struct {
+		after time.Duration
+		err   error
+		want  int
+	}{
+		{0, sink.err, http.StatusOK},
+		{30 * time.Second, sink.err, http.StatusOK},
+		{time.Minute, sink.err, http.StatusServiceUnavailable},
+		// a stored report ends the failures, and starts a new grace period
+		{2 * time.Minute, nil, http.StatusOK},
+		{3 * time.Minute, sink.err, http.StatusOK},
+	}
+	for _, tt := range tests {
+		clock.Set(start.Add(tt.after))
+		sink.mu.Lock()
+		sink.err = tt.err
+		sink.mu.Unlock()
+		if code := post(handler); code != tt.want {
+			t.Errorf("strict, after %s: expected %d, got %d", tt.after, tt.want, code)
+		}
+	}
+}
+
+func TestHandlerMaxFormValues(t *testing.T) {
+	sink := &recordingSink{}
+	in := newTestIngester(t, config.Config{}, sink)
+
+	var extra strings.Builder
+	for i := range 50 {
+		fmt.Fprintf(&extra, "&field%d=1", i)
+	}
+	body := sampleQuery + extra.String()
+
+	tests := []struct {
+		max  int
+		want int
+	}{
+		{0, http.StatusOK},
+		{100, http.StatusOK},
+		{40, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		handler := makeHandler(in.logger, in, config.HTTPConfig{MaxFormValues: tt.max})
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("max %d: expected %d, got %d", tt.max, tt.want, rec.Code)
+		}
+	}
+
+	if got := len(sink.Written()); got != 2 {
+		t.Errorf("expected 2 stored readings, got %d", got)
+	}
+}
+
+func TestHandlerJSONErrors(t *testing.T) {
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+
+	for _, jsonErrors := range []bool{false, true} {
+		handler := makeHandler(in.logger, in, config.HTTPConfig{IngestJSONErrors: jsonErrors})
+
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader("dateutc=yesterday"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+
+		if !jsonErrors {
+			if rec.Body.Len() != 0 {
+				t.Errorf("expected an empty body, got %q", rec.Body.String())
+			}
+			continue
+		}
+
+		var body apiError
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("error decoding the JSON error: %s", err)
+		}
+		if body.Code != http.StatusBadRequest || body.Error == "" {
+			t.Errorf("unexpected error body: %+v", body)
+		}
+		// the missing passkey is reported along with the invalid date
+		if len(body.Fields) != 2 || body.Fields[0].Field != "PASSKEY" || body.Fields[1].Field != "dateutc" {
+			t.Errorf("unexpected invalid fields: %+v", body.Fields)
+		}
+	}
+}
+
+// truncatedReader returns its data, then fails as a connection closed before
+// the whole body was received.
+type truncatedReader struct {
+	data *strings.Reader
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	if r.data.Len() == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return r.data.Read(p)
+}
+
+func TestHandlerTruncatedBody(t *testing.T) {
+	sink := &recordingSink{}
+	in := newTestIngester(t, config.Config{}, sink)
+	handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+	before := testutil.ToFloat64(reqErrors.WithLabelValues("truncated"))
+
+	body := sampleQuery[:len(sampleQuery)/2]
+	req := httptest.NewRequest(http.MethodPost, "/data/report/", &truncatedReader{data: strings.NewReader(body)})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = int64(len(sampleQuery))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if got := testutil.ToFloat64(reqErrors.WithLabelValues("truncated")); got != before+1 {
+		t.Errorf("expected the truncated errors to increase to %v, got %v", before+1, got)
+	}
+	if n := len(sink.Written()); n != 0 {
+		t.Errorf("expected no stored readings, got %d", n)
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        config.DatabaseConfig
+		wantAppName string
+		wantTimeout string
+	}{
+		{"defaults", config.DatabaseConfig{DSN: "postgres://localhost/weather"}, "ecowitt-collector", ""},
+		{"from dsn", config.DatabaseConfig{DSN: "postgres://localhost/weather?application_name=weather"}, "weather", ""},
+		{
+			"configured",
+			config.DatabaseConfig{
+				DSN:              "postgres://localhost/weather?application_name=weather",
+				ApplicationName:  "collector",
+				StatementTimeout: 30 * time.Second,
+			},
+			"collector",
+			"30000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pgConfig, err := poolConfig(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			params := pgConfig.ConnConfig.RuntimeParams
+			if got := params["application_name"]; got != tt.wantAppName {
+				t.Errorf("expected application_name %q, got %q", tt.wantAppName, got)
+			}
+			if got := params["statement_timeout"]; got != tt.wantTimeout {
+				t.Errorf("expected statement_timeout %q, got %q", tt.wantTimeout, got)
+			}
+		})
+	}
+}
+
+// recordingExecer is an Execer that records the statements instead of
+// executing them.
+type recordingExecer struct {
+	sql  []string
+	args [][]any
+}
+
+func (e *recordingExecer) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	e.sql = append(e.sql, sql)
+	e.args = append(e.args, args)
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func TestSendMetrics(t *testing.T) {
+	ts := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC)
+	gust := 7.5
+	wd := WeatherData{
+		Passkey:            "secret",
+		Timestamp:          ts,
+		Station:            "station",
+		AbsolutePressure:   1001.5,
+		RelativePressure:   1013.2,
+		Interval:           time.Minute,
+		OutdoorTemperature: 19.9,
+		WindGustSmoothed:   &gust,
+	}
+
+	db := &recordingExecer{}
+	if err := sendMetrics(context.Background(), &wd, weatherDataColumns, db, "weather"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.sql) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(db.sql))
+	}
+
+	sql, args := db.sql[0], db.args[0]
+	wantPrefix := "INSERT INTO weather(time,station,pressure_absolute,pressure_relative,frequency,"
+	if !strings.HasPrefix(sql, wantPrefix) {
+		t.Errorf("expected statement starting with %q, got %q", wantPrefix, sql)
+	}
+
+	columns, placeholders, ok := strings.Cut(strings.TrimPrefix(sql, "INSERT INTO weather("), ") VALUES(")
+	if !ok {
+		t.Fatalf("unexpected statement %q", sql)
+	}
+	names := strings.Split(columns, ",")
+	placeholders = strings.TrimSuffix(placeholders, ")")
+	if want := makeValuesString(names); placeholders != want {
+		t.Errorf("expected placeholders %q, got %q", want, placeholders)
+	}
+	if len(args) != len(names) {
+		t.Fatalf("got %d columns and %d arguments", len(names), len(args))
+	}
+	if names[len(names)-1] != "wind_gust_smoothed" {
+		t.Errorf("expected the optional column last, got %q", names[len(names)-1])
+	}
+
+	want := map[string]any{
+		"time":                ts,
+		"station":             "station",
+		"pressure_absolute":   1001.5,
+		"pressure_relative":   1013.2,
+		"interval":            60.0,
+		"temperature_outdoor": 19.9,
+		"wind_gust_smoothed":  &gust,
+	}
+	for i, name := range names {
+		if w, ok := want[name]; ok && args[i] != w {
+			t.Errorf("%s: expected %v, got %v", name, w, args[i])
+		}
+		if args[i] == "secret" {
+			t.Errorf("the passkey should not be stored, found in column %s", name)
+		}
+	}
+}
+
+func TestSendMetricsTimeStorage(t *testing.T) {
+	ts := time.Date(2024, 6, 16, 16, 32, 8, 250_000_000, time.UTC)
+	wd := WeatherData{Timestamp: ts, Station: "station"}
+
+	tests := []struct {
+		storage string
+		want    any
+	}{
+		{"", ts},
+		{"timestamptz", ts},
+		{"epoch_seconds", int64(1718555528)},
+		{"epoch_millis", int64(1718555528250)},
+	}
+	for _, tt := range tests {
+		db := &recordingExecer{}
+		if err := sendMetrics(context.Background(), &wd, withTimeStorage(weatherDataColumns, tt.storage), db, "weather"); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(db.sql[0], "INSERT INTO weather(time,") {
+			t.Fatalf("expected time to be the first column, got %q", db.sql[0])
+		}
+		if got := db.args[0][0]; got != tt.want {
+			t.Errorf("%q: expected time %v (%T), got %v (%T)", tt.storage, tt.want, tt.want, got, got)
+		}
+	}
+
+	// the other columns are not affected
+	if weatherDataColumns[0].TimeStorage != "" {
+		t.Errorf("expected withTimeStorage not to change weatherDataColumns")
+	}
+}
+
+func TestHandlerStoreRaw(t *testing.T) {
+	for _, redact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("redact=%v", redact), func(t *testing.T) {
+			sink := &recordingSink{}
+			conf := config.Config{Database: config.DatabaseConfig{StoreRaw: true, RedactRawPasskey: redact}}
+			in := newTestIngester(t, conf, sink)
+			handler := makeHandler(in.logger, in, config.HTTPConfig{})
+
+			req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			written := sink.Written()
+			if len(written) != 1 || written[0].RawQuery == nil {
+				t.Fatalf("expected a stored raw query, got %v", written)
+			}
+			raw := *written[0].RawQuery
+
+			got, err := url.ParseQuery(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := url.ParseQuery(sampleQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if redact {
+				if strings.Contains(raw, want.Get("PASSKEY")) || got.Get("PASSKEY") != "REDACTED" {
+					t.Errorf("the passkey was not redacted: %s", raw)
+				}
+				want.Set("PASSKEY", "REDACTED")
+			} else if raw != sampleQuery {
+				t.Errorf("the raw query was not stored as received: %s", raw)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("the raw query doesn't round-trip: got %v, want %v", got, want)
+			}
+		})
+	}
+}
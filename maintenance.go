@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// maintenanceMode is toggled during planned database maintenance: the reports
+// are rejected with 503 so that the stations send them again later, while the
+// health check keeps succeeding so that the process isn't restarted.
+type maintenanceMode struct {
+	enabled atomic.Bool
+}
+
+// maintenanceStatus is the response of /maintenance and /healthz.
+type maintenanceStatus struct {
+	Status      string `json:"status,omitempty"`
+	Maintenance bool   `json:"maintenance"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Middleware rejects the reports while the maintenance mode is enabled; the
+// error has a JSON body when conf.IngestJSONErrors is set.
+func (m *maintenanceMode) Middleware(conf config.HTTPConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enabled.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", "60")
+		if conf.IngestJSONErrors {
+			writeJSONError(w, http.StatusServiceUnavailable, "maintenance in progress")
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		reqErrors.WithLabelValues("maintenance").Inc()
+	})
+}
+
+// makeMaintenanceHandler enables the maintenance mode on PUT and disables it
+// on DELETE, returning the resulting state as JSON.
+func makeMaintenanceHandler(logger *slog.Logger, m *maintenanceMode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled := r.Method == http.MethodPut
+		if m.enabled.Swap(enabled) != enabled {
+			requestLogger(r.Context(), logger).Warn("maintenance mode changed", "enabled", enabled)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(maintenanceStatus{Maintenance: enabled})
+	})
+}
+
+// makeHealthHandler answers 200 while the process is serving requests,
+// including during maintenance, unless the reports received are not being
+// stored according to health; then it answers 503, with the reason in the
+// body.
+func makeHealthHandler(m *maintenanceMode, health *insertHealth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := maintenanceStatus{Status: "ok", Maintenance: m.enabled.Load()}
+		w.Header().Set("Content-Type", "application/json")
+		if ok, reason := health.Check(); !ok {
+			status.Status, status.Reason = "unhealthy", reason
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+
+	var m maintenanceMode
+	ingest := m.Middleware(config.HTTPConfig{}, makeHandler(logger, in, config.HTTPConfig{}))
+	toggle := makeMaintenanceHandler(logger, &m)
+	health := makeHealthHandler(&m, newInsertHealth(0, realClock{}))
+
+	report := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		ingest.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	healthz := func() int {
+		rec := httptest.NewRecorder()
+		health.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		method     string
+		wantIngest int
+	}{
+		{http.MethodPut, http.StatusServiceUnavailable},
+		{http.MethodDelete, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		toggle.ServeHTTP(rec, httptest.NewRequest(tt.method, "/maintenance", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s /maintenance: expected status %d, got %d", tt.method, http.StatusOK, rec.Code)
+		}
+
+		if code := report(); code != tt.wantIngest {
+			t.Errorf("after %s: expected ingest status %d, got %d", tt.method, tt.wantIngest, code)
+		}
+		if code := healthz(); code != http.StatusOK {
+			t.Errorf("after %s: expected health status %d, got %d", tt.method, http.StatusOK, code)
+		}
+	}
+}
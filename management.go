@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// withManagementToken requires the requests to carry the management token as a
+// bearer token in the Authorization header or, for the clients that can't set
+// headers, in the token query parameter.
+func withManagementToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			got, ok = r.URL.Query().Get("token"), r.URL.Query().Has("token")
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// makeConfigHandler returns the loaded configuration, with the secrets redacted,
+// as JSON using the same keys as the configuration file.
+func makeConfigHandler(conf config.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// round trip through YAML to get the keys and the values (e.g. the
+		// durations) in the format used by the configuration file
+		b, err := yaml.Marshal(conf.Redacted())
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error encoding the configuration")
+			return
+		}
+
+		var v map[string]any
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error encoding the configuration")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	})
+}
+
+// selftestStation is the station of the readings written by /selftest, so that
+// they can be told apart from the real ones if they're left in the database.
+const selftestStation = "__selftest__"
+
+// selftestResult is the response of /selftest.
+type selftestResult struct {
+	OK      bool      `json:"ok"`
+	Station string    `json:"station"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// selftestReading returns a plausible reading taken at t.
+func selftestReading(t time.Time) *WeatherData {
+	uv := 3.0
+	outdoorHumidity, indoorHumidity, windDirection := 55, 45, 180
+	return &WeatherData{
+		Timestamp:          t.UTC().Truncate(time.Second),
+		Station:            selftestStation,
+		AbsolutePressure:   1005.2,
+		RelativePressure:   1013.25,
+		Frequency:          "868M",
+		OutdoorHumidity:    &outdoorHumidity,
+		IndoorHumidity:     &indoorHumidity,
+		Interval:           60 * time.Second,
+		Model:              "selftest",
+		StationType:        "selftest",
+		SolarRadiation:     250,
+		OutdoorTemperature: 20,
+		IndoorTemperature:  21,
+		UV:                 &uv,
+		WindDirection:      &windDirection,
+		WindGust:           3.5,
+		WindSpeed:          2.1,
+	}
+}
+
+// makeSelftestHandler writes a synthetic reading to sink, the database,
+// checking the connection and the schema, then deletes it with remove, and
+// returns the outcome as JSON; when storeSource is set, the reading has
+// "selftest" as its source.
+func makeSelftestHandler(logger *slog.Logger, sink MetricsSink, remove func(context.Context, *WeatherData) error, clock Clock, storeSource bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wd := selftestReading(clock.Now())
+		if storeSource {
+			source := sourceSelftest
+			wd.Source = &source
+		}
+		result := selftestResult{OK: true, Station: wd.Station, Time: wd.Timestamp}
+
+		code := http.StatusOK
+		err := sink.Write(r.Context(), wd)
+		if err == nil {
+			if err = remove(r.Context(), wd); err != nil {
+				err = fmt.Errorf("removing the synthetic reading: %w", err)
+			}
+		}
+		if err != nil {
+			requestLogger(r.Context(), logger).Error("self-test failed", "err", err)
+			result.OK, result.Error = false, err.Error()
+			code = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
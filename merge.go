@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// reportedColumns maps the form fields sent by the Ecowitt stations to the
+// columns that would be stored as zero, rather than NULL, when the field is
+// missing from the report; the other columns are either NULL when their field
+// is missing, or always sent, like the station.
+var reportedColumns = map[string]string{
+	"baromabsin":     "pressure_absolute",
+	"baromrelin":     "pressure_relative",
+	"freq":           "frequency",
+	"heap":           "heap",
+	"dailyrainin":    "daily_rain",
+	"eventrainin":    "event_rain",
+	"hourlyrainin":   "hourly_rain",
+	"monthlyrainin":  "monthly_rain",
+	"rainratein":     "rain_rate",
+	"totalrainin":    "total_rain",
+	"weeklyrainin":   "weekly_rain",
+	"yearlyrainin":   "yearly_rain",
+	"interval":       "interval",
+	"model":          "model",
+	"runtime":        "runtime",
+	"solarradiation": "solar_radiation",
+	"stationtype":    "station_type",
+	"tempf":          "temperature_outdoor",
+	"tempinf":        "temperature_indoor",
+	"wh65batt":       "battery",
+	"maxdailygust":   "wind_max_daily_gust",
+	"windgustmph":    "wind_gust",
+	"windspeedmph":   "wind_speed",
+}
+
+// unreportedColumns returns the columns of reportedColumns whose field is
+// missing from form.
+func unreportedColumns(form url.Values) map[string]bool {
+	unreported := make(map[string]bool)
+	for field, column := range reportedColumns {
+		if _, ok := form[field]; !ok {
+			unreported[column] = true
+		}
+	}
+
+	return unreported
+}
+
+// reported reports whether the fields of all columns were in the report, so
+// that the derivations and the metrics don't use the zeros standing for the
+// missing ones; the Tempest readings have their own unreported columns, see
+// tempestUnreported.
+func (wd *WeatherData) reported(columns ...string) bool {
+	for _, column := range columns {
+		if wd.unreported[column] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeMetrics stores wd like sendMetrics, but merges it into the row already
+// stored for the same station and time, if any: the columns having a value
+// replace the stored ones, while the NULL columns and the ones missing from
+// the report keep them. It needs a unique index on (station, time).
+func mergeMetrics(ctx context.Context, wd *WeatherData, stored []dbColumn, db Execer, table string) error {
+	names, args := wd.columnValues(stored)
+
+	// the missing fields are left out, so that a new row stores them as
+	// NULL and an existing row keeps their values
+	n := 0
+	for i, name := range names {
+		if wd.unreported[name] {
+			continue
+		}
+		names[n], args[n] = name, args[i]
+		n++
+	}
+	names, args = names[:n], args[:n]
+
+	var updates []string
+	for _, name := range names {
+		if name == "station" || name == "time" {
+			continue
+		}
+		updates = append(updates, fmt.Sprintf("%s = COALESCE(EXCLUDED.%[1]s, existing.%[1]s)", name))
+	}
+	action := "NOTHING"
+	if len(updates) > 0 {
+		action = "UPDATE SET " + strings.Join(updates, ", ")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	if _, err := db.Exec(ctx,
+		fmt.Sprintf("INSERT INTO %s AS existing(%s) VALUES(%s) ON CONFLICT (station, time) DO %s",
+			table, makeColumnString(names), makeValuesString(names), action),
+		args...,
+	); err != nil {
+		return fmt.Errorf("executing INSERT query: %w", err)
+	}
+
+	return nil
+}
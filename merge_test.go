@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestMergeMetrics(t *testing.T) {
+	// the first half of a reading split across two reports
+	form := url.Values{
+		"PASSKEY":      {"LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI"},
+		"dateutc":      {"2024-06-16 16:32:08"},
+		"tempf":        {"67.8"},
+		"humidity":     {"47"},
+		"windspeedmph": {"0.22"},
+		"interval":     {"60"},
+	}
+
+	conf := config.Config{Database: config.DatabaseConfig{Merge: true}}
+	in := newTestIngester(t, conf, &recordingSink{})
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &recordingExecer{}
+	if err := mergeMetrics(context.Background(), wd, weatherDataColumns, db, "weather"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.sql) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(db.sql))
+	}
+
+	sql := db.sql[0]
+	insert, update, ok := strings.Cut(sql, " ON CONFLICT (station, time) DO UPDATE SET ")
+	if !ok {
+		t.Fatalf("expected an upsert, got %q", sql)
+	}
+
+	columns, _, _ := strings.Cut(strings.TrimPrefix(insert, "INSERT INTO weather AS existing("), ")")
+	names := strings.Split(columns, ",")
+	if len(names) != len(db.args[0]) {
+		t.Fatalf("got %d columns and %d values", len(names), len(db.args[0]))
+	}
+	for _, name := range []string{"time", "station", "temperature_outdoor", "humidity_outdoor", "wind_speed", "interval"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("expected the %s column to be stored, got %v", name, names)
+		}
+	}
+	// without the merge, these would be stored as 0
+	for _, name := range []string{"temperature_indoor", "pressure_relative", "daily_rain", "wind_gust", "model"} {
+		if slices.Contains(names, name) {
+			t.Errorf("expected the unreported %s column not to be stored", name)
+		}
+	}
+
+	for _, want := range []string{
+		"temperature_outdoor = COALESCE(EXCLUDED.temperature_outdoor, existing.temperature_outdoor)",
+		"wind_speed = COALESCE(EXCLUDED.wind_speed, existing.wind_speed)",
+	} {
+		if !strings.Contains(update, want) {
+			t.Errorf("expected %q in the update, got %q", want, update)
+		}
+	}
+	for _, key := range []string{"station =", "time =", "temperature_indoor ="} {
+		if strings.Contains(update, key) {
+			t.Errorf("expected %q not to be updated, got %q", key, update)
+		}
+	}
+}
+
+func TestMergeMetricsNothingToUpdate(t *testing.T) {
+	wd := WeatherData{Station: "station"}
+	wd.unreported = make(map[string]bool)
+	for _, col := range weatherDataColumns {
+		if col.Name != "station" && col.Name != "time" {
+			wd.unreported[col.Name] = true
+		}
+	}
+
+	db := &recordingExecer{}
+	if err := mergeMetrics(context.Background(), &wd, weatherDataColumns, db, "weather"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "INSERT INTO weather AS existing(time,station) VALUES($1,$2) ON CONFLICT (station, time) DO NOTHING"
+	if db.sql[0] != want {
+		t.Errorf("expected %q, got %q", want, db.sql[0])
+	}
+}
+
+func TestMergeTwoPartialReports(t *testing.T) {
+	first := url.Values{
+		"PASSKEY":      {"LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI"},
+		"stationtype":  {"EasyWeatherPro_V5.1.3"},
+		"dateutc":      {"2024-06-16 16:32:08"},
+		"tempf":        {"67.8"},
+		"humidity":     {"47"},
+		"windspeedmph": {"0.22"},
+	}
+	second := url.Values{
+		"PASSKEY":     {"LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI"},
+		"stationtype": {"EasyWeatherPro_V5.1.3"},
+		"dateutc":     {"2024-06-16 16:32:08"},
+		"baromrelin":  {"29.920"},
+		"baromabsin":  {"29.565"},
+	}
+
+	conf := config.Config{
+		Database:        config.DatabaseConfig{Merge: true},
+		FeelsLikeMethod: "us",
+		DegreeDays:      config.DegreeDaysConfig{Enabled: true},
+	}
+	in := newTestIngester(t, conf, &recordingSink{})
+
+	// the row resulting from the upserts: the non-NULL values replace the
+	// stored ones, like with COALESCE(EXCLUDED.col, existing.col)
+	row := make(map[string]any)
+	for _, form := range []url.Values{first, second} {
+		wd, err := in.Ingest(context.Background(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db := &recordingExecer{}
+		if err := mergeMetrics(context.Background(), wd, weatherDataColumns, db, "weather"); err != nil {
+			t.Fatal(err)
+		}
+		columns, _, _ := strings.Cut(strings.TrimPrefix(db.sql[0], "INSERT INTO weather AS existing("), ")")
+		for i, name := range strings.Split(columns, ",") {
+			if v := reflect.ValueOf(db.args[0][i]); v.Kind() == reflect.Pointer && v.IsNil() {
+				continue
+			}
+			row[name] = db.args[0][i]
+		}
+	}
+
+	// the derivations of the first report aren't overwritten by the ones
+	// computed from the zeros standing for its fields missing from the second
+	if v, ok := row["temperature_outdoor"].(float64); !ok || math.Abs(v-19.89) > 0.01 {
+		t.Errorf("expected the temperature of the first report, got %v", row["temperature_outdoor"])
+	}
+	if v, ok := row["feels_like"].(*float64); !ok || math.Abs(*v-19.89) > 0.01 {
+		t.Errorf("expected the feels-like temperature of the first report, got %v", row["feels_like"])
+	}
+	if v, ok := row["heating_degree_days"].(*float64); !ok || *v != 0 {
+		t.Errorf("expected no heating degree days from the first report, got %v", row["heating_degree_days"])
+	}
+	if v, ok := row["pressure_relative"].(float64); !ok || math.Abs(v-1013.2) > 0.1 {
+		t.Errorf("expected the pressure of the second report, got %v", row["pressure_relative"])
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// instanceLabel is the label added to all the metrics to tell apart the
+// collectors scraped by the same Prometheus.
+const instanceLabel = "instance_name"
+
+var (
+	stationTemperature = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_temperature_celsius",
+			Help: "The most recent temperature reported by the station",
+		},
+		[]string{"station", "sensor"},
+	)
+	stationHumidity = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_humidity_percent",
+			Help: "The most recent relative humidity reported by the station",
+		},
+		[]string{"station", "sensor"},
+	)
+	stationPressure = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_pressure_hpa",
+			Help: "The most recent barometric pressure reported by the station",
+		},
+		[]string{"station", "type"},
+	)
+	stationWindSpeed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_wind_speed_meters_per_second",
+			Help: "The most recent wind speed reported by the station",
+		},
+		[]string{"station"},
+	)
+	stationWindGust = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_wind_gust_meters_per_second",
+			Help: "The most recent wind gust reported by the station",
+		},
+		[]string{"station"},
+	)
+	stationWindDirection = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_wind_direction_degrees",
+			Help: "The most recent wind direction reported by the station",
+		},
+		[]string{"station"},
+	)
+	stationRainRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_rain_rate_millimeters_per_hour",
+			Help: "The most recent rain rate reported by the station",
+		},
+		[]string{"station"},
+	)
+	stationBattery = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_battery",
+			Help: "The most recent battery status reported by the station (0=OK, 1=LOW)",
+		},
+		[]string{"station"},
+	)
+	stationLastSeen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_station_last_seen_timestamp_seconds",
+			Help: "The time at which the station last sent a valid report",
+		},
+		[]string{"station"},
+	)
+
+	collectorUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ecowitt_collector_up",
+		Help: "Whether the collector is running (always 1 while it serves requests)",
+	})
+	collectorBuildInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ecowitt_collector_build_info",
+			Help: "A metric with a constant value of 1 labelled with the version and the commit of the collector",
+		},
+		[]string{"version", "commit"},
+	)
+)
+
+// setBuildInfo sets the collector_up and collector_build_info gauges; it's
+// called once when the collector starts serving requests.
+func setBuildInfo(version, commit string) {
+	collectorUp.Set(1)
+	collectorBuildInfo.WithLabelValues(version, commit).Set(1)
+}
+
+// instanceGatherer adds the instanceLabel, set to instance, to all the
+// metrics of the wrapped Gatherer.
+type instanceGatherer struct {
+	prometheus.Gatherer
+	instance string
+}
+
+func (g instanceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			name, value := instanceLabel, g.instance
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: &name, Value: &value})
+			// the exposition expects the labels sorted by name, as
+			// returned by the registry
+			slices.SortFunc(metric.Label, func(a, b *dto.LabelPair) int {
+				return strings.Compare(a.GetName(), b.GetName())
+			})
+		}
+	}
+
+	return families, err
+}
+
+// metricsHandler serves the metrics of the default registry, like
+// promhttp.Handler, labelled with the name of the instance.
+func metricsHandler(instance string) http.Handler {
+	gatherer := instanceGatherer{Gatherer: prometheus.DefaultGatherer, instance: instance}
+	return promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}),
+	)
+}
+
+// updateStationMetrics sets the per-station gauges to the values of wd,
+// received at the given time.
+func updateStationMetrics(wd *WeatherData, now time.Time) {
+	station := wd.Station
+
+	// the gauges of a missing sensor, or of a field missing from the report,
+	// keep their last value
+	set := func(g prometheus.Gauge, column string, v float64) {
+		if wd.reported(column) {
+			g.Set(v)
+		}
+	}
+
+	set(stationTemperature.WithLabelValues(station, "outdoor"), "temperature_outdoor", wd.OutdoorTemperature)
+	set(stationTemperature.WithLabelValues(station, "indoor"), "temperature_indoor", wd.IndoorTemperature)
+	if wd.OutdoorHumidity != nil {
+		stationHumidity.WithLabelValues(station, "outdoor").Set(float64(*wd.OutdoorHumidity))
+	}
+	if wd.IndoorHumidity != nil {
+		stationHumidity.WithLabelValues(station, "indoor").Set(float64(*wd.IndoorHumidity))
+	}
+	set(stationPressure.WithLabelValues(station, "absolute"), "pressure_absolute", wd.AbsolutePressure)
+	set(stationPressure.WithLabelValues(station, "relative"), "pressure_relative", wd.RelativePressure)
+	set(stationWindSpeed.WithLabelValues(station), "wind_speed", wd.WindSpeed)
+	set(stationWindGust.WithLabelValues(station), "wind_gust", wd.WindGust)
+	if wd.WindDirection != nil {
+		stationWindDirection.WithLabelValues(station).Set(float64(*wd.WindDirection))
+	}
+	set(stationRainRate.WithLabelValues(station), "rain_rate", wd.RainRate)
+	set(stationBattery.WithLabelValues(station), "battery", wd.BatteryLevel)
+	stationLastSeen.WithLabelValues(station).Set(float64(now.UnixNano()) / 1e9)
+}
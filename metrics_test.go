@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpdateStationMetrics(t *testing.T) {
+	wd := WeatherData{
+		Station:            "test-station",
+		OutdoorTemperature: 19.9,
+		OutdoorHumidity:    ptr(47),
+		BatteryLevel:       1,
+	}
+
+	clock := newFakeClock(time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC))
+	updateStationMetrics(&wd, clock.Now())
+
+	if got := testutil.ToFloat64(stationTemperature.WithLabelValues("test-station", "outdoor")); got != 19.9 {
+		t.Errorf("temperature: got %v, want 19.9", got)
+	}
+	if got := testutil.ToFloat64(stationHumidity.WithLabelValues("test-station", "outdoor")); got != 47 {
+		t.Errorf("humidity: got %v, want 47", got)
+	}
+	if got := testutil.ToFloat64(stationBattery.WithLabelValues("test-station")); got != 1 {
+		t.Errorf("battery: got %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(stationLastSeen.WithLabelValues("test-station")); got != 1718555528 {
+		t.Errorf("last seen: got %v, want 1718555528", got)
+	}
+}
+
+func TestSetBuildInfo(t *testing.T) {
+	setBuildInfo("v1.2.3", "abc1234")
+
+	if got := testutil.ToFloat64(collectorUp); got != 1 {
+		t.Errorf("up: got %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(collectorBuildInfo.WithLabelValues("v1.2.3", "abc1234")); got != 1 {
+		t.Errorf("build info: got %v, want 1", got)
+	}
+}
+
+func TestMetricsHandlerInstanceName(t *testing.T) {
+	setBuildInfo("v1.2.3", "abc1234")
+
+	rec := httptest.NewRecorder()
+	metricsHandler("collector-1").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `ecowitt_collector_build_info{commit="abc1234",instance_name="collector-1",version="v1.2.3"} 1`
+	if body := rec.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("metrics don't contain %q:\n%s", want, body)
+	}
+}
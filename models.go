@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// modelFields maps a station model to the form fields it's known to send; the
+// model is matched ignoring its firmware version (e.g. "WS2900_V2.02.03" matches "WS2900").
+var modelFields = map[string][]string{
+	"WS2900": {
+		"PASSKEY", "stationtype", "runtime", "dateutc", "tempinf", "humidityin", "baromrelin",
+		"baromabsin", "tempf", "humidity", "winddir", "windspeedmph", "windgustmph", "maxdailygust",
+		"solarradiation", "uv", "rainratein", "eventrainin", "hourlyrainin", "dailyrainin",
+		"weeklyrainin", "monthlyrainin", "yearlyrainin", "totalrainin", "vpd", "wh65batt", "freq",
+		"model", "interval",
+	},
+}
+
+// optionalFields are the form fields that some firmwares of any model send,
+// and that are not reported as unexpected.
+var optionalFields = []string{"ptrend", "weather"}
+
+func init() {
+	// the WS2910 is sold with the same console as the WS2900
+	modelFields["WS2910"] = modelFields["WS2900"]
+}
+
+// modelBase returns the model name without the firmware version.
+func modelBase(model string) string {
+	base, _, _ := strings.Cut(model, "_")
+	return base
+}
+
+// defaultModelVersionPattern splits e.g. "WS2900_V2.02.03" in "WS2900" and
+// "2.02.03", and "EasyWeatherV1.6.4" in "EasyWeather" and "1.6.4".
+const defaultModelVersionPattern = `(?i)^(?P<base>.+?)[_-]?V(?P<version>\d[\w.]*)$`
+
+// modelSplitter splits a model or a station type in its name and firmware
+// version, with a regular expression having the "base" and "version" named
+// groups.
+type modelSplitter struct {
+	re      *regexp.Regexp
+	base    int
+	version int
+}
+
+func newModelSplitter(pattern string) *modelSplitter {
+	if pattern == "" {
+		pattern = defaultModelVersionPattern
+	}
+	// the pattern is checked when loading the configuration
+	re := regexp.MustCompile(pattern)
+
+	return &modelSplitter{
+		re:      re,
+		base:    re.SubexpIndex("base"),
+		version: re.SubexpIndex("version"),
+	}
+}
+
+// Split returns the name, in upper case so that it doesn't depend on how the
+// firmware spells it, and the version of model; when model doesn't match,
+// it's returned as the name and version is empty.
+func (s *modelSplitter) Split(model string) (base, version string) {
+	m := s.re.FindStringSubmatch(model)
+	if m == nil {
+		return strings.ToUpper(model), ""
+	}
+
+	return strings.ToUpper(m[s.base]), m[s.version]
+}
+
+// Columns returns the values of the base and version columns for model; they
+// are NULL when model is empty, and the version when it doesn't match.
+func (s *modelSplitter) Columns(model string) (base, version *string) {
+	if model == "" {
+		return nil, nil
+	}
+
+	b, v := s.Split(model)
+	if v == "" {
+		return &b, nil
+	}
+	return &b, &v
+}
+
+// checkModelFields compares the fields in form with the ones known to be sent by
+// model, returning the fields that are unexpected (e.g. after a firmware change)
+// and the ones that are missing (e.g. a sensor failure). Models that are not
+// in the registry are not checked; known is false for them.
+func checkModelFields(model string, form url.Values) (unexpected, missing []string, known bool) {
+	fields, ok := modelFields[modelBase(model)]
+	if !ok {
+		return nil, nil, false
+	}
+
+	for key := range form {
+		if !slices.Contains(fields, key) && !slices.Contains(optionalFields, key) {
+			unexpected = append(unexpected, key)
+		}
+	}
+
+	for _, field := range fields {
+		if _, ok := form[field]; !ok {
+			missing = append(missing, field)
+		}
+	}
+
+	slices.Sort(unexpected)
+	return unexpected, missing, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestCheckModelFields(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unexpected, missing, known := checkModelFields(form.Get("model"), form)
+	if !known {
+		t.Fatalf("expected model %s to be known", form.Get("model"))
+	}
+	if len(unexpected) > 0 || len(missing) > 0 {
+		t.Fatalf("expected no differences, got unexpected=%v missing=%v", unexpected, missing)
+	}
+
+	form.Set("tf_ch1", "60.1")
+	form.Set("ptrend", "rising")
+	form.Del("uv")
+	unexpected, missing, _ = checkModelFields(form.Get("model"), form)
+	if !slices.Equal(unexpected, []string{"tf_ch1"}) {
+		t.Errorf("expected unexpected=[tf_ch1], got %v", unexpected)
+	}
+	if !slices.Equal(missing, []string{"uv"}) {
+		t.Errorf("expected missing=[uv], got %v", missing)
+	}
+
+	if _, _, known := checkModelFields("GW1100A_V2.1.4", form); known {
+		t.Errorf("expected model GW1100A to be unknown")
+	}
+}
+
+func TestModelSplitter(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		model       string
+		wantBase    string
+		wantVersion string
+	}{
+		{"", "WS2900_V2.02.03", "WS2900", "2.02.03"},
+		{"", "WS2900_V2.02.04", "WS2900", "2.02.04"},
+		{"", "ws2900_v2.02.04", "WS2900", "2.02.04"},
+		{"", "GW2000A_V2.1.4", "GW2000A", "2.1.4"},
+		{"", "EasyWeatherV1.6.4", "EASYWEATHER", "1.6.4"},
+		{"", "HP2551", "HP2551", ""},
+		{`^(?P<base>[^.]+)\.(?P<version>.+)$`, "WH2650A.1.7.5", "WH2650A", "1.7.5"},
+	}
+
+	for _, tt := range tests {
+		base, version := newModelSplitter(tt.pattern).Split(tt.model)
+		if base != tt.wantBase || version != tt.wantVersion {
+			t.Errorf("%s: got %q %q, want %q %q", tt.model, base, version, tt.wantBase, tt.wantVersion)
+		}
+	}
+
+	base, version := newModelSplitter("").Columns("HP2551")
+	if base == nil || *base != "HP2551" || version != nil {
+		t.Errorf("expected the base only for a model without version, got %v %v", base, version)
+	}
+	if base, version := newModelSplitter("").Columns(""); base != nil || version != nil {
+		t.Errorf("expected no values for an empty model, got %v %v", base, version)
+	}
+}
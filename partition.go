@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionNamer resolves a table name pattern containing strftime-like
+// directives (%Y, %m, %d and %%) from the time of a reading, caching the
+// resolved names by day.
+type partitionNamer struct {
+	pattern string
+
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func newPartitionNamer(pattern string) (*partitionNamer, error) {
+	if _, err := formatTableName(pattern, time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &partitionNamer{
+		pattern: pattern,
+		names:   make(map[string]string),
+	}, nil
+}
+
+// Name returns the name of the table storing the readings taken at t.
+func (p *partitionNamer) Name(t time.Time) string {
+	day := t.UTC().Format(time.DateOnly)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name, ok := p.names[day]
+	if !ok {
+		// the pattern was validated by newPartitionNamer
+		name, _ = formatTableName(p.pattern, t.UTC())
+		p.names[day] = name
+	}
+
+	return name
+}
+
+// formatTableName expands the directives in pattern with the values of t.
+func formatTableName(pattern string, t time.Time) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			b.WriteByte(pattern[i])
+			continue
+		}
+
+		i++
+		if i == len(pattern) {
+			return "", fmt.Errorf("invalid table pattern %q: trailing %%", pattern)
+		}
+
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("invalid table pattern %q: unknown directive %%%c", pattern, pattern[i])
+		}
+	}
+
+	return b.String(), nil
+}
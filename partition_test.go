@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPartitionNamer(t *testing.T) {
+	namer, err := newPartitionNamer("weather_%Y_%m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2024, 6, 16, 16, 32, 10, 0, time.UTC), "weather_2024_06"},
+		{time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC), "weather_2024_12"},
+		// the name is resolved from the UTC time
+		{time.Date(2025, 1, 1, 0, 30, 0, 0, time.FixedZone("CET", 3600)), "weather_2024_12"},
+	}
+
+	for _, tt := range tests {
+		if got := namer.Name(tt.t); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.t, tt.want, got)
+		}
+	}
+}
+
+func TestFormatTableName(t *testing.T) {
+	ts := time.Date(2024, 6, 5, 0, 0, 0, 0, time.UTC)
+	if got, err := formatTableName("weather_%Y%m%d", ts); err != nil || got != "weather_20240605" {
+		t.Errorf("expected weather_20240605, got %q (%v)", got, err)
+	}
+
+	for _, pattern := range []string{"weather_%H", "weather_%"} {
+		if _, err := newPartitionNamer(pattern); err == nil {
+			t.Errorf("expected an error for pattern %q", pattern)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// The defaults for the pressure tendency, based on the 3 hours tendency used
+// by the synoptic observations.
+const (
+	defaultTendencyWindow    = 3 * time.Hour
+	defaultTendencyThreshold = 1.0
+)
+
+// The pressure tendencies.
+const (
+	tendencyRising  = "rising"
+	tendencyFalling = "falling"
+	tendencySteady  = "steady"
+)
+
+type pressureSample struct {
+	Time     time.Time
+	Pressure float64
+}
+
+// pressureTracker keeps, for each station, the relative pressure readings
+// received within a time window, to compute the pressure tendency: the change
+// of the pressure from the reading taken a window earlier.
+//
+// The readings only live in memory, so after a restart the tendency is only
+// available once a full window of readings has been received again, unless
+// the tracker is seeded from the database.
+type pressureTracker struct {
+	window    time.Duration
+	threshold float64
+
+	mu      sync.Mutex
+	samples *lruMap[[]pressureSample]
+}
+
+func newPressureTracker(window time.Duration, threshold float64, maxStations int) *pressureTracker {
+	return &pressureTracker{
+		window:    window,
+		threshold: threshold,
+		samples:   newLRUMap[[]pressureSample](maxStations),
+	}
+}
+
+// tolerance is how far from a full window the reference reading can be.
+func (p *pressureTracker) tolerance() time.Duration {
+	return p.window / 6
+}
+
+// Add records a pressure reading for station and returns the tendency over
+// the window ending at t; ok is false when there isn't a reading old enough
+// to compare with.
+func (p *pressureTracker) Add(station string, t time.Time, pressure float64) (tendency string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cutoff := t.Add(-p.window - p.tolerance())
+	previous, _ := p.samples.Get(station)
+	samples := previous[:0]
+	for _, s := range previous {
+		if s.Time.After(cutoff) && s.Time.Before(t) {
+			samples = append(samples, s)
+		}
+	}
+	samples = append(samples, pressureSample{Time: t, Pressure: pressure})
+	p.samples.Put(station, samples)
+
+	// the oldest reading is the one closest to a window earlier
+	ref := samples[0]
+	if ref.Time.After(t.Add(-p.window + p.tolerance())) {
+		return "", false
+	}
+
+	switch delta := pressure - ref.Pressure; {
+	case delta >= p.threshold:
+		return tendencyRising, true
+	case delta <= -p.threshold:
+		return tendencyFalling, true
+	default:
+		return tendencySteady, true
+	}
+}
+
+// Seed loads the pressure readings of the last window from the database, so
+// that the tendency is available right after a restart.
+func (p *pressureTracker) Seed(ctx context.Context, pool *pgxpool.Pool, db config.DatabaseConfig, now time.Time) error {
+	rows, err := pool.Query(ctx, fmt.Sprintf(
+		`SELECT station, %[1]s, %[2]s FROM %[3]s
+		WHERE time > $1 AND %[2]s IS NOT NULL ORDER BY time`, columnExpr(db, "time"), columnExpr(db, "pressure_relative"), db.Table),
+		timeBound(now.Add(-p.window-p.tolerance()).UTC(), db.TimeStorage))
+	if err != nil {
+		return fmt.Errorf("querying recent pressure readings: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			station string
+			s       pressureSample
+		)
+		if err := rows.Scan(&station, &s.Time, &s.Pressure); err != nil {
+			return fmt.Errorf("reading recent pressure readings: %w", err)
+		}
+
+		p.mu.Lock()
+		samples, _ := p.samples.Get(station)
+		p.samples.Put(station, append(samples, s))
+		p.mu.Unlock()
+	}
+
+	return rows.Err()
+}
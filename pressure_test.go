@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPressureTracker(t *testing.T) {
+	start := time.Date(2024, 6, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		end   float64
+		want  string
+		delta time.Duration
+	}{
+		{"rising", 1015.5, tendencyRising, 3 * time.Hour},
+		{"falling", 1010.0, tendencyFalling, 3 * time.Hour},
+		{"steady", 1013.8, tendencySteady, 3 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPressureTracker(3*time.Hour, 1, 0)
+
+			// a reading every 10 minutes, from 1013.2hPa
+			for ts := start; ts.Before(start.Add(tt.delta)); ts = ts.Add(10 * time.Minute) {
+				p.Add("station", ts, 1013.2)
+			}
+
+			got, ok := p.Add("station", start.Add(tt.delta), tt.end)
+			if !ok || got != tt.want {
+				t.Errorf("expected %q, got %q (ok=%v)", tt.want, got, ok)
+			}
+		})
+	}
+}
+
+func TestPressureTrackerHistory(t *testing.T) {
+	start := time.Date(2024, 6, 16, 12, 0, 0, 0, time.UTC)
+	p := newPressureTracker(3*time.Hour, 1, 0)
+
+	// not enough history yet
+	p.Add("station", start, 1013.2)
+	if _, ok := p.Add("station", start.Add(time.Hour), 1020); ok {
+		t.Error("expected no tendency with one hour of history")
+	}
+
+	// other stations are tracked separately
+	if _, ok := p.Add("other", start.Add(3*time.Hour), 1000); ok {
+		t.Error("expected no tendency for a new station")
+	}
+
+	// the reference is the reading closest to 3 hours earlier, not the first one
+	got, ok := p.Add("station", start.Add(4*time.Hour), 1020.5)
+	if !ok || got != tendencySteady {
+		t.Errorf("expected %q, got %q (ok=%v)", tendencySteady, got, ok)
+	}
+}
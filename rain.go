@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// defaultRainMismatchThreshold is the difference, in mm, between the daily
+// rain and the increase of the total rain above which a reading is flagged,
+// when rain_reconciliation.threshold is not set; it allows for a few tips of
+// the rain gauge around midnight.
+const defaultRainMismatchThreshold = 1.0
+
+// rainDay is the total rain of a station during a local day.
+type rainDay struct {
+	date string // in the station's timezone
+
+	// start is the total rain at the last reading of the previous day, and
+	// known is false when it's unknown, e.g. for the first day seen
+	start float64
+	known bool
+
+	last     float64
+	mismatch bool
+}
+
+// rainReconciler compares the daily rain sent by the stations with the
+// increase of their total rain since the local midnight, which should be the
+// same: a difference points at a bug of the rain counting, e.g. a daily rain
+// not reset at midnight, or a reset of the total rain. The days start at
+// midnight in the timezone of each station, which must be the one of the
+// console, where the daily rain is reset.
+//
+// The totals only live in memory, so the readings of the day in progress when
+// the collector starts are not compared.
+type rainReconciler struct {
+	threshold float64
+	locations map[string]*time.Location
+
+	mu   sync.Mutex
+	days *lruMap[rainDay]
+}
+
+func newRainReconciler(conf config.RainReconciliationConfig, stations map[string]config.StationConfig, maxStations int) *rainReconciler {
+	threshold := conf.Threshold
+	if threshold == 0 {
+		threshold = defaultRainMismatchThreshold
+	}
+
+	// the timezones are checked when loading the configuration
+	locations := make(map[string]*time.Location)
+	for station := range stations {
+		if loc, err := stationLocation(stations, station); err == nil {
+			locations[station] = loc
+		}
+	}
+
+	return &rainReconciler{
+		threshold: threshold,
+		locations: locations,
+		days:      newLRUMap[rainDay](maxStations),
+	}
+}
+
+// Add records the daily and total rain (mm) of a reading of station taken at
+// t, returning the increase of the total rain since the local midnight and
+// whether the daily rain differs from it by more than the threshold; ok is
+// false when the total at midnight is unknown. started is true when the
+// mismatch starts with this reading, so that it's only logged once.
+func (r *rainReconciler) Add(station string, t time.Time, daily, total float64) (fromTotal float64, mismatch, started, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loc := r.locations[station]
+	if loc == nil {
+		loc = time.UTC
+	}
+	date := t.In(loc).Format(time.DateOnly)
+
+	day, seen := r.days.Get(station)
+	switch {
+	case !seen:
+		day = rainDay{date: date}
+	case date < day.date:
+		// a late reading of the previous day
+		return 0, false, false, false
+	case date > day.date:
+		day = rainDay{date: date, start: day.last, known: true}
+	}
+	day.last = total
+
+	if day.known {
+		fromTotal = total - day.start
+		mismatch = math.Abs(daily-fromTotal) > r.threshold
+		started = mismatch && !day.mismatch
+		day.mismatch = mismatch
+	}
+	r.days.Put(station, day)
+
+	return fromTotal, mismatch, started, day.known
+}
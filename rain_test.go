@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestRainReconciler(t *testing.T) {
+	stations := map[string]config.StationConfig{"station": {Timezone: "Europe/Rome"}}
+	r := newRainReconciler(config.RainReconciliationConfig{}, stations, 0)
+
+	// midnight in Rome is 22:00 UTC in summer
+	day := func(hour, minute int) time.Time {
+		return time.Date(2024, 6, 16, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name         string
+		t            time.Time
+		daily, total float64
+		fromTotal    float64
+		mismatch     bool
+		started      bool
+		ok           bool
+	}{
+		{"first reading, unknown total at midnight", day(21, 58), 4.2, 100.2, 0, false, false, false},
+		{"same day", day(21, 59), 4.2, 100.2, 0, false, false, false},
+		{"after the local midnight", day(22, 0), 0, 100.2, 0, false, false, true},
+		{"late reading of the previous day", day(21, 59), 4.2, 100.2, 0, false, false, false},
+		{"rain", day(22, 30), 1.6, 101.8, 1.6, false, false, true},
+		{"within the threshold", day(22, 31), 2.0, 102.6, 2.4, false, false, true},
+		{"daily rain not counting", day(22, 40), 2.0, 104.6, 4.4, true, true, true},
+		{"still not counting", day(22, 41), 2.0, 105.0, 4.8, true, false, true},
+		{"counting again", day(22, 42), 5.0, 105.2, 5.0, false, false, true},
+	}
+	for _, tt := range tests {
+		fromTotal, mismatch, started, ok := r.Add("station", tt.t, tt.daily, tt.total)
+		if math.Abs(fromTotal-tt.fromTotal) > 1e-9 || mismatch != tt.mismatch || started != tt.started || ok != tt.ok {
+			t.Errorf("%s: got (%v, %v, %v, %v), want (%v, %v, %v, %v)", tt.name,
+				fromTotal, mismatch, started, ok, tt.fromTotal, tt.mismatch, tt.started, tt.ok)
+		}
+	}
+}
+
+func TestRainReconcilerThreshold(t *testing.T) {
+	r := newRainReconciler(config.RainReconciliationConfig{Threshold: 0.2}, nil, 0)
+
+	// without a timezone, the days start at midnight UTC
+	r.Add("station", time.Date(2024, 6, 15, 23, 59, 0, 0, time.UTC), 3.0, 50.0)
+	_, mismatch, _, ok := r.Add("station", time.Date(2024, 6, 16, 0, 30, 0, 0, time.UTC), 0.3, 50.6)
+	if !ok || !mismatch {
+		t.Errorf("expected a mismatch of 0.3mm above the 0.2mm threshold, got mismatch=%v ok=%v", mismatch, ok)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// readingsDB is the part of *pgxpool.Pool used to correct the stored readings.
+type readingsDB interface {
+	Execer
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// hasReadingKey tells whether table has a unique index on (station, time),
+// which makes a reading addressable by its station and time.
+func hasReadingKey(ctx context.Context, db readingsDB, table string) (bool, error) {
+	var ok bool
+	err := db.QueryRow(ctx,
+		`SELECT EXISTS (
+			SELECT 1 FROM pg_index i
+			WHERE i.indrelid = $1::regclass AND i.indisunique AND i.indnatts = 2
+			AND (SELECT array_agg(a.attname::text ORDER BY a.attname) FROM pg_attribute a
+				WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)) = ARRAY['station', 'time']
+		)`, table,
+	).Scan(&ok)
+
+	return ok, err
+}
+
+// makeDeleteReadingHandler deletes the reading of a station taken at a given
+// time, e.g. an obviously bad one; tableFor returns the table storing the
+// readings taken at a time. The table must have a unique index on (station,
+// time), so that at most one row is deleted.
+func makeDeleteReadingHandler(logger *slog.Logger, db readingsDB, tableFor func(time.Time) string, timeStorage string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r.Context(), logger)
+
+		station := r.URL.Query().Get("station")
+		if station == "" || r.URL.Query().Get("time") == "" {
+			writeJSONError(w, http.StatusBadRequest, "the station and time parameters are required")
+			return
+		}
+
+		t, err := time.Parse(time.RFC3339, r.URL.Query().Get("time"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid time, expected RFC 3339")
+			return
+		}
+		t = t.UTC()
+		table := tableFor(t)
+
+		ok, err := hasReadingKey(r.Context(), db, table)
+		if err != nil {
+			logger.Error("error checking the indexes", "table", table, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "error querying the database")
+			return
+		}
+		if !ok {
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("deleting readings requires a unique index on %s (station, time)", table))
+			return
+		}
+
+		tag, err := db.Exec(r.Context(), fmt.Sprintf("DELETE FROM %s WHERE station = $1 AND time = $2", table), station, timeBound(t, timeStorage))
+		if err != nil {
+			logger.Error("error deleting reading", "station", station, "time", t, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "error querying the database")
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeJSONError(w, http.StatusNotFound, "no reading found")
+			return
+		}
+
+		logger.Info("deleted reading", "station", station, "time", t, "table", table, "client", r.RemoteAddr)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"station": station, "time": t, "deleted": tag.RowsAffected()})
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeReadingsDB is a readingsDB whose table has a unique index on (station,
+// time) when indexed is set, and holds a single reading.
+type fakeReadingsDB struct {
+	indexed bool
+	station string
+	time    time.Time
+	deleted []string
+}
+
+type boolRow bool
+
+func (r boolRow) Scan(dest ...any) error {
+	*dest[0].(*bool) = bool(r)
+	return nil
+}
+
+func (db *fakeReadingsDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return boolRow(db.indexed)
+}
+
+func (db *fakeReadingsDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if args[0] != db.station || !args[1].(time.Time).Equal(db.time) {
+		return pgconn.NewCommandTag("DELETE 0"), nil
+	}
+	db.deleted = append(db.deleted, sql)
+	return pgconn.NewCommandTag("DELETE 1"), nil
+}
+
+func TestDeleteReadingHandler(t *testing.T) {
+	ts := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tableFor := func(time.Time) string { return "weather" }
+
+	tests := []struct {
+		name    string
+		query   string
+		indexed bool
+		code    int
+	}{
+		{"deleted", "station=abc&time=2024-06-16T16:32:08Z", true, http.StatusOK},
+		{"other timezone", "station=abc&time=2024-06-16T18:32:08%2B02:00", true, http.StatusOK},
+		{"not found", "station=abc&time=2024-06-16T16:33:08Z", true, http.StatusNotFound},
+		{"missing station", "time=2024-06-16T16:32:08Z", true, http.StatusBadRequest},
+		{"invalid time", "station=abc&time=yesterday", true, http.StatusBadRequest},
+		{"no unique index", "station=abc&time=2024-06-16T16:32:08Z", false, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeReadingsDB{indexed: tt.indexed, station: "abc", time: ts}
+			h := makeDeleteReadingHandler(logger, db, tableFor, "")
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/readings?"+tt.query, nil))
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected status %d, got %d: %s", tt.code, rec.Code, rec.Body)
+			}
+			if deleted := len(db.deleted); (tt.code == http.StatusOK) != (deleted == 1) {
+				t.Errorf("unexpected deletions %v", db.deleted)
+			}
+		})
+	}
+}
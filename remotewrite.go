@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/piger/ecowitt-collector/internal/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// defaultRemoteWritePrefix is prepended to the column names to name the
+// series when remote_write.prefix is not set.
+const defaultRemoteWritePrefix = "weather_"
+
+// remoteWriteSink pushes the numeric values of each reading to a Prometheus
+// remote-write endpoint, e.g. VictoriaMetrics or Mimir, as one sample per
+// column with the station's timestamp, before writing it to the wrapped sink.
+// Like for StatsD, pushing is best effort: errors are logged without
+// affecting the storage of the data.
+type remoteWriteSink struct {
+	next   MetricsSink
+	logger *slog.Logger
+	client *http.Client
+	conf   config.RemoteWriteConfig
+}
+
+func newRemoteWriteSink(logger *slog.Logger, next MetricsSink, conf config.RemoteWriteConfig) *remoteWriteSink {
+	if conf.Prefix == "" {
+		conf.Prefix = defaultRemoteWritePrefix
+	}
+
+	return &remoteWriteSink{
+		next:   next,
+		logger: logger,
+		client: &http.Client{Timeout: 30 * time.Second},
+		conf:   conf,
+	}
+}
+
+func (s *remoteWriteSink) Write(ctx context.Context, wd *WeatherData) error {
+	if err := s.push(ctx, wd); err != nil {
+		s.logger.Error("error pushing samples to the remote-write endpoint", "station", wd.Station, "err", err)
+	}
+
+	return s.next.Write(ctx, wd)
+}
+
+func (s *remoteWriteSink) push(ctx context.Context, wd *WeatherData) error {
+	body := snappy.Encode(nil, remoteWriteRequest(wd, s.conf.Prefix, s.conf.Labels))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case s.conf.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.conf.BearerToken)
+	case s.conf.Username != "":
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// remoteWriteRequest encodes a remote-write WriteRequest protobuf message with
+// one series per numeric column of wd, named after the column with prefix and
+// labelled with the station and labels.
+func remoteWriteRequest(wd *WeatherData, prefix string, labels map[string]string) []byte {
+	// the labels of a series must be sorted by name; __name__ is added
+	// first, as it sorts before any lower case label
+	var common [][2]string
+	for name, value := range labels {
+		common = append(common, [2]string{name, value})
+	}
+	common = append(common, [2]string{"station", wd.Station})
+	slices.SortFunc(common, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+
+	timestamp := wd.Timestamp.UnixMilli()
+
+	var req []byte
+	names, values := wd.columnValues(weatherDataColumns)
+	for i, name := range names {
+		value, ok := sampleValue(values[i])
+		if !ok {
+			continue
+		}
+
+		var series []byte
+		series = appendLabel(series, "__name__", prefix+name)
+		for _, label := range common {
+			series = appendLabel(series, label[0], label[1])
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+
+	return req
+}
+
+// appendLabel appends a Label message, as field 1 of a TimeSeries, to b.
+func appendLabel(b []byte, name, value string) []byte {
+	var label []byte
+	label = protowire.AppendTag(label, 1, protowire.BytesType)
+	label = protowire.AppendString(label, name)
+	label = protowire.AppendTag(label, 2, protowire.BytesType)
+	label = protowire.AppendString(label, value)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, label)
+}
+
+// sampleValue returns v as a sample value, if it's a number.
+func sampleValue(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case *float64:
+		if v == nil {
+			return 0, false
+		}
+		return *v, true
+	case int:
+		return float64(v), true
+	case *int:
+		if v == nil {
+			return 0, false
+		}
+		return float64(*v), true
+	default:
+		return 0, false
+	}
+}
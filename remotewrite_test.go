@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/piger/ecowitt-collector/internal/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSeries is a decoded TimeSeries with a single sample.
+type remoteWriteSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeFields calls fn for each field of the protobuf message b.
+func decodeFields(t *testing.T, b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, v uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			fn(num, typ, value, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fn(num, typ, nil, v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fn(num, typ, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+}
+
+func decodeWriteRequest(t *testing.T, b []byte) map[string]remoteWriteSeries {
+	series := map[string]remoteWriteSeries{}
+	decodeFields(t, b, func(_ protowire.Number, _ protowire.Type, ts []byte, _ uint64) {
+		s := remoteWriteSeries{labels: map[string]string{}}
+		decodeFields(t, ts, func(num protowire.Number, _ protowire.Type, msg []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				decodeFields(t, msg, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				s.labels[name] = value
+			case 2:
+				decodeFields(t, msg, func(num protowire.Number, _ protowire.Type, _ []byte, v uint64) {
+					if num == 1 {
+						s.value = math.Float64frombits(v)
+					} else {
+						s.timestamp = int64(v)
+					}
+				})
+			}
+		})
+		series[s.labels["__name__"]] = s
+	})
+	return series
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	next := &recordingSink{}
+	sink := newRemoteWriteSink(logger, next, config.RemoteWriteConfig{
+		URL:         server.URL,
+		BearerToken: "token",
+		Labels:      map[string]string{"env": "home"},
+	})
+
+	wd := &WeatherData{
+		Timestamp:          time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC),
+		Station:            "station",
+		OutdoorTemperature: 19.9,
+		OutdoorHumidity:    ptr(47),
+	}
+	if err := sink.Write(context.Background(), wd); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Written()) != 1 {
+		t.Errorf("expected the reading to be written to the next sink")
+	}
+
+	req := <-requests
+	for header, want := range map[string]string{
+		"Content-Type":     "application/x-protobuf",
+		"Content-Encoding": "snappy",
+		"Authorization":    "Bearer token",
+	} {
+		if got := req.Header.Get(header); got != want {
+			t.Errorf("expected %s %q, got %q", header, want, got)
+		}
+	}
+
+	body, err := snappy.Decode(nil, <-bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := decodeWriteRequest(t, body)
+
+	temperature, ok := series["weather_temperature_outdoor"]
+	if !ok {
+		t.Fatalf("expected a weather_temperature_outdoor series, got %v", series)
+	}
+	if temperature.value != 19.9 || temperature.timestamp != wd.Timestamp.UnixMilli() {
+		t.Errorf("unexpected sample %v at %d", temperature.value, temperature.timestamp)
+	}
+	if temperature.labels["station"] != "station" || temperature.labels["env"] != "home" {
+		t.Errorf("unexpected labels %v", temperature.labels)
+	}
+	if humidity := series["weather_humidity_outdoor"]; humidity.value != 47 {
+		t.Errorf("expected a humidity of 47, got %v", humidity.value)
+	}
+	// the text columns are not numbers
+	if _, ok := series["weather_model"]; ok {
+		t.Errorf("unexpected series for the model")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// replay reads a file containing the raw, URL-encoded form bodies sent by the
+// stations, one per line, and runs them through the ingest pipeline. Lines
+// can also be entries of the dead-letter file, whose body is replayed.
+func replay(ctx context.Context, logger *slog.Logger, in *ingester, filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	ctx = withIngestSource(ctx, sourceReplay)
+
+	var ok, throttled, failed int
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "{") {
+			var entry deadLetter
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				logger.Error("error parsing dead-letter entry", "line", lineno, "err", err)
+				failed++
+				continue
+			}
+			line = entry.Body
+		}
+
+		form, err := url.ParseQuery(line)
+		if err != nil {
+			logger.Error("error parsing form data", "line", lineno, "err", err)
+			failed++
+			continue
+		}
+
+		if _, err := in.Ingest(ctx, form); err != nil {
+			if errors.Is(err, errThrottled) {
+				throttled++
+				continue
+			}
+			logger.Error("error ingesting data", "line", lineno, "err", err)
+			failed++
+			continue
+		}
+		ok++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", filename, err)
+	}
+
+	logger.Info("replay completed", "file", filename, "ingested", ok, "throttled", throttled, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d lines could not be ingested", failed)
+	}
+
+	return nil
+}
+
+func runReplay(logger *slog.Logger, conf config.Config, filename string) error {
+	ctx := context.Background()
+
+	pool, err := newPool(ctx, conf.Database)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	pg, err := newPgSink(pool, conf.Database)
+	if err != nil {
+		return err
+	}
+	sink := newCopySink(pg, defaultCopyBatchSize)
+
+	in := newIngester(logger, conf, sink, newStationTracker(conf.Stations, conf.MaxTrackedStations), realClock{}, -90)
+	// the file being replayed might be the dead-letter file itself
+	in.deadLetters = nil
+
+	replayErr := replay(ctx, logger, in, filename)
+	if err := sink.Flush(ctx); err != nil {
+		return fmt.Errorf("storing the replayed data: %w", err)
+	}
+
+	return replayErr
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// requestIDHeader is the header carrying the request ID, both in the requests
+// and in the responses.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// newRequestID returns a short random identifier.
+func newRequestID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming request ID is safe to be logged
+// and echoed back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// withRequestID assigns an ID to each request, or uses the one set by the
+// client, and returns it in the X-Request-ID response header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request ctx belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns logger with the ID of the request ctx belongs to, if any.
+func requestLogger(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return logger.With("req_id", id)
+	}
+
+	return logger
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// notNullColumns are the columns that are always set.
+var notNullColumns = map[string]bool{
+	"time":    true,
+	"station": true,
+}
+
+// columnType returns the PostgreSQL type of col, storing values of type t, as
+// converted by columnValues.
+func columnType(col dbColumn, t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		if col.TimeStorage == "epoch_seconds" || col.TimeStorage == "epoch_millis" {
+			return "bigint"
+		}
+		return "TIMESTAMP"
+	case reflect.TypeOf(time.Duration(0)):
+		return "integer"
+	case reflect.TypeOf(rainData{}):
+		return "jsonb"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "text"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "double precision"
+	default:
+		panic(fmt.Sprintf("no column type for %s", t))
+	}
+}
+
+// createTableStatement returns the CREATE TABLE statement for the table
+// storing WeatherData, derived from its db tags.
+func createTableStatement(table string, columns []dbColumn) string {
+	t := reflect.TypeOf(WeatherData{})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (\n", table)
+	for i, col := range columns {
+		fmt.Fprintf(&b, "    %s %s", col.Name, columnType(col, t.Field(col.Index).Type))
+		if notNullColumns[col.Name] {
+			b.WriteString(" NOT NULL")
+		}
+		if i < len(columns)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n")
+
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCreateTableStatement(t *testing.T) {
+	stmt := createTableStatement("weather_station", weatherDataColumns)
+
+	for _, line := range []string{
+		"CREATE TABLE IF NOT EXISTS weather_station (\n",
+		"    time TIMESTAMP NOT NULL,\n",
+		"    station text NOT NULL,\n",
+		"    humidity_outdoor integer,\n",
+		"    interval integer,\n",
+		"    wind_gust_smoothed double precision,\n",
+	} {
+		if !strings.Contains(stmt, line) {
+			t.Errorf("expected %q in:\n%s", line, stmt)
+		}
+	}
+
+	if !strings.HasSuffix(stmt, "    rain jsonb\n);\n") {
+		t.Errorf("expected the statement to end with the rain column:\n%s", stmt)
+	}
+}
+
+// the example schema must stay in sync with the columns written by the collector
+func TestSchemaFileColumns(t *testing.T) {
+	b, err := os.ReadFile("docs/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re := regexp.MustCompile(`(?m)^\s+(\w+)\s+\w+`)
+	var got []string
+	for _, m := range re.FindAllStringSubmatch(string(b), -1) {
+		got = append(got, m[1])
+	}
+
+	var want []string
+	for _, col := range weatherDataColumns {
+		want = append(want, col.Name)
+	}
+
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("docs/schema.sql columns %v don't match %v", got, want)
+	}
+}
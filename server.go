@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout is how long the servers wait for the in-flight requests to
+// complete when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// defaultHandlerTimeout bounds the requests when http.handler_timeout is not
+// set; it leaves room for the 20 seconds of a database write.
+const defaultHandlerTimeout = 30 * time.Second
+
+// serverMuxes assigns groups of routes to listen addresses, so that e.g. the
+// ingest endpoint can be exposed on the LAN and the API only on localhost.
+// All the routes are served under basePath, when running behind a reverse
+// proxy that doesn't strip its own prefix.
+type serverMuxes struct {
+	defaultAddr string
+	basePath    string
+	muxes       map[string]*http.ServeMux
+
+	// accessLog, when set, receives a line for each request
+	accessLog io.Writer
+
+	// certFile and keyFile, when set, make all the addresses serve HTTPS
+	certFile string
+	keyFile  string
+
+	// redirectAddr, when set, serves plain HTTP redirecting every request to
+	// HTTPS on redirectPort
+	redirectAddr string
+	redirectPort string
+
+	// handlerTimeout bounds the handling of each request; defaults to
+	// defaultHandlerTimeout
+	handlerTimeout time.Duration
+}
+
+func newServerMuxes(defaultAddr, basePath string) *serverMuxes {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+
+	return &serverMuxes{
+		defaultAddr: defaultAddr,
+		basePath:    basePath,
+		muxes:       make(map[string]*http.ServeMux),
+	}
+}
+
+// Mux returns the mux serving addr, or the default address if addr is empty.
+func (s *serverMuxes) Mux(addr string) *http.ServeMux {
+	if addr == "" {
+		addr = s.defaultAddr
+	}
+
+	mux, ok := s.muxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		s.muxes[addr] = mux
+	}
+
+	return mux
+}
+
+// handler returns the handler serving mux under the base path. The requests
+// taking longer than handlerTimeout, from the parsing to the last sink, get a
+// 503 and their context is cancelled, releasing e.g. their database
+// connection.
+func (s *serverMuxes) handler(mux *http.ServeMux) http.Handler {
+	var handler http.Handler = mux
+	if s.basePath != "" {
+		handler = http.StripPrefix(s.basePath, mux)
+	}
+
+	timeout := s.handlerTimeout
+	if timeout <= 0 {
+		timeout = defaultHandlerTimeout
+	}
+	return http.TimeoutHandler(handler, timeout, "")
+}
+
+// httpsRedirect redirects the requests to the same host and path over HTTPS,
+// on port, with a 308 so that the clients following it repeat the POST
+// requests with their body.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// listen listens on addr, which is either "host:port", with IPv6 hosts
+// enclosed in brackets (e.g. "[::1]:8080"), or ":port" to listen on all the
+// IPv4 and IPv6 addresses.
+func listen(addr string) (net.Listener, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return nil, fmt.Errorf("invalid address %q: IPv6 addresses must be enclosed in brackets, e.g. \"[::1]:8080\"", addr)
+		}
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Serve starts a server for each address, and runs until ctx is done or one of
+// the servers fails; then all the servers are shut down.
+func (s *serverMuxes) Serve(ctx context.Context, logger *slog.Logger) error {
+	var tlsConfig *tls.Config
+	if s.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return fmt.Errorf("loading the TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	handlers := make(map[string]http.Handler, len(s.muxes)+1)
+	for addr, mux := range s.muxes {
+		handler := withRequestID(s.handler(mux))
+		if s.accessLog != nil {
+			handler = withAccessLog(s.accessLog, handler)
+		}
+		handlers[addr] = handler
+	}
+	if s.redirectAddr != "" {
+		handlers[s.redirectAddr] = httpsRedirect(s.redirectPort)
+	}
+
+	listeners := make(map[string]net.Listener, len(handlers))
+	for addr := range handlers {
+		ln, err := listen(addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("server on %s: %w", addr, err)
+		}
+		listeners[addr] = ln
+	}
+
+	servers := make([]*http.Server, 0, len(handlers))
+	errc := make(chan error, len(handlers))
+	for addr, handler := range handlers {
+		srv := &http.Server{Addr: addr, Handler: handler}
+		servers = append(servers, srv)
+
+		if tlsConfig != nil && addr != s.redirectAddr {
+			srv.TLSConfig = tlsConfig
+		}
+
+		ln := listeners[addr]
+		go func() {
+			logger.Info("starting server", "addr", ln.Addr().String(), "tls", srv.TLSConfig != nil)
+			var err error
+			if srv.TLSConfig != nil {
+				// the plain HTTP requests get a 400
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errc <- fmt.Errorf("server on %s: %w", addr, err)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		logger.Info("shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if serr := srv.Shutdown(shutdownCtx); serr != nil {
+			logger.Error("error shutting down server", "addr", srv.Addr, "err", serr)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerMuxes(t *testing.T) {
+	servers := newServerMuxes(":8080", "")
+
+	if servers.Mux("") != servers.Mux(":8080") {
+		t.Error("expected an empty address to use the default mux")
+	}
+	if servers.Mux("127.0.0.1:8081") == servers.Mux(":8080") {
+		t.Error("expected a different mux for a different address")
+	}
+	if n := len(servers.muxes); n != 2 {
+		t.Errorf("expected 2 muxes, got %d", n)
+	}
+}
+
+func TestServerMuxesBasePath(t *testing.T) {
+	for _, basePath := range []string{"/ecowitt", "/ecowitt/", "ecowitt"} {
+		servers := newServerMuxes(":8080", basePath)
+		mux := servers.Mux("")
+		mux.Handle("GET /stations", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		h := servers.handler(mux)
+
+		for path, want := range map[string]int{
+			"/ecowitt/stations": http.StatusOK,
+			"/stations":         http.StatusNotFound,
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != want {
+				t.Errorf("base path %q, %s: expected status %d, got %d", basePath, path, want, rec.Code)
+			}
+		}
+	}
+}
+
+func TestServerMuxesHandlerTimeout(t *testing.T) {
+	servers := newServerMuxes(":8080", "")
+	servers.handlerTimeout = 10 * time.Millisecond
+	mux := servers.Mux("")
+
+	cancelled := make(chan struct{})
+	mux.Handle("POST /data/report/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a stuck sink, only stopped by the deadline
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+
+	rec := httptest.NewRecorder()
+	servers.handler(mux).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/data/report/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rec.Code)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the context of the request to be cancelled")
+	}
+}
+
+func TestServerMuxesServeError(t *testing.T) {
+	// keep an address busy, so that one of the servers fails to start
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	servers := newServerMuxes(ln.Addr().String(), "")
+	servers.Mux("")
+	servers.Mux("127.0.0.1:0")
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	errc := make(chan error, 1)
+	go func() { errc <- servers.Serve(context.Background(), logger) }()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after a server failed")
+	}
+}
+
+func TestServerMuxesServeShutdown(t *testing.T) {
+	servers := newServerMuxes("127.0.0.1:0", "")
+	servers.Mux("")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	errc := make(chan error, 1)
+	go func() { errc <- servers.Serve(ctx, logger) }()
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after the context was canceled")
+	}
+}
+
+func TestListen(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0", ":0"} {
+		ln, err := listen(addr)
+		if err != nil {
+			if addr == "[::1]:0" {
+				t.Logf("skipping IPv6: %s", err)
+				continue
+			}
+			t.Fatalf("%s: %s", addr, err)
+		}
+
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+		go srv.Serve(ln)
+
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Errorf("%s: %s", addr, err)
+		} else {
+			resp.Body.Close()
+		}
+		srv.Close()
+	}
+}
+
+func TestListenInvalidAddress(t *testing.T) {
+	_, err := listen("::1:8080")
+	if err == nil || !strings.Contains(err.Error(), "brackets") {
+		t.Errorf("expected an error about brackets, got %v", err)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		port, host, target, want string
+	}{
+		{"8443", "collector.lan:8080", "/data/report/?a=b", "https://collector.lan:8443/data/report/?a=b"},
+		{"443", "collector.lan", "/stations", "https://collector.lan/stations"},
+		{"8443", "[fd00::10]:8080", "/", "https://[fd00::10]:8443/"},
+		{"443", "[fd00::10]", "/", "https://[fd00::10]/"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		httpsRedirect(tt.port).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.want {
+			t.Errorf("%s%s: expected a 308 to %s, got %d to %s", tt.host, tt.target, tt.want, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir, returning their paths.
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServerMuxesServeTLS(t *testing.T) {
+	// find two free ports
+	var addrs []string
+	for range 2 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		ln.Close()
+	}
+	httpsAddr, redirectAddr := addrs[0], addrs[1]
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+
+	servers := newServerMuxes(httpsAddr, "")
+	servers.Mux("").Handle("POST /data/report/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	servers.certFile, servers.keyFile = writeTestCertificate(t, t.TempDir())
+	servers.redirectAddr, servers.redirectPort = redirectAddr, httpsPort
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	go servers.Serve(ctx, logger)
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	post := func(url string) *http.Response {
+		t.Helper()
+		var (
+			resp *http.Response
+			err  error
+		)
+		// wait for the servers to start
+		for range 50 {
+			if resp, err = client.Post(url, "application/x-www-form-urlencoded", strings.NewReader("a=b")); err == nil {
+				resp.Body.Close()
+				return resp
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	if resp := post("https://" + httpsAddr + "/data/report/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 over HTTPS, got %d", resp.StatusCode)
+	}
+	if resp := post("http://" + httpsAddr + "/data/report/"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected plain HTTP to be rejected on the HTTPS address, got %d", resp.StatusCode)
+	}
+	resp := post("http://" + redirectAddr + "/data/report/")
+	if want := "https://" + httpsAddr + "/data/report/"; resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != want {
+		t.Errorf("expected a 308 to %s, got %d to %s", want, resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
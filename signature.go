@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// signatureHeader is the header containing the hex encoded HMAC-SHA256 of the
+// request body; the "sha256=" prefix is optional.
+const signatureHeader = "X-Signature"
+
+// maxSignedBodySize is the largest body read to check its signature, the
+// limit applied by ParseForm to the unsigned ones.
+const maxSignedBodySize = 10 << 20
+
+// verifySignature reports whether signature is the HMAC-SHA256 of body with secret.
+func verifySignature(secret, body []byte, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// withSignature rejects the requests whose body isn't signed with secret.
+func withSignature(logger *slog.Logger, secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r.Context(), logger)
+
+		// the body is read before being authenticated, so its size is capped
+		counter := &countingBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxSignedBodySize)}
+		body, err := io.ReadAll(counter)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			logger.Warn("request body too large", "client", r.RemoteAddr, "limit", maxErr.Limit)
+			reqErrors.With(prometheus.Labels{"error_type": "parser"}).Inc()
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			reportBodyError(logger.With("client", r.RemoteAddr), r, counter, err)
+			return
+		}
+
+		if !verifySignature([]byte(secret), body, r.Header.Get(signatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			logger.Warn("invalid request signature", "client", r.RemoteAddr)
+			reqErrors.With(prometheus.Labels{"error_type": "signature"}).Inc()
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
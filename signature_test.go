@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithSignature(t *testing.T) {
+	const secret = "s3cr3t"
+	body := "PASSKEY=test&tempf=67.8"
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	valid := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name       string
+		signature  string
+		wantStatus int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"valid with prefix", "sha256=" + valid, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"invalid", strings.Repeat("0", 64), http.StatusUnauthorized},
+		{"not hex", "nope", http.StatusUnauthorized},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBody string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				gotBody = string(b)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(body))
+			if tt.signature != "" {
+				req.Header.Set(signatureHeader, tt.signature)
+			}
+			rec := httptest.NewRecorder()
+			withSignature(logger, secret, next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantStatus == http.StatusOK && gotBody != body {
+				t.Errorf("the body was not passed to the next handler: %q", gotBody)
+			}
+		})
+	}
+}
+
+func TestWithSignatureBodyTooLarge(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request should not reach the next handler")
+	})
+
+	body := strings.NewReader(strings.Repeat("a", maxSignedBodySize+1))
+	req := httptest.NewRequest(http.MethodPost, "/data/report/", body)
+	req.Header.Set(signatureHeader, strings.Repeat("0", 64))
+	rec := httptest.NewRecorder()
+	withSignature(slog.New(slog.NewTextHandler(io.Discard, nil)), "s3cr3t", next).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
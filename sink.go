@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MetricsSink is where the weather data is stored.
+type MetricsSink interface {
+	Write(ctx context.Context, wd *WeatherData) error
+}
+
+// flusher is implemented by the sinks that hold on to the readings, to store
+// them at once.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// pgSink stores the weather data in a PostgreSQL table or, when a partition
+// pattern is configured, in the table resolved from each reading's time.
+type pgSink struct {
+	pool    *pgxpool.Pool
+	table   string
+	columns []dbColumn
+
+	// insert replaces the generated INSERT when insert_sql is configured
+	insert *insertTemplate
+
+	// merge is true when the readings are merged into the stored ones
+	merge bool
+
+	timeStorage string
+
+	partitions       *partitionNamer
+	createPartitions bool
+
+	// health is nil unless the successful inserts are tracked
+	health *insertHealth
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+func newPgSink(pool *pgxpool.Pool, conf config.DatabaseConfig) (*pgSink, error) {
+	columns, err := storedColumns(ignoredColumns(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	s := pgSink{
+		columns:          withTimeStorage(columns, conf.TimeStorage),
+		pool:             pool,
+		table:            conf.Table,
+		createPartitions: conf.CreatePartitions,
+		merge:            conf.Merge,
+		timeStorage:      conf.TimeStorage,
+		created:          make(map[string]bool),
+	}
+
+	if conf.InsertSQL != "" {
+		insert, err := parseInsertTemplate(conf.InsertSQL)
+		if err != nil {
+			return nil, err
+		}
+		insert.columns = withTimeStorage(insert.columns, conf.TimeStorage)
+		s.insert = insert
+	}
+
+	if conf.PartitionTable != "" {
+		partitions, err := newPartitionNamer(conf.PartitionTable)
+		if err != nil {
+			return nil, err
+		}
+		s.partitions = partitions
+	}
+
+	return &s, nil
+}
+
+func (s *pgSink) Write(ctx context.Context, wd *WeatherData) error {
+	err := s.write(ctx, wd)
+	if err == nil && s.health != nil {
+		s.health.Inserted()
+	}
+
+	return err
+}
+
+func (s *pgSink) write(ctx context.Context, wd *WeatherData) error {
+	if s.insert != nil {
+		return s.insert.exec(ctx, wd, s.pool)
+	}
+
+	table := s.tableFor(wd.Timestamp)
+	if s.partitions != nil {
+		if s.createPartitions {
+			if err := s.createPartition(ctx, table); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.merge {
+		return mergeMetrics(ctx, wd, s.columns, s.pool, table)
+	}
+	return sendMetrics(ctx, wd, s.columns, s.pool, table)
+}
+
+// remove deletes the stored reading wd, e.g. the one written by /selftest.
+func (s *pgSink) remove(ctx context.Context, wd *WeatherData) error {
+	table := s.tableFor(wd.Timestamp)
+	if _, err := s.pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE station = $1 AND time = $2", table),
+		wd.Station, timeBound(wd.Timestamp, s.timeStorage)); err != nil {
+		return fmt.Errorf("deleting from %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// tableFor returns the table storing the readings taken at t.
+func (s *pgSink) tableFor(t time.Time) string {
+	if s.partitions != nil {
+		return s.partitions.Name(t)
+	}
+	return s.table
+}
+
+// WriteBatch stores rows using COPY, with one COPY per partition when a
+// partition pattern is configured.
+func (s *pgSink) WriteBatch(ctx context.Context, rows []*WeatherData) error {
+	// the custom statement and the merge can't be turned into a COPY
+	if s.insert != nil || s.merge {
+		for _, wd := range rows {
+			if err := s.write(ctx, wd); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if s.partitions == nil {
+		return copyMetrics(ctx, rows, s.columns, s.pool, s.table)
+	}
+
+	var tables []string
+	byTable := make(map[string][]*WeatherData)
+	for _, wd := range rows {
+		table := s.partitions.Name(wd.Timestamp)
+		if _, ok := byTable[table]; !ok {
+			tables = append(tables, table)
+		}
+		byTable[table] = append(byTable[table], wd)
+	}
+
+	for _, table := range tables {
+		if s.createPartitions {
+			if err := s.createPartition(ctx, table); err != nil {
+				return err
+			}
+		}
+		if err := copyMetrics(ctx, byTable[table], s.columns, s.pool, table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createPartition creates the partition table, inheriting from the main table
+// so that the readings can still be queried from it, unless it was already
+// created by this process.
+func (s *pgSink) createPartition(ctx context.Context, table string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.created[table] {
+		return nil
+	}
+
+	if _, err := s.pool.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s () INHERITS (%s)", table, s.table)); err != nil {
+		return fmt.Errorf("creating partition %s: %w", table, err)
+	}
+	s.created[table] = true
+
+	return nil
+}
+
+// discardSink drops the readings; it ends the chain of the secondary sinks
+// written by a fanoutSink: StatsD, Graphite, Elasticsearch, Kafka and
+// remote-write.
+type discardSink struct{}
+
+func (discardSink) Write(context.Context, *WeatherData) error {
+	return nil
+}
+
+// defaultSinkTimeout bounds the writes to the secondary sinks of a fanoutSink
+// when sinks.timeout is not set.
+const defaultSinkTimeout = 10 * time.Second
+
+// namedSink is one of the sinks of a fanoutSink; the name is the one used by
+// sinks.primary and in the logs.
+type namedSink struct {
+	name string
+	sink MetricsSink
+}
+
+// fanoutSink writes each reading to all of its sinks, each in its own
+// goroutine. Only the error of the primary sink is returned, so that a slow or
+// failing secondary sink, e.g. an unreachable Elasticsearch cluster, doesn't
+// delay or fail the response to the station: the secondary writes carry on
+// after Write returns, bounded by timeout, and their errors are logged. Wait
+// waits for them when shutting down.
+type fanoutSink struct {
+	logger      *slog.Logger
+	primary     namedSink
+	secondaries []namedSink
+	timeout     time.Duration
+
+	pending sync.WaitGroup
+}
+
+func newFanoutSink(logger *slog.Logger, sinks []namedSink, conf config.SinksConfig) (*fanoutSink, error) {
+	primary := conf.Primary
+	if primary == "" {
+		primary = "postgres"
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultSinkTimeout
+	}
+
+	s := fanoutSink{logger: logger, timeout: timeout}
+	for _, ns := range sinks {
+		if ns.name == primary {
+			s.primary = ns
+		} else {
+			s.secondaries = append(s.secondaries, ns)
+		}
+	}
+	if s.primary.sink == nil {
+		return nil, fmt.Errorf("sinks.primary %q is not enabled", primary)
+	}
+
+	return &s, nil
+}
+
+func (s *fanoutSink) Write(ctx context.Context, wd *WeatherData) error {
+	// the secondary writes must not be cancelled when the request is over
+	detached := context.WithoutCancel(ctx)
+	for _, ns := range s.secondaries {
+		s.pending.Add(1)
+		go func() {
+			defer s.pending.Done()
+			ctx, cancel := context.WithTimeout(detached, s.timeout)
+			defer cancel()
+
+			if err := ns.sink.Write(ctx, wd); err != nil {
+				s.logger.Warn("error writing to secondary sink", "sink", ns.name, "station", wd.Station, "err", err)
+			}
+		}()
+	}
+
+	return s.primary.sink.Write(ctx, wd)
+}
+
+// Wait waits for the secondary writes in progress, at most for timeout, so
+// that the secondary sinks get them before being flushed.
+func (s *fanoutSink) Wait() {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.timeout):
+		s.logger.Warn("timed out waiting for the writes to the secondary sinks")
+	}
+}
+
+// errSinkBusy is returned when a sink can't accept more data right now; the
+// station should retry later.
+var errSinkBusy = errors.New("too many concurrent writes")
+
+// limitedSink limits the number of concurrent writes to the wrapped sink,
+// failing immediately with errSinkBusy instead of waiting for a free slot.
+type limitedSink struct {
+	next MetricsSink
+	sem  chan struct{}
+}
+
+func newLimitedSink(next MetricsSink, limit int) *limitedSink {
+	return &limitedSink{
+		next: next,
+		sem:  make(chan struct{}, limit),
+	}
+}
+
+func (s *limitedSink) Write(ctx context.Context, wd *WeatherData) error {
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		return errSinkBusy
+	}
+	defer func() { <-s.sem }()
+
+	return s.next.Write(ctx, wd)
+}
+
+// defaultQueueWorkers is the number of concurrent writes of a queuedSink when
+// max_inflight is not set.
+const defaultQueueWorkers = 4
+
+var queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecowitt_collector_queue_depth",
+	Help: "The number of readings waiting to be written to the database",
+})
+
+type queuedWrite struct {
+	ctx  context.Context
+	wd   *WeatherData
+	done chan error
+}
+
+// queuedSink writes to the wrapped sink from a fixed number of workers,
+// through a bounded queue; when the queue is full, writes fail immediately
+// with errSinkBusy instead of waiting for the database. The writes that were
+// queued wait for their turn, so the latency of a slow database is bounded by
+// the size of the queue.
+type queuedSink struct {
+	next    MetricsSink
+	workers int
+	queue   chan queuedWrite
+}
+
+func newQueuedSink(next MetricsSink, size, workers int) *queuedSink {
+	if workers <= 0 {
+		workers = defaultQueueWorkers
+	}
+	return &queuedSink{
+		next:    next,
+		workers: workers,
+		queue:   make(chan queuedWrite, size),
+	}
+}
+
+// Run runs the workers until ctx is cancelled, then writes the readings left
+// in the queue.
+func (s *queuedSink) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					s.drain()
+					return
+				case w := <-s.queue:
+					s.write(w)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *queuedSink) drain() {
+	for {
+		select {
+		case w := <-s.queue:
+			s.write(w)
+		default:
+			return
+		}
+	}
+}
+
+func (s *queuedSink) write(w queuedWrite) {
+	queueDepth.Set(float64(len(s.queue)))
+	// the station might have given up waiting
+	if err := w.ctx.Err(); err != nil {
+		w.done <- err
+		return
+	}
+	w.done <- s.next.Write(w.ctx, w.wd)
+}
+
+func (s *queuedSink) Write(ctx context.Context, wd *WeatherData) error {
+	w := queuedWrite{ctx: ctx, wd: wd, done: make(chan error, 1)}
+	select {
+	case s.queue <- w:
+		queueDepth.Set(float64(len(s.queue)))
+	default:
+		return errSinkBusy
+	}
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
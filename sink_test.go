@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// recordingSink is a MetricsSink that keeps the written data in memory; if err
+// is set, it is returned by Write and the data is not recorded.
+type recordingSink struct {
+	mu      sync.Mutex
+	written []*WeatherData
+	err     error
+}
+
+func (s *recordingSink) Write(_ context.Context, wd *WeatherData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.written = append(s.written, wd)
+	return nil
+}
+
+func (s *recordingSink) Written() []*WeatherData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*WeatherData(nil), s.written...)
+}
+
+func TestFanoutSink(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	primary := &recordingSink{}
+	hanging := &blockingSink{release: make(chan struct{})}
+	defer close(hanging.release)
+	failing := &recordingSink{err: errors.New("broker down")}
+
+	sink, err := newFanoutSink(logger, []namedSink{
+		{name: "postgres", sink: primary},
+		{name: "statsd", sink: hanging},
+		{name: "elasticsearch", sink: failing},
+	}, config.SinksConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sink.Write(context.Background(), &WeatherData{Station: "station"}) }()
+
+	// the hanging secondary sink doesn't delay the write to the primary one,
+	// and the error of the other secondary sink is not returned
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the write waited for the hanging secondary sink")
+	}
+	if len(primary.Written()) != 1 {
+		t.Errorf("expected 1 reading written to the primary sink, got %d", len(primary.Written()))
+	}
+
+	// only the error of the primary sink is returned
+	sink, err = newFanoutSink(logger, []namedSink{
+		{name: "postgres", sink: &recordingSink{}},
+		{name: "elasticsearch", sink: failing},
+	}, config.SinksConfig{Primary: "elasticsearch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), &WeatherData{Station: "station"}); err == nil {
+		t.Error("expected the error of the primary sink")
+	}
+
+	if _, err := newFanoutSink(logger, []namedSink{{name: "postgres", sink: primary}}, config.SinksConfig{Primary: "statsd"}); err == nil {
+		t.Error("expected an error when the primary sink is not enabled")
+	}
+}
+
+func TestFanoutSinkWait(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	secondary := &blockingSink{release: make(chan struct{})}
+
+	sink, err := newFanoutSink(logger, []namedSink{
+		{name: "postgres", sink: &recordingSink{}},
+		{name: "graphite", sink: secondary},
+	}, config.SinksConfig{Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), &WeatherData{Station: "station"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		sink.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("Wait returned before the secondary write")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(secondary.release)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after the secondary write")
+	}
+
+	// a hanging secondary sink only delays the shutdown up to the timeout
+	hanging := &blockingSink{release: make(chan struct{})}
+	defer close(hanging.release)
+	sink, err = newFanoutSink(logger, []namedSink{
+		{name: "postgres", sink: &recordingSink{}},
+		{name: "graphite", sink: hanging},
+	}, config.SinksConfig{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), &WeatherData{Station: "station"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	sink.Wait()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait took %s, expected about the 10ms timeout", elapsed)
+	}
+}
+
+// ctxSink is a MetricsSink whose writes block until their context is done,
+// sending the context error to errs.
+type ctxSink struct {
+	errs chan error
+}
+
+func (s *ctxSink) Write(ctx context.Context, wd *WeatherData) error {
+	<-ctx.Done()
+	s.errs <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestFanoutSinkTimeout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	secondary := &ctxSink{errs: make(chan error, 1)}
+
+	sink, err := newFanoutSink(logger, []namedSink{
+		{name: "postgres", sink: &recordingSink{}},
+		{name: "statsd", sink: secondary},
+	}, config.SinksConfig{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the secondary write outlives the request's context, up to the timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := sink.Write(ctx, &WeatherData{Station: "station"}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case err := <-secondary.errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the secondary write to time out, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the secondary write didn't time out")
+	}
+}
+
+func TestQueuedSinkShutdown(t *testing.T) {
+	next := &recordingSink{}
+	s := newQueuedSink(next, 2, 1)
+
+	// queued before the workers start, and written when they stop
+	errs := make(chan error)
+	go func() { errs <- s.Write(context.Background(), &WeatherData{Station: "a"}) }()
+	for len(s.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx)
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Written()) != 1 {
+		t.Errorf("expected the queued reading to be written, got %d", len(next.Written()))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// snapshotSink writes the latest reading of each station to a JSON file after
+// it's stored by the wrapped sink, so that a static web page can show the
+// current conditions without querying the database. The file is replaced
+// atomically, so readers never see a partial file; errors writing it are only
+// logged.
+type snapshotSink struct {
+	next   MetricsSink
+	logger *slog.Logger
+	path   string
+
+	mu     sync.Mutex
+	latest map[string]*WeatherData
+}
+
+func newSnapshotSink(logger *slog.Logger, next MetricsSink, path string) *snapshotSink {
+	return &snapshotSink{
+		next:   next,
+		logger: logger,
+		path:   path,
+		latest: make(map[string]*WeatherData),
+	}
+}
+
+func (s *snapshotSink) Write(ctx context.Context, wd *WeatherData) error {
+	if err := s.next.Write(ctx, wd); err != nil {
+		return err
+	}
+
+	if err := s.update(wd); err != nil {
+		s.logger.Error("error writing the snapshot file", "path", s.path, "err", err)
+	}
+
+	return nil
+}
+
+func (s *snapshotSink) update(wd *WeatherData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a retried report can be older than the reading in the file
+	if prev, ok := s.latest[wd.Station]; ok && wd.Timestamp.Before(prev.Timestamp) {
+		return nil
+	}
+	s.latest[wd.Station] = wd
+
+	return writeSnapshot(s.path, s.latest)
+}
+
+// writeSnapshot writes the columns of the readings in latest, keyed by
+// station, as a JSON object to path, replacing it atomically.
+func writeSnapshot(path string, latest map[string]*WeatherData) error {
+	snapshot := make(map[string]map[string]any, len(latest))
+	for station, wd := range latest {
+		names, values := wd.columnValues(weatherDataColumns)
+		reading := make(map[string]any, len(names))
+		for i, name := range names {
+			reading[name] = values[i]
+		}
+		snapshot[station] = reading
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// the temporary file must be on the same filesystem for the rename to
+	// be atomic
+	fh, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	// readable by the web server serving it
+	if err := fh.Chmod(0o644); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fh.Name(), path)
+}
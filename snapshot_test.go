@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSink(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "current.json")
+	sink := newSnapshotSink(logger, &recordingSink{}, path)
+
+	ts := time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC)
+	readings := []*WeatherData{
+		{Timestamp: ts, Station: "a", OutdoorTemperature: 19.9},
+		{Timestamp: ts, Station: "b", OutdoorTemperature: 12.5},
+		{Timestamp: ts.Add(time.Minute), Station: "a", OutdoorTemperature: 20.1},
+		// retried, older than the latest
+		{Timestamp: ts.Add(-time.Minute), Station: "a", OutdoorTemperature: 18.0},
+	}
+	for _, wd := range readings {
+		if err := sink.Write(context.Background(), wd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot map[string]map[string]any
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("invalid JSON %s: %s", data, err)
+	}
+
+	if len(snapshot) != 2 {
+		t.Fatalf("expected 2 stations, got %s", data)
+	}
+	if a := snapshot["a"]; a["temperature_outdoor"] != 20.1 || a["time"] != "2024-06-16T16:33:08Z" {
+		t.Errorf("expected the last reading of a, got %v", a)
+	}
+	if b := snapshot["b"]; b["temperature_outdoor"] != 12.5 {
+		t.Errorf("expected the last reading of b, got %v", b)
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the snapshot file, got %d files", len(entries))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// sunriseElevation is the elevation of the center of the sun, in degrees, at
+// sunrise and sunset: the upper limb touches the horizon, and the refraction
+// makes it visible while still below it.
+const sunriseElevation = -0.833
+
+// solarElevation returns the elevation of the sun above the horizon, in
+// degrees, at t from the given latitude and longitude (degrees, east
+// positive). It uses the low precision formulas of the Astronomical Almanac,
+// accurate to about a minute for sunrise and sunset, which is plenty to tell
+// the day from the night.
+func solarElevation(t time.Time, lat, lon float64) float64 {
+	const rad = math.Pi / 180
+
+	// days since J2000.0
+	n := float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5 - 2451545.0
+
+	meanLongitude := 280.460 + 0.9856474*n
+	meanAnomaly := (357.528 + 0.9856003*n) * rad
+	eclipticLongitude := (meanLongitude + 1.915*math.Sin(meanAnomaly) + 0.020*math.Sin(2*meanAnomaly)) * rad
+	obliquity := (23.439 - 0.0000004*n) * rad
+
+	declination := math.Asin(math.Sin(obliquity) * math.Sin(eclipticLongitude))
+	rightAscension := math.Atan2(math.Cos(obliquity)*math.Sin(eclipticLongitude), math.Cos(eclipticLongitude))
+
+	// the local sidereal time gives the hour angle of the sun
+	sidereal := (280.46061837 + 360.98564736629*n + lon) * rad
+	hourAngle := sidereal - rightAscension
+
+	sinElevation := math.Sin(lat*rad)*math.Sin(declination) +
+		math.Cos(lat*rad)*math.Cos(declination)*math.Cos(hourAngle)
+	return math.Asin(sinElevation) / rad
+}
+
+// isDaytime reports whether the sun is up at the given elevation, i.e.
+// between sunrise and sunset.
+func isDaytime(elevation float64) bool {
+	return elevation > sunriseElevation
+}
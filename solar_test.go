@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSolarElevation(t *testing.T) {
+	// sunrise and sunset on the 2024 June solstice, from the published tables
+	london := []float64{51.5074, -0.1278}   // 03:43 and 20:21 UTC
+	sydney := []float64{-33.8688, 151.2093} // 21:00 (the day before) and 06:54 UTC
+
+	tests := []struct {
+		name     string
+		location []float64
+		time     time.Time
+		daytime  bool
+	}{
+		{"london before sunrise", london, time.Date(2024, 6, 21, 3, 33, 0, 0, time.UTC), false},
+		{"london after sunrise", london, time.Date(2024, 6, 21, 3, 53, 0, 0, time.UTC), true},
+		{"london before sunset", london, time.Date(2024, 6, 21, 20, 11, 0, 0, time.UTC), true},
+		{"london after sunset", london, time.Date(2024, 6, 21, 20, 31, 0, 0, time.UTC), false},
+		{"sydney before sunrise", sydney, time.Date(2024, 6, 20, 20, 50, 0, 0, time.UTC), false},
+		{"sydney after sunrise", sydney, time.Date(2024, 6, 20, 21, 10, 0, 0, time.UTC), true},
+		{"sydney before sunset", sydney, time.Date(2024, 6, 21, 6, 44, 0, 0, time.UTC), true},
+		{"sydney after sunset", sydney, time.Date(2024, 6, 21, 7, 4, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elevation := solarElevation(tt.time, tt.location[0], tt.location[1])
+			if isDaytime(elevation) != tt.daytime {
+				t.Errorf("expected daytime %v, got elevation %.2f°", tt.daytime, elevation)
+			}
+		})
+	}
+
+	// at solar noon the sun is 90 - latitude + declination above the horizon
+	noon := solarElevation(time.Date(2024, 6, 21, 12, 2, 0, 0, time.UTC), london[0], london[1])
+	if want := 90 - london[0] + 23.44; math.Abs(noon-want) > 0.1 {
+		t.Errorf("expected the noon elevation to be %.2f°, got %.2f°", want, noon)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// defaultStationNameHeader is the header carrying the station name, when
+// taken from the requests.
+const defaultStationNameHeader = "X-Station-Name"
+
+// stationNameTTL is how long the reverse DNS lookups are cached, including the
+// failed ones.
+const stationNameTTL = time.Hour
+
+type stationNameKey struct{}
+
+// stationNameFromContext returns the station name resolved from the request ctx
+// belongs to, if any.
+func stationNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(stationNameKey{}).(string)
+	return name
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+// stationNameResolver resolves the name of the station sending a request, from
+// a header set by a proxy or from the reverse DNS lookup of the client IP.
+type stationNameResolver struct {
+	source     string
+	header     string
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	clock      Clock
+
+	mu    sync.Mutex
+	cache *lruMap[cachedName] // keyed by IP address
+}
+
+func newStationNameResolver(conf config.StationNameConfig, clock Clock) *stationNameResolver {
+	header := conf.Header
+	if header == "" {
+		header = defaultStationNameHeader
+	}
+
+	return &stationNameResolver{
+		source:     conf.Source,
+		header:     header,
+		lookupAddr: net.DefaultResolver.LookupAddr,
+		clock:      clock,
+		cache:      newLRUMap[cachedName](defaultMaxTrackedStations),
+	}
+}
+
+// Resolve returns the name of the station sending r, or an empty string if
+// it's not available.
+func (s *stationNameResolver) Resolve(r *http.Request) string {
+	switch s.source {
+	case "header":
+		return strings.TrimSpace(r.Header.Get(s.header))
+	case "dns":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return ""
+		}
+		return s.reverse(r.Context(), host)
+	default:
+		return ""
+	}
+}
+
+func (s *stationNameResolver) reverse(ctx context.Context, ip string) string {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	cached, ok := s.cache.Get(ip)
+	s.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.name
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var name string
+	if names, err := s.lookupAddr(ctx, ip); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	s.mu.Lock()
+	s.cache.Put(ip, cachedName{name: name, expires: now.Add(stationNameTTL)})
+	s.mu.Unlock()
+
+	return name
+}
+
+// Middleware stores the name of the station sending the request in the request
+// context.
+func (s *stationNameResolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := s.Resolve(r); name != "" {
+			r = r.WithContext(context.WithValue(r.Context(), stationNameKey{}, name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestStationNameResolver(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 6, 16, 16, 32, 10, 0, time.UTC))
+
+	req := httptest.NewRequest(http.MethodPost, "/data/report/", nil)
+	req.RemoteAddr = "192.168.1.20:51234"
+	req.Header.Set("X-Station-Name", "garden")
+
+	header := newStationNameResolver(config.StationNameConfig{Source: "header"}, clock)
+	if got := header.Resolve(req); got != "garden" {
+		t.Errorf("expected the name from the header, got %q", got)
+	}
+
+	var lookups int
+	dns := newStationNameResolver(config.StationNameConfig{Source: "dns"}, clock)
+	dns.lookupAddr = func(_ context.Context, addr string) ([]string, error) {
+		lookups++
+		if addr != "192.168.1.20" {
+			return nil, errors.New("not found")
+		}
+		return []string{"ws2910.home.lan."}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := dns.Resolve(req); got != "ws2910.home.lan" {
+			t.Errorf("expected the name from the reverse lookup, got %q", got)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected the lookup to be cached, got %d lookups", lookups)
+	}
+
+	clock.Advance(stationNameTTL + time.Second)
+	dns.Resolve(req)
+	if lookups != 2 {
+		t.Errorf("expected the cached name to expire, got %d lookups", lookups)
+	}
+}
+
+func TestIngestStationName(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	station := form.Get("stationtype")
+
+	tests := []struct {
+		name     string
+		stations map[string]config.StationConfig
+		resolved string
+		want     string
+	}{
+		{"resolved", map[string]config.StationConfig{station: {Name: "configured"}}, "garden", "garden"},
+		{"configured", map[string]config.StationConfig{station: {Name: "configured"}}, "", "configured"},
+		{"station", nil, "", station},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.Config{Stations: tt.stations, StationName: config.StationNameConfig{Source: "header"}}
+			in := newTestIngester(t, conf, &recordingSink{})
+
+			ctx := context.Background()
+			if tt.resolved != "" {
+				ctx = context.WithValue(ctx, stationNameKey{}, tt.resolved)
+			}
+
+			wd, err := in.Ingest(ctx, form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wd.StationName == nil || *wd.StationName != tt.want {
+				t.Errorf("expected station name %q, got %v", tt.want, wd.StationName)
+			}
+		})
+	}
+}
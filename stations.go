@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// defaultInterval is the reporting interval assumed for stations that haven't
+// told us theirs.
+const defaultInterval = 60 * time.Second
+
+type stationState struct {
+	LastSeen    time.Time
+	Interval    time.Duration
+	Offline     bool
+	LastReading *WeatherData
+	LastError   *stationError
+}
+
+// stationError is the last error of the ingest pipeline for a station.
+type stationError struct {
+	Time time.Time `json:"time"`
+
+	// Kind is the stage that failed, as in ingestError
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// maxErrorLength is the maximum length, in characters, of the error messages
+// kept for each station.
+const maxErrorLength = 256
+
+// The parts of the error messages that could reveal credentials or the layout
+// of the network, e.g. in the connection errors of the database driver:
+// key=value parameters, the user info of the URLs and the IP addresses.
+var (
+	errorParamRe    = regexp.MustCompile("(?i)\\b(user|password|passkey|host|hostaddr|database|dbname)=[^\\s`'\"&]+")
+	errorUserInfoRe = regexp.MustCompile(`://[^/@\s]+@`)
+	errorAddressRe  = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b|\[[0-9a-fA-F:]+\](:\d+)?`)
+)
+
+// redactError returns the message of err without the sensitive details, and
+// truncated to maxErrorLength, to be exposed by the read API.
+func redactError(err error) string {
+	msg := errorParamRe.ReplaceAllString(err.Error(), "$1=REDACTED")
+	msg = errorUserInfoRe.ReplaceAllString(msg, "://REDACTED@")
+	msg = errorAddressRe.ReplaceAllString(msg, "REDACTED")
+
+	if runes := []rune(msg); len(runes) > maxErrorLength {
+		msg = string(runes[:maxErrorLength])
+	}
+	return msg
+}
+
+// stationStatus is the JSON representation of a known station.
+type stationStatus struct {
+	Station     string          `json:"station"`
+	Name        string          `json:"name,omitempty"`
+	Model       string          `json:"model"`
+	StationType string          `json:"station_type"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Interval    int             `json:"interval_seconds"`
+	Online      bool            `json:"online"`
+	LastReading *readingSummary `json:"last_reading,omitempty"`
+
+	// only set when http.api_last_error is enabled
+	LastError *stationError `json:"last_error,omitempty"`
+}
+
+// readingSummary is a short summary of a station's last reading.
+type readingSummary struct {
+	Time               time.Time `json:"time"`
+	OutdoorTemperature float64   `json:"temperature_outdoor"`
+	OutdoorHumidity    *int      `json:"humidity_outdoor"`
+	RelativePressure   float64   `json:"pressure_relative"`
+	WindSpeed          float64   `json:"wind_speed"`
+	WindGust           float64   `json:"wind_gust"`
+	WindDirection      *int      `json:"wind_direction"`
+	RainRate           float64   `json:"rain_rate"`
+	DailyRain          float64   `json:"daily_rain"`
+	Battery            float64   `json:"battery"`
+	Runtime            string    `json:"runtime"`
+
+	// only set when http.api_units is enabled
+	Units map[string]string `json:"units,omitempty"`
+}
+
+// stationList is the response of the /stations endpoint.
+type stationList []stationStatus
+
+func (l stationList) CSV() ([]string, [][]string) {
+	header := []string{
+		"station", "name", "model", "station_type", "last_seen", "interval_seconds", "online",
+		"time", "temperature_outdoor", "humidity_outdoor", "pressure_relative", "wind_speed", "wind_gust",
+		"wind_direction", "rain_rate", "daily_rain", "battery", "runtime",
+	}
+
+	rows := make([][]string, 0, len(l))
+	for _, s := range l {
+		row := []string{
+			s.Station, s.Name, s.Model, s.StationType, s.LastSeen.Format(time.RFC3339),
+			strconv.Itoa(s.Interval), strconv.FormatBool(s.Online),
+		}
+		if r := s.LastReading; r != nil {
+			row = append(row,
+				r.Time.Format(time.RFC3339),
+				strconv.FormatFloat(r.OutdoorTemperature, 'f', -1, 64),
+				optionalItoa(r.OutdoorHumidity),
+				strconv.FormatFloat(r.RelativePressure, 'f', -1, 64),
+				strconv.FormatFloat(r.WindSpeed, 'f', -1, 64),
+				strconv.FormatFloat(r.WindGust, 'f', -1, 64),
+				optionalItoa(r.WindDirection),
+				strconv.FormatFloat(r.RainRate, 'f', -1, 64),
+				strconv.FormatFloat(r.DailyRain, 'f', -1, 64),
+				strconv.FormatFloat(r.Battery, 'f', -1, 64),
+				r.Runtime,
+			)
+		} else {
+			row = append(row, make([]string, len(header)-len(row))...)
+		}
+		rows = append(rows, row)
+	}
+
+	return header, rows
+}
+
+// optionalItoa formats i, or returns an empty string when nil.
+func optionalItoa(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+// stationTracker keeps track of the known stations and of when they last reported.
+type stationTracker struct {
+	names map[string]string
+
+	mu       sync.Mutex
+	stations *lruMap[*stationState]
+}
+
+// newStationTracker returns a tracker for at most maxStations stations, or
+// defaultMaxTrackedStations if zero; the least recently seen are forgotten.
+func newStationTracker(conf map[string]config.StationConfig, maxStations int) *stationTracker {
+	names := make(map[string]string, len(conf))
+	for station, sc := range conf {
+		names[station] = sc.Name
+	}
+
+	return &stationTracker{
+		names:    names,
+		stations: newLRUMap[*stationState](maxStations),
+	}
+}
+
+// Seen records that the station sending wd reported at the given time; it
+// returns true if the station was previously considered offline.
+func (t *stationTracker) Seen(wd *WeatherData, at time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.stations.Get(wd.Station)
+	if !ok {
+		s = &stationState{}
+		t.stations.Put(wd.Station, s)
+	}
+
+	// the reading is copied, as the derivations and the conversions that
+	// follow change it while the read API uses the last one
+	reading := *wd
+
+	wasOffline := s.Offline
+	s.LastSeen = at
+	s.Offline = false
+	s.LastReading = &reading
+	if wd.Interval > 0 {
+		s.Interval = wd.Interval
+	}
+
+	return wasOffline
+}
+
+// Failed records err as the last error of station, when the station is
+// known: the reports that can't be decoded could come from anyone.
+func (t *stationTracker) Failed(station string, at time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.stations.Get(station)
+	if !ok {
+		return
+	}
+
+	var (
+		kind string
+		ie   *ingestError
+	)
+	if errors.As(err, &ie) {
+		kind, err = ie.Kind, ie.Err
+	}
+	s.LastError = &stationError{Time: at, Kind: kind, Message: redactError(err)}
+}
+
+// Stale marks as offline, and returns, the stations which haven't reported in
+// the last `intervals` reporting intervals. Stations already marked as offline
+// are not returned again.
+func (t *stationTracker) Stale(now time.Time, intervals int) []stationStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var result []stationStatus
+	for name, s := range t.stations.All() {
+		if s.Offline {
+			continue
+		}
+
+		interval := s.Interval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+
+		if now.Sub(s.LastSeen) > time.Duration(intervals)*interval {
+			s.Offline = true
+			result = append(result, t.status(name, s))
+		}
+	}
+
+	return result
+}
+
+// List returns the status of all the known stations, sorted by name.
+func (t *stationTracker) List() stationList {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(stationList, 0, t.stations.Len())
+	for name, s := range t.stations.All() {
+		result = append(result, t.status(name, s))
+	}
+
+	slices.SortFunc(result, func(a, b stationStatus) int {
+		return strings.Compare(a.Station, b.Station)
+	})
+
+	return result
+}
+
+// Name returns the configured name of the station, if any.
+func (t *stationTracker) Name(station string) string {
+	return t.names[station]
+}
+
+func (t *stationTracker) status(name string, s *stationState) stationStatus {
+	status := stationStatus{
+		Station:  name,
+		Name:     t.names[name],
+		LastSeen: s.LastSeen,
+		Interval: int(s.Interval.Seconds()),
+		Online:   !s.Offline,
+	}
+	if e := s.LastError; e != nil {
+		lastError := *e
+		status.LastError = &lastError
+	}
+
+	if wd := s.LastReading; wd != nil {
+		status.Model = wd.Model
+		status.StationType = wd.StationType
+		status.LastReading = &readingSummary{
+			Time:               wd.Timestamp,
+			OutdoorTemperature: wd.OutdoorTemperature,
+			OutdoorHumidity:    wd.OutdoorHumidity,
+			RelativePressure:   wd.RelativePressure,
+			WindSpeed:          wd.WindSpeed,
+			WindGust:           wd.WindGust,
+			WindDirection:      wd.WindDirection,
+			RainRate:           wd.RainRate,
+			DailyRain:          wd.DailyRain,
+			Battery:            wd.BatteryLevel,
+			Runtime:            wd.RuntimeDuration().String(),
+		}
+	}
+
+	return status
+}
+
+// knownStationsWindow is how far back Load looks for the stations already
+// present in the database; the ones that didn't report for longer are not
+// worth tracking, and the bound spares a scan of the whole table.
+const knownStationsWindow = 7 * 24 * time.Hour
+
+// knownStationsQuery returns the query reading the last reading of each
+// station stored after since. With received_at stored, the readings received
+// before since are also excluded, so that a station whose clock is ahead isn't
+// kept forever.
+func knownStationsQuery(conf config.DatabaseConfig, since time.Time) (string, []any) {
+	// the readings of /selftest are deleted once written, but one may be
+	// left behind when the deletion fails
+	where := "time > $1 AND station <> $2"
+	args := []any{timeBound(since, conf.TimeStorage), selftestStation}
+	if conf.StoreReceivedAt {
+		where += " AND (received_at IS NULL OR received_at > $3)"
+		args = append(args, since)
+	}
+
+	c := func(name string) string { return columnExpr(conf, name) }
+	return fmt.Sprintf(
+		`SELECT DISTINCT ON (station) station, %s, coalesce(%s, 0), coalesce(%s, ''),
+		coalesce(%s, ''), coalesce(%s, 0), %s,
+		coalesce(%s, 0), coalesce(%s, 0), coalesce(%s, 0),
+		%s, coalesce(%s, 0), coalesce(%s, 0), coalesce(%s, 0),
+		coalesce(%s, 0)
+		FROM %s WHERE %s ORDER BY station, time DESC`,
+		c("time"), c("interval"), c("model"),
+		c("station_type"), c("temperature_outdoor"), c("humidity_outdoor"),
+		c("pressure_relative"), c("wind_speed"), c("wind_gust"),
+		c("wind_direction"), c("rain_rate"), c("daily_rain"), c("battery"),
+		c("runtime"),
+		conf.Table, where), args
+}
+
+// Load populates the tracker with the stations that reported to the database
+// in the last knownStationsWindow before now, so that stations which don't
+// report after a restart are still noticed.
+func (t *stationTracker) Load(ctx context.Context, pool *pgxpool.Pool, conf config.DatabaseConfig, now time.Time) error {
+	query, args := knownStationsQuery(conf, now.Add(-knownStationsWindow))
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("querying known stations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			wd       WeatherData
+			interval int
+		)
+		if err := rows.Scan(&wd.Station, &wd.Timestamp, &interval, &wd.Model, &wd.StationType,
+			&wd.OutdoorTemperature, &wd.OutdoorHumidity, &wd.RelativePressure, &wd.WindSpeed,
+			&wd.WindGust, &wd.WindDirection, &wd.RainRate, &wd.DailyRain, &wd.BatteryLevel, &wd.Runtime); err != nil {
+			return fmt.Errorf("reading known stations: %w", err)
+		}
+
+		wd.Interval = time.Duration(interval) * time.Second
+		// the tracker keeps the rain in mm, like the readings it's sent
+		if conf.RainUnit == "in" {
+			wd.RainRate *= millimetersPerInch
+			wd.DailyRain *= millimetersPerInch
+		}
+		t.Seen(&wd, wd.Timestamp)
+	}
+
+	return rows.Err()
+}
+
+// watchStaleness periodically checks for stations that stopped reporting and
+// notifies the configured webhook, if any.
+func watchStaleness(ctx context.Context, logger *slog.Logger, tracker *stationTracker, clock Clock, conf config.StalenessConfig) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, s := range tracker.Stale(clock.Now(), conf.Intervals) {
+				logger.Warn("station is offline", "station", s.Station, "last_seen", s.LastSeen)
+				if conf.WebhookURL == "" {
+					continue
+				}
+
+				event := webhookEvent{Event: "station_offline", Station: s.Station, LastSeen: s.LastSeen}
+				if err := sendWebhook(ctx, conf.WebhookURL, event); err != nil {
+					logger.Error("error sending webhook", "station", s.Station, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// makeStationsHandler returns the handler of the stations API; the rain is
+// returned in rainUnit, like it's stored, while the tracker keeps it in mm.
+func makeStationsHandler(tracker *stationTracker, rainUnit string, units, lastError bool) http.Handler {
+	readingUnits := withRainUnit(readingUnits, rainUnit)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := tracker.List()
+		for i, s := range list {
+			if s.LastReading != nil && rainUnit == "in" {
+				s.LastReading.RainRate /= millimetersPerInch
+				s.LastReading.DailyRain /= millimetersPerInch
+			}
+			if units && s.LastReading != nil {
+				s.LastReading.Units = readingUnits
+			}
+			if !lastError {
+				list[i].LastError = nil
+			}
+		}
+		writeAPIResponse(w, r, slog.Default(), list)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// statsdMaxPacket keeps the packets within the usual network MTU.
+const statsdMaxPacket = 1432
+
+// statsdSink sends the numeric values of each reading as StatsD gauges, with
+// DogStatsD tags, before writing it to the wrapped sink. Sending is best
+// effort: errors are ignored, so that a StatsD outage doesn't affect the
+// storage of the data.
+type statsdSink struct {
+	next   MetricsSink
+	conn   net.Conn
+	prefix string
+	tags   []string
+}
+
+func newStatsdSink(next MetricsSink, conf config.StatsDConfig) (*statsdSink, error) {
+	// UDP "connections" don't block and don't fail when nobody is listening
+	conn, err := net.Dial("udp", conf.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdSink{
+		next:   next,
+		conn:   conn,
+		prefix: conf.Prefix,
+		tags:   conf.Tags,
+	}, nil
+}
+
+func (s *statsdSink) Write(ctx context.Context, wd *WeatherData) error {
+	for _, packet := range s.packets(wd) {
+		_, _ = s.conn.Write(packet)
+	}
+
+	return s.next.Write(ctx, wd)
+}
+
+// packets formats the gauges for wd, split in packets of at most
+// statsdMaxPacket bytes.
+func (s *statsdSink) packets(wd *WeatherData) [][]byte {
+	tags := "|#" + strings.Join(append([]string{"station:" + wd.Station}, s.tags...), ",")
+
+	var (
+		packets [][]byte
+		buf     bytes.Buffer
+	)
+	names, values := wd.columnValues(weatherDataColumns)
+	for i, name := range names {
+		value, ok := statsdValue(values[i])
+		if !ok {
+			continue
+		}
+
+		line := s.prefix + name + ":" + value + "|g" + tags
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			packets = append(packets, bytes.Clone(buf.Bytes()))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+
+	return packets
+}
+
+// statsdValue formats v as a gauge value, if it's a number.
+func statsdValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case *float64:
+		if v == nil {
+			return "", false
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case *int:
+		if v == nil {
+			return "", false
+		}
+		return strconv.Itoa(*v), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestStatsdSink(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	next := &recordingSink{}
+	sink, err := newStatsdSink(next, config.StatsDConfig{
+		Address: server.LocalAddr().String(),
+		Prefix:  "weather.",
+		Tags:    []string{"env:test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := WeatherData{Station: "station", Timestamp: time.Now(), OutdoorTemperature: 19.9, OutdoorHumidity: ptr(47)}
+	if err := sink.Write(context.Background(), &wd); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Written()) != 1 {
+		t.Error("expected the reading to be written to the wrapped sink")
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, statsdMaxPacket)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	for _, want := range []string{
+		"weather.temperature_outdoor:19.9|g|#station:station,env:test",
+		"weather.humidity_outdoor:47|g|#station:station,env:test",
+	} {
+		found := false
+		for _, line := range lines {
+			if line == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %q in %q", want, lines)
+		}
+	}
+
+	// the timestamp, strings and missing values are not sent
+	for _, line := range lines {
+		if strings.HasPrefix(line, "weather.time:") || strings.HasPrefix(line, "weather.model:") || strings.HasPrefix(line, "weather.uv:") {
+			t.Errorf("unexpected gauge %q", line)
+		}
+	}
+}
+
+func TestStatsdSinkPacketSize(t *testing.T) {
+	s := &statsdSink{prefix: strings.Repeat("p", 100) + ".", tags: []string{"env:test"}}
+	packets := s.packets(&WeatherData{Station: "station"})
+	if len(packets) < 2 {
+		t.Fatalf("expected the gauges to be split in multiple packets, got %d", len(packets))
+	}
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket {
+			t.Errorf("packet of %d bytes exceeds the limit", len(packet))
+		}
+	}
+}
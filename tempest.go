@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tempestPacket is a JSON packet broadcast on the LAN by a WeatherFlow Tempest
+// hub; see https://weatherflow.github.io/Tempest/api/udp/v171/
+type tempestPacket struct {
+	SerialNumber     string       `json:"serial_number"`
+	Type             string       `json:"type"`
+	HubSN            string       `json:"hub_sn"`
+	Obs              [][]*float64 `json:"obs"`
+	FirmwareRevision int          `json:"firmware_revision"`
+}
+
+// The indexes of the values in a Tempest observation ("obs_st").
+const (
+	tempestTime = iota
+	tempestWindLull
+	tempestWindAvg
+	tempestWindGust
+	tempestWindDirection
+	tempestWindSampleInterval
+	tempestPressure
+	tempestTemperature
+	tempestHumidity
+	tempestIlluminance
+	tempestUV
+	tempestSolarRadiation
+	tempestRainMinute
+	tempestPrecipitationType
+	tempestLightningDistance
+	tempestLightningCount
+	tempestBattery
+	tempestReportInterval
+
+	tempestObsLen
+)
+
+// tempestColumns maps the values of a Tempest observation to the columns of
+// reportedColumns storing them.
+var tempestColumns = map[int]string{
+	tempestWindAvg:        "wind_speed",
+	tempestWindGust:       "wind_gust",
+	tempestPressure:       "pressure_absolute",
+	tempestTemperature:    "temperature_outdoor",
+	tempestSolarRadiation: "solar_radiation",
+	tempestRainMinute:     "rain_rate",
+	tempestReportInterval: "interval",
+}
+
+// tempestUnreported returns the columns of reportedColumns missing from obs:
+// the ones the Tempest doesn't report, like the relative pressure, the indoor
+// values and the rain totals, and the ones whose value is null. The battery
+// column is always unreported, as it holds the volts of the Tempest rather
+// than the status of the Ecowitt sensors.
+func tempestUnreported(obs []*float64) map[string]bool {
+	unreported := make(map[string]bool)
+	for _, column := range reportedColumns {
+		unreported[column] = true
+	}
+	delete(unreported, "model")
+	delete(unreported, "station_type")
+
+	for i, column := range tempestColumns {
+		if obs[i] != nil {
+			delete(unreported, column)
+		}
+	}
+
+	return unreported
+}
+
+// tempestWeatherData converts a Tempest observation to WeatherData; the values
+// are already in metric units. The columns the Tempest doesn't report, or
+// whose value is missing from obs, are marked as unreported.
+func tempestWeatherData(pkt *tempestPacket, obs []*float64) (*WeatherData, error) {
+	if len(obs) < tempestObsLen {
+		return nil, fmt.Errorf("observation has %d values, expected %d", len(obs), tempestObsLen)
+	}
+	if obs[tempestTime] == nil {
+		return nil, errors.New("observation has no time")
+	}
+
+	value := func(i int) float64 {
+		if obs[i] == nil {
+			return 0
+		}
+		return *obs[i]
+	}
+	// intValue returns the rounded value i, or nil when missing
+	intValue := func(i int) *int {
+		if obs[i] == nil {
+			return nil
+		}
+		v := int(math.Round(*obs[i]))
+		return &v
+	}
+
+	wd := WeatherData{
+		Passkey:            pkt.SerialNumber,
+		Station:            pkt.SerialNumber,
+		Timestamp:          time.Unix(int64(value(tempestTime)), 0).UTC(),
+		StationType:        fmt.Sprintf("WeatherFlow_Tempest_%d", pkt.FirmwareRevision),
+		Model:              "Tempest",
+		AbsolutePressure:   value(tempestPressure),
+		OutdoorTemperature: value(tempestTemperature),
+		OutdoorHumidity:    intValue(tempestHumidity),
+		SolarRadiation:     value(tempestSolarRadiation),
+		RainRate:           value(tempestRainMinute) * 60,
+		WindSpeed:          value(tempestWindAvg),
+		WindGust:           value(tempestWindGust),
+		WindDirection:      intValue(tempestWindDirection),
+		BatteryLevel:       value(tempestBattery), // volts
+		Interval:           time.Duration(value(tempestReportInterval)) * time.Minute,
+		unreported:         tempestUnreported(obs),
+	}
+	if obs[tempestUV] != nil {
+		uv := *obs[tempestUV]
+		wd.UV = &uv
+	}
+
+	return &wd, nil
+}
+
+// IngestTempest runs a Tempest UDP packet through the ingest pipeline, returning
+// the stored WeatherData; packets other than observations are ignored, and so
+// are the observations dropped by min_store_interval.
+func (in *ingester) IngestTempest(ctx context.Context, packet []byte) ([]*WeatherData, error) {
+	logger := in.logger
+	now := in.clock.Now()
+	ctx = withIngestSource(ctx, sourceTempest)
+
+	var pkt tempestPacket
+	if err := json.Unmarshal(packet, &pkt); err != nil {
+		return nil, &ingestError{Kind: "decoder", Err: err}
+	}
+	if pkt.Type != "obs_st" {
+		return nil, nil
+	}
+
+	var stored []*WeatherData
+	for _, obs := range pkt.Obs {
+		wd, err := tempestWeatherData(&pkt, obs)
+		if err != nil {
+			return stored, &ingestError{Kind: "converter", Err: err}
+		}
+		wd.Calibrate(in.calibration)
+
+		if err := in.store(ctx, logger, wd, now, ""); err != nil {
+			if errors.Is(err, errThrottled) {
+				logger.Debug("dropped weather data received before min_store_interval", "station", wd.Station, "time", wd.Timestamp)
+				continue
+			}
+			return stored, err
+		}
+		stored = append(stored, wd)
+	}
+
+	return stored, nil
+}
+
+// serveTempest reads the packets broadcast by the Tempest hubs from conn until
+// ctx is done.
+func serveTempest(ctx context.Context, logger *slog.Logger, conn net.PacketConn, in *ingester) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("error reading UDP packet", "err", err)
+			}
+			return
+		}
+
+		stored, err := in.IngestTempest(ctx, buf[:n])
+		if err != nil {
+			var ie *ingestError
+			if errors.As(err, &ie) {
+				reqErrors.With(prometheus.Labels{"error_type": ie.Kind}).Inc()
+			}
+			logger.Error("error ingesting Tempest packet", "client", addr, "err", err)
+			continue
+		}
+
+		for _, wd := range stored {
+			logger.Debug("stored weather data", "station", wd.Station, "time", wd.Timestamp)
+			reqProcessed.Inc()
+		}
+	}
+}
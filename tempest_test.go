@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// from the WeatherFlow UDP API documentation
+const tempestSamplePacket = `{"serial_number":"ST-00000512","type":"obs_st","hub_sn":"HB-00013030","obs":[[1588948614,0.18,0.22,0.27,144,6,1017.57,22.37,50.26,328,0.03,3,0.000000,0,0,0,2.410,1]],"firmware_revision":129}`
+
+func TestIngestTempest(t *testing.T) {
+	sink := &recordingSink{}
+	in := newTestIngester(t, config.Config{}, sink)
+
+	stored, err := in.IngestTempest(context.Background(), []byte(tempestSamplePacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || len(sink.Written()) != 1 {
+		t.Fatalf("expected 1 stored reading, got %d", len(stored))
+	}
+
+	wd := stored[0]
+	if wd.Station != "ST-00000512" || !wd.Timestamp.Equal(time.Unix(1588948614, 0)) {
+		t.Errorf("unexpected station or time: %s %s", wd.Station, wd.Timestamp)
+	}
+	if wd.OutdoorTemperature != 22.37 || *wd.OutdoorHumidity != 50 || wd.AbsolutePressure != 1017.57 {
+		t.Errorf("unexpected temperature, humidity or pressure: %v %v %v",
+			wd.OutdoorTemperature, *wd.OutdoorHumidity, wd.AbsolutePressure)
+	}
+	if wd.WindSpeed != 0.22 || wd.WindGust != 0.27 || *wd.WindDirection != 144 {
+		t.Errorf("unexpected wind: %v %v %v", wd.WindSpeed, wd.WindGust, *wd.WindDirection)
+	}
+	if wd.UV == nil || *wd.UV != 0.03 || wd.SolarRadiation != 3 {
+		t.Errorf("unexpected UV or solar radiation: %v %v", wd.UV, wd.SolarRadiation)
+	}
+	if wd.Interval != time.Minute {
+		t.Errorf("expected a 1m interval, got %s", wd.Interval)
+	}
+}
+
+func TestIngestTempestErrors(t *testing.T) {
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+
+	stored, err := in.IngestTempest(context.Background(), []byte(`{"serial_number":"ST-00000512","type":"rapid_wind","ob":[1493322445,2.3,128]}`))
+	if err != nil || len(stored) != 0 {
+		t.Errorf("expected rapid_wind packets to be ignored, got %v %v", stored, err)
+	}
+
+	for _, packet := range []string{
+		`not json`,
+		`{"serial_number":"ST-00000512","type":"obs_st","obs":[[1588948614,0.18]]}`,
+	} {
+		if _, err := in.IngestTempest(context.Background(), []byte(packet)); err == nil {
+			t.Errorf("expected an error for %s", packet)
+		}
+	}
+}
+
+func TestServeTempest(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	in := newTestIngester(t, config.Config{}, sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveTempest(ctx, in.logger, conn, in)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte(tempestSamplePacket)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.Written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the packet wasn't stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIngestTempestDerivations(t *testing.T) {
+	conf := config.Config{
+		Database:           config.DatabaseConfig{Merge: true},
+		Pressure:           config.PressureConfig{Tendency: true},
+		Forecast:           config.ForecastConfig{Enabled: true},
+		RainReconciliation: config.RainReconciliationConfig{Enabled: true},
+		Battery:            config.BatteryConfig{StatusText: true},
+		DegreeDays:         config.DegreeDaysConfig{Enabled: true},
+	}
+	in := newTestIngester(t, conf, &recordingSink{})
+
+	// two observations three hours apart, the second without the temperature
+	var stored []*WeatherData
+	for _, packet := range []string{
+		tempestSamplePacket,
+		`{"serial_number":"ST-00000512","type":"obs_st","obs":[[1588959414,0.18,0.22,0.27,144,6,1010.57,null,50.26,328,0.03,3,0.000000,0,0,0,2.410,1]],"firmware_revision":129}`,
+	} {
+		wd, err := in.IngestTempest(context.Background(), []byte(packet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, wd...)
+	}
+
+	// the Tempest doesn't report the relative pressure, the rain totals nor
+	// the battery status of the Ecowitt sensors
+	for _, wd := range stored {
+		if wd.PressureTendency != nil || wd.Forecast != nil {
+			t.Errorf("expected no tendency nor forecast without the relative pressure, got %v %v", wd.PressureTendency, wd.Forecast)
+		}
+		if wd.DailyRainMismatch != nil {
+			t.Errorf("expected no rain reconciliation without the rain totals, got %v", *wd.DailyRainMismatch)
+		}
+		if wd.BatteryStatus != nil {
+			t.Errorf("expected no battery status from the volts, got %q", *wd.BatteryStatus)
+		}
+	}
+	if stored[0].HeatingDegreeDays == nil || stored[1].HeatingDegreeDays != nil {
+		t.Errorf("expected the degree days only with the temperature, got %v %v", stored[0].HeatingDegreeDays, stored[1].HeatingDegreeDays)
+	}
+
+	db := &recordingExecer{}
+	if err := mergeMetrics(context.Background(), stored[1], weatherDataColumns, db, "weather"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pressure_relative", "temperature_outdoor", "temperature_indoor", "daily_rain", "battery"} {
+		if strings.Contains(db.sql[0], name+",") || strings.Contains(db.sql[0], name+")") {
+			t.Errorf("expected the unreported %s column not to be stored, got %q", name, db.sql[0])
+		}
+	}
+}
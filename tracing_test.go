@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+	handler := withTracing("POST /data/report/", makeHandler(in.logger, in, config.HTTPConfig{}))
+
+	req := httptest.NewRequest(http.MethodPost, "/data/report/", strings.NewReader(sampleQuery))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	if want := []string{"parse", "decode", "convert", "write", "POST /data/report/"}; !slices.Equal(names, want) {
+		t.Fatalf("expected spans %v, got %v", want, names)
+	}
+
+	root := spans[len(spans)-1]
+	if got := root.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace of the client, got %s", got)
+	}
+	for _, span := range spans[:len(spans)-1] {
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("expected span %s to be a child of the request's span", span.Name())
+		}
+	}
+}
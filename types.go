@@ -1,18 +1,32 @@
 package main
 
 import (
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/bcicen/go-units"
+	"github.com/piger/ecowitt-collector/internal/config"
 )
 
 var (
 	MilesPerHour    = units.NewUnit("MilesPerHour", "mph")
 	MetersPerSecond = units.NewUnit("MetersPerSecond", "ms")
+
+	InchesPerHour      = units.NewUnit("InchesPerHour", "in/h")
+	MillimetersPerHour = units.NewUnit("MillimetersPerHour", "mm/h")
 )
 
+// hectopascalsPerKilopascal converts the VPD sent by the stations to hPa.
+const hectopascalsPerKilopascal = 10
+
+// millimetersPerInch converts the rain amounts, and inchesPerHour to
+// millimetersPerHour the rain rates.
+const millimetersPerInch = 25.4
+
 func init() {
 	units.NewRatioConversion(MilesPerHour, MetersPerSecond, 0.44704)
+	units.NewRatioConversion(InchesPerHour, MillimetersPerHour, millimetersPerInch)
 }
 
 // Time is a type alias that has helpers to serialize to JSON and to
@@ -35,6 +49,76 @@ func (t *Time) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// optionalFloat is a number that some firmwares send empty or malformed; in
+// that case it's decoded as missing instead of failing the whole payload.
+type optionalFloat struct {
+	Value float64
+	Valid bool
+}
+
+func (f *optionalFloat) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseFloat(string(text), 64)
+	*f = optionalFloat{Value: v, Valid: err == nil}
+	return nil
+}
+
+// Ptr returns a pointer to the value, or nil when missing.
+func (f optionalFloat) Ptr() *float64 {
+	if !f.Valid {
+		return nil
+	}
+	v := f.Value
+	return &v
+}
+
+// optionalInt is an integer that some firmwares send empty, e.g. when a sensor
+// is disconnected; in that case it's decoded as missing instead of failing the
+// whole payload. Malformed values are still an error.
+type optionalInt struct {
+	Value int
+	Valid bool
+}
+
+func (i *optionalInt) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*i = optionalInt{}
+		return nil
+	}
+
+	v, err := strconv.Atoi(string(text))
+	if err != nil {
+		return err
+	}
+	*i = optionalInt{Value: v, Valid: true}
+	return nil
+}
+
+// Ptr returns a pointer to the value, or nil when missing.
+func (i optionalInt) Ptr() *int {
+	if !i.Valid {
+		return nil
+	}
+	v := i.Value
+	return &v
+}
+
+// fahrenheitToCelsius converts an optional temperature in °F to °C.
+func fahrenheitToCelsius(f optionalFloat) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	c := (f.Value - 32) * 5 / 9
+	return &c
+}
+
+// optionalText returns a pointer to s, or nil when empty.
+func optionalText(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
 // payload is the POST form data sent by the weather station to a custom endpoint.
 type payload struct {
 	// Some sort of identifier; seems to be the MD5 hash of the MAC address
@@ -64,11 +148,11 @@ type payload struct {
 	// Total rain recorded in this hour (in)
 	HourlyRainIn float64
 
-	// Outdoor humidity (percentage)
-	Humidity int
+	// Outdoor humidity (percentage); empty when the sensor is disconnected
+	Humidity optionalInt
 
-	// Indoor humidity (percentage)
-	HumidityIn int
+	// Indoor humidity (percentage); empty when the sensor is disconnected
+	HumidityIn optionalInt
 
 	// How often the station sends data to the collector (seconds)
 	Interval int
@@ -82,9 +166,10 @@ type payload struct {
 	// Total rain recorded this month (in)
 	MonthlyRainIn float64
 
-	// Current rainfall rate (inches per hour?)
+	// Current rainfall rate (in/h)
 	RainRateIn float64
 
+	// Station uptime (seconds)
 	Runtime int
 
 	// Solar radiation (W/m2)
@@ -102,20 +187,20 @@ type payload struct {
 	// Total rain recorded (in)
 	TotalRainIn float64
 
-	// UV index
-	UV float64 // or int?
+	// UV index; sent as an integer by some firmwares, or empty
+	UV optionalFloat
 
-	// Vapour Pressure Deficit
-	VPD float64
+	// Vapour Pressure Deficit (kPa)
+	VPD optionalFloat
 
 	// Total rain recorded this week (in)
 	WeeklyRainIn float64
 
-	// Battery status (0=OK, 1=LOW, unconfirmed)
-	Wh65Batt float64 // or int?
+	// Battery status of the WH65 sensor array; see batteryStatus
+	Wh65Batt float64
 
-	// Wind direction (degrees)
-	WindDir int
+	// Wind direction (degrees); empty when the sensor is disconnected
+	WindDir optionalInt
 
 	// Wind gust speed (mph)
 	WindGustMph float64
@@ -125,41 +210,221 @@ type payload struct {
 
 	// Total rain recorded this year (in)
 	YearlyRainIn float64
+
+	// WN34 temperature probes, channels 1 to 8 (f); missing when the
+	// channel is not used
+	TfCh1 optionalFloat `schema:"tf_ch1"`
+	TfCh2 optionalFloat `schema:"tf_ch2"`
+	TfCh3 optionalFloat `schema:"tf_ch3"`
+	TfCh4 optionalFloat `schema:"tf_ch4"`
+	TfCh5 optionalFloat `schema:"tf_ch5"`
+	TfCh6 optionalFloat `schema:"tf_ch6"`
+	TfCh7 optionalFloat `schema:"tf_ch7"`
+	TfCh8 optionalFloat `schema:"tf_ch8"`
+
+	// WN34 battery voltages, channels 1 to 8
+	TfBatt1 optionalFloat `schema:"tf_batt1"`
+	TfBatt2 optionalFloat `schema:"tf_batt2"`
+	TfBatt3 optionalFloat `schema:"tf_batt3"`
+	TfBatt4 optionalFloat `schema:"tf_batt4"`
+	TfBatt5 optionalFloat `schema:"tf_batt5"`
+	TfBatt6 optionalFloat `schema:"tf_batt6"`
+	TfBatt7 optionalFloat `schema:"tf_batt7"`
+	TfBatt8 optionalFloat `schema:"tf_batt8"`
+
+	// Text fields sent by some firmwares: the pressure trend computed by the
+	// console, and a short description of the weather.
+	PTrend  string `schema:"ptrend"`
+	Weather string `schema:"weather"`
 }
 
 type WeatherData struct {
 	Passkey            string        `db:"-"`
+	Timestamp          time.Time     `db:"time"`
+	Station            string        `db:"station"`
 	AbsolutePressure   float64       `db:"pressure_absolute"`
 	RelativePressure   float64       `db:"pressure_relative"`
-	Timestamp          time.Time     `db:"time"`
 	Frequency          string        `db:"frequency"`
 	Heap               int           `db:"heap"`
 	DailyRain          float64       `db:"daily_rain"`
 	EventRain          float64       `db:"event_rain"`
 	HourlyRain         float64       `db:"hourly_rain"`
 	MonthlyRain        float64       `db:"monthly_rain"`
-	RainRate           float64       `db:"rain_rate"`
+	RainRate           float64       `db:"rain_rate"` // mm/h, while the amounts are in mm
 	TotalRain          float64       `db:"total_rain"`
 	WeeklyRain         float64       `db:"weekly_rain"`
 	YearlyRain         float64       `db:"yearly_rain"`
-	OutdoorHumidity    int           `db:"humidity_outdoor"`
-	IndoorHumidity     int           `db:"humidity_indoor"`
+	OutdoorHumidity    *int          `db:"humidity_outdoor"`
+	IndoorHumidity     *int          `db:"humidity_indoor"`
 	Interval           time.Duration `db:"interval"`
 	Model              string        `db:"model"`
-	Runtime            int           `db:"runtime"`
+	Runtime            int           `db:"runtime"` // station uptime, in seconds
 	SolarRadiation     float64       `db:"solar_radiation"`
 	StationType        string        `db:"station_type"`
 	OutdoorTemperature float64       `db:"temperature_outdoor"`
 	IndoorTemperature  float64       `db:"temperature_indoor"`
-	UV                 float64       `db:"uv"`
+	UV                 *float64      `db:"uv"` // nil when not sent
 	BatteryLevel       float64       `db:"battery"`
 	MaxDailyGust       float64       `db:"wind_max_daily_gust"`
-	WindDirection      int           `db:"wind_direction"`
+	WindDirection      *int          `db:"wind_direction"`
 	WindGust           float64       `db:"wind_gust"`
 	WindSpeed          float64       `db:"wind_speed"`
+
+	// The WN34 temperature probes (°C) and their battery voltages; nil for the
+	// channels that are not used.
+	TemperatureProbe1        *float64 `db:"temperature_probe_ch1,omitempty"`
+	TemperatureProbe2        *float64 `db:"temperature_probe_ch2,omitempty"`
+	TemperatureProbe3        *float64 `db:"temperature_probe_ch3,omitempty"`
+	TemperatureProbe4        *float64 `db:"temperature_probe_ch4,omitempty"`
+	TemperatureProbe5        *float64 `db:"temperature_probe_ch5,omitempty"`
+	TemperatureProbe6        *float64 `db:"temperature_probe_ch6,omitempty"`
+	TemperatureProbe7        *float64 `db:"temperature_probe_ch7,omitempty"`
+	TemperatureProbe8        *float64 `db:"temperature_probe_ch8,omitempty"`
+	TemperatureProbeBattery1 *float64 `db:"temperature_probe_battery_ch1,omitempty"`
+	TemperatureProbeBattery2 *float64 `db:"temperature_probe_battery_ch2,omitempty"`
+	TemperatureProbeBattery3 *float64 `db:"temperature_probe_battery_ch3,omitempty"`
+	TemperatureProbeBattery4 *float64 `db:"temperature_probe_battery_ch4,omitempty"`
+	TemperatureProbeBattery5 *float64 `db:"temperature_probe_battery_ch5,omitempty"`
+	TemperatureProbeBattery6 *float64 `db:"temperature_probe_battery_ch6,omitempty"`
+	TemperatureProbeBattery7 *float64 `db:"temperature_probe_battery_ch7,omitempty"`
+	TemperatureProbeBattery8 *float64 `db:"temperature_probe_battery_ch8,omitempty"`
+
+	// The text fields sent by some firmwares; nil when not sent.
+	StationPressureTrend *string `db:"station_pressure_trend,omitempty"`
+	StationWeather       *string `db:"station_weather,omitempty"`
+
+	// Optional, derived values; these columns are only written when the
+	// corresponding feature is enabled.
+	WindGustSmoothed *float64 `db:"wind_gust_smoothed,omitempty"`
+	WindDirectionAvg *float64 `db:"wind_direction_avg,omitempty"`
+	SolarLux         *float64 `db:"solar_lux,omitempty"`
+	SolarElevation   *float64 `db:"solar_elevation,omitempty"`
+	IsDaytime        *bool    `db:"is_daytime,omitempty"`
+	Condition        *string  `db:"condition,omitempty"`
+	FeelsLike        *float64 `db:"feels_like,omitempty"`
+	PressureTendency *string  `db:"pressure_tendency,omitempty"`
+	Forecast         *string  `db:"forecast,omitempty"`
+	BatteryStatus    *string  `db:"battery_status_text,omitempty"`
+
+	// The contribution of the reading to the degree days of its day.
+	HeatingDegreeDays *float64 `db:"heating_degree_days,omitempty"`
+	CoolingDegreeDays *float64 `db:"cooling_degree_days,omitempty"`
+
+	// Whether the daily rain differs from the increase of the total rain
+	// since the local midnight, when enabled; nil when the total at midnight
+	// is unknown.
+	DailyRainMismatch *bool `db:"daily_rain_mismatch,omitempty"`
+
+	// The model and the station type split in their name and firmware
+	// version, when enabled; the versions are nil when they don't match.
+	ModelBase          *string `db:"model_base,omitempty"`
+	ModelVersion       *string `db:"model_version,omitempty"`
+	StationTypeBase    *string `db:"station_type_base,omitempty"`
+	StationTypeVersion *string `db:"station_type_version,omitempty"`
+
+	// The name of the station, when enabled; see config.StationNameConfig.
+	StationName *string `db:"station_name,omitempty"`
+
+	// The time at which the collector received the data, as opposed to the
+	// time reported by the station.
+	ReceivedAt *time.Time `db:"received_at,omitempty"`
+
+	// The form body of the report, when enabled.
+	RawQuery *string `db:"raw_query,omitempty"`
+
+	// How the reading arrived, when enabled, e.g. "ecowitt_http".
+	Source *string `db:"source,omitempty"`
+
+	// The Vapour Pressure Deficit, when enabled, in kPa or hPa as set by
+	// database.vpd_unit; nil when not sent.
+	VPD *float64 `db:"vpd,omitempty"`
+
+	// The location configured for the station, when enabled; see
+	// config.StationConfig.
+	Latitude  *float64 `db:"latitude,omitempty"`
+	Longitude *float64 `db:"longitude,omitempty"`
+	Altitude  *float64 `db:"altitude,omitempty"`
+
+	// The pressures as sent by the station (inHg), before the conversion and
+	// the calibration, when enabled.
+	AbsolutePressureInHg *float64 `db:"pressure_absolute_inhg,omitempty"`
+	RelativePressureInHg *float64 `db:"pressure_relative_inhg,omitempty"`
+
+	// The rain metrics packed in a single column, when enabled; the rain
+	// columns above are not stored in this case.
+	Rain *rainData `db:"rain,omitempty"`
+
+	// unreported are the columns whose field was missing from the report;
+	// see reported and mergeMetrics.
+	unreported map[string]bool
 }
 
-func NewWeatherData(p payload) (*WeatherData, error) {
+// rainData holds the rain metrics of a reading (mm and mm/h, or inches and
+// in/h with database.rain_unit "in"), stored as a
+// jsonb object keyed by the names of the rain columns.
+type rainData struct {
+	DailyRain   float64 `json:"daily_rain"`
+	EventRain   float64 `json:"event_rain"`
+	HourlyRain  float64 `json:"hourly_rain"`
+	MonthlyRain float64 `json:"monthly_rain"`
+	RainRate    float64 `json:"rain_rate"`
+	TotalRain   float64 `json:"total_rain"`
+	WeeklyRain  float64 `json:"weekly_rain"`
+	YearlyRain  float64 `json:"yearly_rain"`
+}
+
+// rainToInches converts the rain amounts of wd to inches, and the rain rate
+// to inches per hour.
+func (wd *WeatherData) rainToInches() {
+	for _, v := range []*float64{
+		&wd.DailyRain, &wd.EventRain, &wd.HourlyRain, &wd.MonthlyRain,
+		&wd.RainRate, &wd.TotalRain, &wd.WeeklyRain, &wd.YearlyRain,
+	} {
+		*v /= millimetersPerInch
+	}
+}
+
+// newRainData returns the rain metrics of wd.
+func newRainData(wd *WeatherData) *rainData {
+	return &rainData{
+		DailyRain:   wd.DailyRain,
+		EventRain:   wd.EventRain,
+		HourlyRain:  wd.HourlyRain,
+		MonthlyRain: wd.MonthlyRain,
+		RainRate:    wd.RainRate,
+		TotalRain:   wd.TotalRain,
+		WeeklyRain:  wd.WeeklyRain,
+		YearlyRain:  wd.YearlyRain,
+	}
+}
+
+// RuntimeDuration returns the station's uptime as a time.Duration.
+func (wd *WeatherData) RuntimeDuration() time.Duration {
+	return time.Duration(wd.Runtime) * time.Second
+}
+
+// calibrate applies the calibration c to v.
+func calibrate(v float64, c config.Calibration) float64 {
+	if c.Scale != 0 {
+		v *= c.Scale
+	}
+	return v + c.Offset
+}
+
+// calibrateHumidity applies the calibration c to the humidity h, keeping the
+// result between 0 and 100%; a missing humidity stays missing.
+func calibrateHumidity(h *int, c config.Calibration) *int {
+	if h == nil {
+		return nil
+	}
+	v := int(math.Round(calibrate(float64(*h), c)))
+	v = min(max(v, 0), 100)
+	return &v
+}
+
+// NewWeatherData converts the payload sent by a station to metric units, then
+// applies the calibration cal.
+func NewWeatherData(p payload, cal config.CalibrationConfig) (*WeatherData, error) {
 	absPressure := units.NewValue(p.BaromAbsIn, units.InHg)
 	if v, err := absPressure.Convert(units.HectoPascal); err != nil {
 		return nil, err
@@ -188,6 +453,13 @@ func NewWeatherData(p payload) (*WeatherData, error) {
 		eventRain = v
 	}
 
+	hourlyRain := units.NewValue(p.HourlyRainIn, units.Inch)
+	if v, err := hourlyRain.Convert(units.MilliMeter); err != nil {
+		return nil, err
+	} else {
+		hourlyRain = v
+	}
+
 	monthlyRain := units.NewValue(p.MonthlyRainIn, units.Inch)
 	if v, err := monthlyRain.Convert(units.MilliMeter); err != nil {
 		return nil, err
@@ -195,8 +467,8 @@ func NewWeatherData(p payload) (*WeatherData, error) {
 		monthlyRain = v
 	}
 
-	rainRate := units.NewValue(p.RainRateIn, units.Inch)
-	if v, err := rainRate.Convert(units.MilliMeter); err != nil {
+	rainRate := units.NewValue(p.RainRateIn, InchesPerHour)
+	if v, err := rainRate.Convert(MillimetersPerHour); err != nil {
 		return nil, err
 	} else {
 		rainRate = v
@@ -263,17 +535,19 @@ func NewWeatherData(p payload) (*WeatherData, error) {
 		AbsolutePressure:   absPressure.Float(),
 		RelativePressure:   relPressure.Float(),
 		Timestamp:          time.Time(p.DateUTC).UTC(),
+		Station:            p.StationType,
 		Frequency:          p.Freq,
 		Heap:               p.Heap,
 		DailyRain:          dailyRain.Float(),
 		EventRain:          eventRain.Float(),
+		HourlyRain:         hourlyRain.Float(),
 		MonthlyRain:        monthlyRain.Float(),
 		RainRate:           rainRate.Float(),
 		TotalRain:          totalRain.Float(),
 		WeeklyRain:         weeklyRain.Float(),
 		YearlyRain:         yearlyRain.Float(),
-		OutdoorHumidity:    p.Humidity,
-		IndoorHumidity:     p.HumidityIn,
+		OutdoorHumidity:    p.Humidity.Ptr(),
+		IndoorHumidity:     p.HumidityIn.Ptr(),
 		Interval:           time.Duration(p.Interval) * time.Second,
 		Model:              p.Model,
 		Runtime:            p.Runtime,
@@ -281,13 +555,52 @@ func NewWeatherData(p payload) (*WeatherData, error) {
 		StationType:        p.StationType,
 		OutdoorTemperature: outTemp.Float(),
 		IndoorTemperature:  inTemp.Float(),
-		UV:                 p.UV,
+		UV:                 p.UV.Ptr(),
 		BatteryLevel:       p.Wh65Batt,
 		MaxDailyGust:       maxDailyGust.Float(),
-		WindDirection:      p.WindDir, // TODO check for offset
+		WindDirection:      p.WindDir.Ptr(),
 		WindGust:           windGust.Float(),
 		WindSpeed:          windSpeed.Float(),
+
+		TemperatureProbe1:        fahrenheitToCelsius(p.TfCh1),
+		TemperatureProbe2:        fahrenheitToCelsius(p.TfCh2),
+		TemperatureProbe3:        fahrenheitToCelsius(p.TfCh3),
+		TemperatureProbe4:        fahrenheitToCelsius(p.TfCh4),
+		TemperatureProbe5:        fahrenheitToCelsius(p.TfCh5),
+		TemperatureProbe6:        fahrenheitToCelsius(p.TfCh6),
+		TemperatureProbe7:        fahrenheitToCelsius(p.TfCh7),
+		TemperatureProbe8:        fahrenheitToCelsius(p.TfCh8),
+		TemperatureProbeBattery1: p.TfBatt1.Ptr(),
+		TemperatureProbeBattery2: p.TfBatt2.Ptr(),
+		TemperatureProbeBattery3: p.TfBatt3.Ptr(),
+		TemperatureProbeBattery4: p.TfBatt4.Ptr(),
+		TemperatureProbeBattery5: p.TfBatt5.Ptr(),
+		TemperatureProbeBattery6: p.TfBatt6.Ptr(),
+		TemperatureProbeBattery7: p.TfBatt7.Ptr(),
+		TemperatureProbeBattery8: p.TfBatt8.Ptr(),
+
+		StationPressureTrend: optionalText(p.PTrend),
+		StationWeather:       optionalText(p.Weather),
 	}
 
+	wd.Calibrate(cal)
+
 	return &wd, nil
 }
+
+// Calibrate applies the calibration cal to the sensor readings.
+func (wd *WeatherData) Calibrate(cal config.CalibrationConfig) {
+	wd.AbsolutePressure = calibrate(wd.AbsolutePressure, cal.AbsolutePressure)
+	wd.RelativePressure = calibrate(wd.RelativePressure, cal.RelativePressure)
+	wd.OutdoorHumidity = calibrateHumidity(wd.OutdoorHumidity, cal.OutdoorHumidity)
+	wd.IndoorHumidity = calibrateHumidity(wd.IndoorHumidity, cal.IndoorHumidity)
+	wd.OutdoorTemperature = calibrate(wd.OutdoorTemperature, cal.OutdoorTemperature)
+	wd.IndoorTemperature = calibrate(wd.IndoorTemperature, cal.IndoorTemperature)
+
+	if cal.FloorNegativeSolar {
+		wd.SolarRadiation = max(wd.SolarRadiation, 0)
+		if wd.UV != nil {
+			*wd.UV = max(*wd.UV, 0)
+		}
+	}
+}
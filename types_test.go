@@ -1,9 +1,18 @@
 package main
 
 import (
+	"errors"
+	"math"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bcicen/go-units"
+	"github.com/gorilla/schema"
+	"github.com/piger/ecowitt-collector/internal/config"
 )
 
 func TestMilesPerHourConversion(t *testing.T) {
@@ -18,3 +27,335 @@ func TestMilesPerHourConversion(t *testing.T) {
 		t.Fatalf("expected 0.44704, got %f\n", result)
 	}
 }
+
+func TestRuntimeDuration(t *testing.T) {
+	wd := WeatherData{Runtime: 1240}
+	if got, want := wd.RuntimeDuration(), 20*time.Minute+40*time.Second; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	// a year of uptime doesn't overflow
+	wd.Runtime = 365 * 24 * 60 * 60
+	if got, want := wd.RuntimeDuration(), 365*24*time.Hour; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestNewWeatherDataCalibration(t *testing.T) {
+	p := payload{Tempf: 68, TempInF: 68, Humidity: optionalInt{98, true}, HumidityIn: optionalInt{50, true}, BaromRelIn: 29.92}
+
+	plain, err := NewWeatherData(p, config.CalibrationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cal := config.CalibrationConfig{
+		OutdoorTemperature: config.Calibration{Offset: -0.5},
+		OutdoorHumidity:    config.Calibration{Offset: 5},
+		RelativePressure:   config.Calibration{Scale: 1.01, Offset: -2},
+	}
+	wd, err := NewWeatherData(p, cal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := wd.OutdoorTemperature, plain.OutdoorTemperature-0.5; math.Abs(got-want) > 1e-9 {
+		t.Errorf("expected outdoor temperature %v, got %v", want, got)
+	}
+	if *wd.OutdoorHumidity != 100 {
+		t.Errorf("expected the outdoor humidity to be capped at 100, got %d", *wd.OutdoorHumidity)
+	}
+	if got, want := wd.RelativePressure, plain.RelativePressure*1.01-2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("expected relative pressure %v, got %v", want, got)
+	}
+
+	// unconfigured fields are untouched
+	if wd.IndoorTemperature != plain.IndoorTemperature || *wd.IndoorHumidity != *plain.IndoorHumidity ||
+		wd.AbsolutePressure != plain.AbsolutePressure {
+		t.Errorf("unexpected change to uncalibrated fields: %+v", wd)
+	}
+}
+
+func TestNewWeatherDataFloorNegativeSolar(t *testing.T) {
+	p := payload{SolarRadiation: -0.3, UV: optionalFloat{Value: -0.1, Valid: true}}
+
+	for _, enabled := range []bool{false, true} {
+		wd, err := NewWeatherData(p, config.CalibrationConfig{FloorNegativeSolar: enabled})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantSolar, wantUV := -0.3, -0.1
+		if enabled {
+			wantSolar, wantUV = 0, 0
+		}
+		if wd.SolarRadiation != wantSolar || *wd.UV != wantUV {
+			t.Errorf("enabled=%v: expected solar radiation %v and UV %v, got %v and %v",
+				enabled, wantSolar, wantUV, wd.SolarRadiation, *wd.UV)
+		}
+	}
+}
+
+func TestNewWeatherData(t *testing.T) {
+	// the sample query, with distinct rain values to tell the fields apart
+	query := strings.NewReplacer(
+		"rainratein=0.000", "rainratein=0.100",
+		"eventrainin=0.000", "eventrainin=0.250",
+		"hourlyrainin=0.000", "hourlyrainin=0.050",
+		"dailyrainin=0.000", "dailyrainin=0.300",
+		"weeklyrainin=0.000", "weeklyrainin=1.000",
+		"monthlyrainin=0.000", "monthlyrainin=2.000",
+		"yearlyrainin=0.000", "yearlyrainin=10.000",
+		"totalrainin=0.000", "totalrainin=20.000",
+	).Replace(sampleQuery)
+
+	form, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p payload
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	if err := decoder.Decode(&p, form); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := NewWeatherData(p, config.CalibrationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	floats := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"AbsolutePressure", wd.AbsolutePressure, 1001.186},   // hPa
+		{"RelativePressure", wd.RelativePressure, 1013.208},   // hPa
+		{"OutdoorTemperature", wd.OutdoorTemperature, 19.889}, // °C
+		{"IndoorTemperature", wd.IndoorTemperature, 21.111},   // °C
+		{"WindSpeed", wd.WindSpeed, 0.098},                    // m/s
+		{"WindGust", wd.WindGust, 0.501},                      // m/s
+		{"MaxDailyGust", wd.MaxDailyGust, 1.998},              // m/s
+		{"RainRate", wd.RainRate, 2.54},                       // mm/h
+		{"EventRain", wd.EventRain, 6.35},                     // mm
+		{"HourlyRain", wd.HourlyRain, 1.27},                   // mm
+		{"DailyRain", wd.DailyRain, 7.62},                     // mm
+		{"WeeklyRain", wd.WeeklyRain, 25.4},                   // mm
+		{"MonthlyRain", wd.MonthlyRain, 50.8},                 // mm
+		{"YearlyRain", wd.YearlyRain, 254},                    // mm
+		{"TotalRain", wd.TotalRain, 508},                      // mm
+		{"SolarRadiation", wd.SolarRadiation, 142.55},         // W/m²
+		{"UV", *wd.UV, 1},
+		{"BatteryLevel", wd.BatteryLevel, 0},
+	}
+
+	for _, tt := range floats {
+		t.Run(tt.name, func(t *testing.T) {
+			if math.Abs(tt.got-tt.want) > 0.001 {
+				t.Errorf("expected %v, got %v", tt.want, tt.got)
+			}
+		})
+	}
+
+	want := WeatherData{
+		Passkey:         "LA5ZAQUAHNGEDOOW0DAEROOV8VEZIETI",
+		Station:         "EasyWeatherPro_V5.1.3",
+		Timestamp:       time.Date(2024, 6, 16, 16, 32, 8, 0, time.UTC),
+		Frequency:       "868M",
+		OutdoorHumidity: ptr(47),
+		IndoorHumidity:  ptr(48),
+		Interval:        time.Minute,
+		Model:           "WS2900_V2.02.03",
+		Runtime:         1240,
+		StationType:     "EasyWeatherPro_V5.1.3",
+		WindDirection:   ptr(196),
+	}
+	got := WeatherData{
+		Passkey:         wd.Passkey,
+		Station:         wd.Station,
+		Timestamp:       wd.Timestamp,
+		Frequency:       wd.Frequency,
+		OutdoorHumidity: wd.OutdoorHumidity,
+		IndoorHumidity:  wd.IndoorHumidity,
+		Interval:        wd.Interval,
+		Model:           wd.Model,
+		Runtime:         wd.Runtime,
+		StationType:     wd.StationType,
+		WindDirection:   wd.WindDirection,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestDecodeUV(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  *float64
+	}{
+		{"absent", "tempf=67.8", nil},
+		{"empty", "uv=", nil},
+		{"invalid", "uv=n/a", nil},
+		{"integer", "uv=3", ptr(3.0)},
+		{"float", "uv=2.5", ptr(2.5)},
+	}
+
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var p payload
+			if err := decoder.Decode(&p, form); err != nil {
+				t.Fatalf("error decoding the payload: %s", err)
+			}
+
+			got := p.UV.Ptr()
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeOptionalInt(t *testing.T) {
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+
+	// a disconnected sensor sends empty values, which are stored as NULL
+	form, err := url.ParseQuery(strings.NewReplacer("humidity=47", "humidity=", "winddir=196", "winddir=").Replace(sampleQuery))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p payload
+	if err := validatePayload(&p, decoder.Decode(&p, form)); err != nil {
+		t.Fatalf("error decoding the payload: %s", err)
+	}
+
+	wd, err := NewWeatherData(p, config.CalibrationConfig{OutdoorHumidity: config.Calibration{Offset: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd.OutdoorHumidity != nil || wd.WindDirection != nil {
+		t.Errorf("expected the humidity and the wind direction to be missing, got %v and %v",
+			wd.OutdoorHumidity, wd.WindDirection)
+	}
+	if wd.IndoorHumidity == nil || *wd.IndoorHumidity != 48 {
+		t.Errorf("expected the indoor humidity to be 48, got %v", wd.IndoorHumidity)
+	}
+
+	// malformed values are still an error
+	form.Set("humidity", "n/a")
+	p = payload{}
+	err = validatePayload(&p, decoder.Decode(&p, form))
+	var ve *validationError
+	if !errors.As(err, &ve) || len(ve.Fields) != 1 || ve.Fields[0].Field != "humidity" {
+		t.Errorf("expected an error for humidity, got %v", err)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestDecodeTextFields(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery + "&ptrend=falling&weather=Light+rain&foo=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	var p payload
+	if err := decoder.Decode(&p, form); err != nil {
+		t.Fatalf("error decoding the payload: %s", err)
+	}
+
+	wd, err := NewWeatherData(p, config.CalibrationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wd.StationPressureTrend == nil || *wd.StationPressureTrend != "falling" {
+		t.Errorf("expected pressure trend \"falling\", got %v", wd.StationPressureTrend)
+	}
+	if wd.StationWeather == nil || *wd.StationWeather != "Light rain" {
+		t.Errorf("expected weather \"Light rain\", got %v", wd.StationWeather)
+	}
+
+	// the unknown keys are still reported
+	unexpected, _, _ := checkModelFields(form.Get("model"), form)
+	if !slices.Equal(unexpected, []string{"foo"}) {
+		t.Errorf("expected unexpected=[foo], got %v", unexpected)
+	}
+
+	// the fields are optional
+	p = payload{}
+	form, _ = url.ParseQuery(sampleQuery)
+	if err := decoder.Decode(&p, form); err != nil {
+		t.Fatal(err)
+	}
+	if wd, err = NewWeatherData(p, config.CalibrationConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if wd.StationPressureTrend != nil || wd.StationWeather != nil {
+		t.Errorf("expected no text fields, got %v and %v", wd.StationPressureTrend, wd.StationWeather)
+	}
+}
+
+func TestDecodeTemperatureProbes(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery + "&tf_ch1=50.0&tf_batt1=1.48&tf_ch3=77.9&tf_batt3=1.32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	var p payload
+	if err := decoder.Decode(&p, form); err != nil {
+		t.Fatalf("error decoding the payload: %s", err)
+	}
+
+	wd, err := NewWeatherData(p, config.CalibrationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		got  *float64
+		want *float64
+	}{
+		{"ch1", wd.TemperatureProbe1, ptr(10.0)},
+		{"ch1 battery", wd.TemperatureProbeBattery1, ptr(1.48)},
+		{"ch2", wd.TemperatureProbe2, nil},
+		{"ch2 battery", wd.TemperatureProbeBattery2, nil},
+		{"ch3", wd.TemperatureProbe3, ptr(25.5)},
+		{"ch3 battery", wd.TemperatureProbeBattery3, ptr(1.32)},
+		{"ch8", wd.TemperatureProbe8, nil},
+	} {
+		if (tt.got == nil) != (tt.want == nil) || (tt.got != nil && math.Abs(*tt.got-*tt.want) > 0.001) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, tt.got)
+		}
+	}
+
+	// the channels that are not used are not written
+	names, _ := wd.columnValues(weatherDataColumns)
+	for _, name := range []string{"temperature_probe_ch1", "temperature_probe_battery_ch3"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("expected column %s to be written", name)
+		}
+	}
+	for _, name := range []string{"temperature_probe_ch2", "temperature_probe_battery_ch8"} {
+		if slices.Contains(names, name) {
+			t.Errorf("expected column %s not to be written", name)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+// fieldError is a problem with one of the fields of a report.
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// validationError lists all the problems found in a report, so that a
+// misconfigured station can be fixed at once instead of one field at a time.
+type validationError struct {
+	Fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Error
+	}
+	return "invalid fields: " + strings.Join(msgs, "; ")
+}
+
+// validatePayload checks the decoded payload p, returning a validationError
+// with the fields that couldn't be decoded, listed in decodeErr, and the ones
+// that are missing or out of range. Errors of decodeErr other than the ones
+// of the fields are returned as they are.
+func validatePayload(p *payload, decodeErr error) error {
+	var fields []fieldError
+
+	if decodeErr != nil {
+		var me schema.MultiError
+		if !errors.As(decodeErr, &me) {
+			return decodeErr
+		}
+		for key, err := range me {
+			var ce schema.ConversionError
+			if errors.As(err, &ce) && ce.Err != nil {
+				err = ce.Err
+			}
+			fields = append(fields, fieldError{Field: key, Error: err.Error()})
+		}
+	}
+
+	invalid := func(field, format string, args ...any) {
+		// a field that couldn't be decoded is only reported once
+		if !slices.ContainsFunc(fields, func(f fieldError) bool { return f.Field == field }) {
+			fields = append(fields, fieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	if p.Passkey == "" {
+		invalid("PASSKEY", "missing")
+	}
+	if time.Time(p.DateUTC).IsZero() {
+		invalid("dateutc", "missing")
+	}
+	if h := p.Humidity; h.Valid && (h.Value < 0 || h.Value > 100) {
+		invalid("humidity", "%d is out of range [0, 100]", h.Value)
+	}
+	if h := p.HumidityIn; h.Valid && (h.Value < 0 || h.Value > 100) {
+		invalid("humidityin", "%d is out of range [0, 100]", h.Value)
+	}
+	if d := p.WindDir; d.Valid && (d.Value < 0 || d.Value > 360) {
+		invalid("winddir", "%d is out of range [0, 360]", d.Value)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	slices.SortFunc(fields, func(a, b fieldError) int { return strings.Compare(a.Field, b.Field) })
+	return &validationError{Fields: fields}
+}
+
+// Validator checks a converted reading before it's stored; readings failing
+// any validator are rejected. Returning a *validationError reports the
+// offending columns to the station.
+type Validator interface {
+	Validate(wd *WeatherData) error
+}
+
+// customValidators are run after the built-in validators; site-specific rules
+// can be compiled in by registering them, with registerValidator, from the
+// init function of a new file of this package.
+var customValidators []Validator
+
+func registerValidator(v Validator) {
+	customValidators = append(customValidators, v)
+}
+
+// validators returns the chain of validators configured by conf: the
+// built-in ones, followed by the custom ones.
+func validators(conf config.ValidationConfig, clock Clock) []Validator {
+	chain := []Validator{rangeValidator{}}
+	if conf.MaxClockSkew > 0 {
+		chain = append(chain, clockSkewValidator{clock: clock, max: conf.MaxClockSkew})
+	}
+
+	return append(chain, customValidators...)
+}
+
+// validateReading runs wd through the chain, stopping at the first failure.
+func validateReading(chain []Validator, wd *WeatherData) error {
+	for _, v := range chain {
+		if err := v.Validate(wd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rangeValidator rejects the readings with values that are physically
+// impossible; unlike validatePayload it also covers the Tempest readings.
+type rangeValidator struct{}
+
+func (rangeValidator) Validate(wd *WeatherData) error {
+	var fields []fieldError
+	invalid := func(field, format string, args ...any) {
+		fields = append(fields, fieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+	}
+
+	if h := wd.OutdoorHumidity; h != nil && (*h < 0 || *h > 100) {
+		invalid("humidity_outdoor", "%d is out of range [0, 100]", *h)
+	}
+	if h := wd.IndoorHumidity; h != nil && (*h < 0 || *h > 100) {
+		invalid("humidity_indoor", "%d is out of range [0, 100]", *h)
+	}
+	if d := wd.WindDirection; d != nil && (*d < 0 || *d > 360) {
+		invalid("wind_direction", "%d is out of range [0, 360]", *d)
+	}
+	if wd.WindSpeed < 0 {
+		invalid("wind_speed", "%v is negative", wd.WindSpeed)
+	}
+	if wd.RainRate < 0 {
+		invalid("rain_rate", "%v is negative", wd.RainRate)
+	}
+	if wd.UV != nil && *wd.UV < 0 {
+		invalid("uv", "%v is negative", *wd.UV)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return &validationError{Fields: fields}
+}
+
+// floorNegative replaces the negative wind speed and rain rate of wd, sent by
+// some sensors around zero, with zero, for validation.floor_negative; it
+// returns the names of the columns that were floored.
+func floorNegative(wd *WeatherData) []string {
+	var floored []string
+	if wd.WindSpeed < 0 {
+		wd.WindSpeed = 0
+		floored = append(floored, "wind_speed")
+	}
+	if wd.RainRate < 0 {
+		wd.RainRate = 0
+		floored = append(floored, "rain_rate")
+	}
+
+	return floored
+}
+
+// clockSkewValidator rejects the readings timestamped further than max in the
+// future, typically from a station whose clock is wrong; readings from the
+// past are legitimate, e.g. when a station sends its backlog.
+type clockSkewValidator struct {
+	clock Clock
+	max   time.Duration
+}
+
+func (v clockSkewValidator) Validate(wd *WeatherData) error {
+	if skew := wd.Timestamp.Sub(v.clock.Now()); skew > v.max {
+		return &validationError{Fields: []fieldError{{
+			Field: "time",
+			Error: fmt.Sprintf("%s is %s in the future", wd.Timestamp.UTC().Format(time.RFC3339), skew.Round(time.Second)),
+		}}}
+	}
+
+	return nil
+}
+
+// defaultMaxTextLength is the length at which the text values sent by the
+// stations are truncated when database.max_text_length is not set.
+const defaultMaxTextLength = 128
+
+// truncateText truncates the text values of wd that come from the station to
+// max characters, so that a malformed or malicious report can't store huge
+// values; it returns the names of the columns that were truncated. The raw
+// report is stored as it is.
+func truncateText(wd *WeatherData, max int) []string {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"station", &wd.Station},
+		{"model", &wd.Model},
+		{"station_type", &wd.StationType},
+		{"frequency", &wd.Frequency},
+		{"station_pressure_trend", wd.StationPressureTrend},
+		{"station_weather", wd.StationWeather},
+		{"station_name", wd.StationName},
+	}
+
+	var truncated []string
+	for _, f := range fields {
+		if f.value == nil || len(*f.value) <= max {
+			continue
+		}
+		if runes := []rune(*f.value); len(runes) > max {
+			*f.value = string(runes[:max])
+			truncated = append(truncated, f.name)
+		}
+	}
+
+	return truncated
+}
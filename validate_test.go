@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestValidatePayload(t *testing.T) {
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p payload
+	if err := validatePayload(&p, decoder.Decode(&p, form)); err != nil {
+		t.Fatalf("unexpected error for a valid report: %v", err)
+	}
+
+	// all the problems are reported at once
+	form.Del("PASSKEY")
+	form.Set("dateutc", "yesterday")
+	form.Set("humidity", "147")
+	form.Set("tempf", "warm")
+	p = payload{}
+	err = validatePayload(&p, decoder.Decode(&p, form))
+
+	ve, ok := err.(*validationError)
+	if !ok {
+		t.Fatalf("expected a validationError, got %v", err)
+	}
+	want := []string{"PASSKEY", "dateutc", "humidity", "tempf"}
+	if len(ve.Fields) != len(want) {
+		t.Fatalf("expected the fields %v, got %+v", want, ve.Fields)
+	}
+	for i, field := range want {
+		if ve.Fields[i].Field != field || ve.Fields[i].Error == "" {
+			t.Errorf("field %d: expected an error for %s, got %+v", i, field, ve.Fields[i])
+		}
+	}
+}
+
+type stationValidator string
+
+func (v stationValidator) Validate(wd *WeatherData) error {
+	if wd.Station == string(v) {
+		return errors.New("station not allowed")
+	}
+	return nil
+}
+
+func TestValidators(t *testing.T) {
+	now := time.Date(2024, 6, 16, 16, 32, 10, 0, time.UTC)
+	chain := validators(config.ValidationConfig{MaxClockSkew: time.Minute}, newFakeClock(now))
+
+	valid := func() *WeatherData {
+		return &WeatherData{Station: "A", Timestamp: now, OutdoorHumidity: ptr(47), WindDirection: ptr(196), UV: ptr(1.0)}
+	}
+	if err := validateReading(chain, valid()); err != nil {
+		t.Fatalf("unexpected error for a valid reading: %v", err)
+	}
+
+	wd := valid()
+	wd.OutdoorHumidity = ptr(147)
+	wd.RainRate = -1
+	var ve *validationError
+	if err := validateReading(chain, wd); !errors.As(err, &ve) || len(ve.Fields) != 2 ||
+		ve.Fields[0].Field != "humidity_outdoor" || ve.Fields[1].Field != "rain_rate" {
+		t.Errorf("expected humidity_outdoor and rain_rate to be out of range, got %v", err)
+	}
+
+	// the past is fine, the future only within the allowed skew
+	wd = valid()
+	wd.Timestamp = now.Add(-24 * time.Hour)
+	if err := validateReading(chain, wd); err != nil {
+		t.Errorf("unexpected error for an old reading: %v", err)
+	}
+	wd.Timestamp = now.Add(time.Minute)
+	if err := validateReading(chain, wd); err != nil {
+		t.Errorf("unexpected error within the allowed skew: %v", err)
+	}
+	wd.Timestamp = now.Add(time.Hour)
+	if err := validateReading(chain, wd); !errors.As(err, &ve) || ve.Fields[0].Field != "time" {
+		t.Errorf("expected the time to be rejected, got %v", err)
+	}
+
+	// the custom validators run after the built-in ones
+	customValidators = []Validator{stationValidator("B")}
+	t.Cleanup(func() { customValidators = nil })
+	chain = validators(config.ValidationConfig{}, newFakeClock(now))
+	wd = valid()
+	wd.Timestamp = now.Add(time.Hour)
+	if err := validateReading(chain, wd); err != nil {
+		t.Errorf("unexpected error without max_clock_skew: %v", err)
+	}
+	wd.Station = "B"
+	if err := validateReading(chain, wd); err == nil {
+		t.Error("expected the custom validator to reject the reading")
+	}
+}
+
+func TestIngestValidator(t *testing.T) {
+	sink := &recordingSink{}
+	conf := config.Config{Validation: config.ValidationConfig{MaxClockSkew: time.Minute}}
+	in := newTestIngester(t, conf, sink)
+
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("dateutc", "2024-06-17 16:32:08")
+
+	_, err = in.Ingest(context.Background(), form)
+	var ie *ingestError
+	if !errors.As(err, &ie) || ie.Kind != "validator" {
+		t.Fatalf("expected a validator error, got %v", err)
+	}
+	if len(sink.Written()) != 0 {
+		t.Error("the rejected reading was stored")
+	}
+	if status := ingestStatus(ie.Kind, false, true); status != 400 {
+		t.Errorf("expected 400, got %d", status)
+	}
+}
+
+func TestIngestFloorNegative(t *testing.T) {
+	form, err := url.ParseQuery(sampleQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("windspeedmph", "-0.22")
+
+	// rejected by default, as it points at a faulty sensor
+	in := newTestIngester(t, config.Config{}, &recordingSink{})
+	var ie *ingestError
+	if _, err := in.Ingest(context.Background(), form); !errors.As(err, &ie) || ie.Kind != "validator" {
+		t.Fatalf("expected the reading to be rejected, got %v", err)
+	}
+
+	in = newTestIngester(t, config.Config{Validation: config.ValidationConfig{FloorNegative: true}}, &recordingSink{})
+	wd, err := in.Ingest(context.Background(), form)
+	if err != nil {
+		t.Fatalf("expected the reading to be stored, got %v", err)
+	}
+	if wd.WindSpeed != 0 {
+		t.Errorf("expected the negative wind speed to be stored as zero, got %v", wd.WindSpeed)
+	}
+	if *wd.OutdoorHumidity != 47 {
+		t.Errorf("expected the rest of the reading to be kept, got humidity %v", *wd.OutdoorHumidity)
+	}
+}
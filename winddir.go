@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type directionSample struct {
+	Time time.Time
+	Sin  float64
+	Cos  float64
+}
+
+// directionAverager keeps, for each station, the wind directions received
+// within a time window and reports their vector average: each direction is a
+// unit vector, and the average is the direction of their sum, so that e.g.
+// 350° and 10° average to 0° and not to 180° like their arithmetic mean.
+//
+// Like for gustSmoother, the buffers only live in memory.
+type directionAverager struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	samples *lruMap[[]directionSample]
+}
+
+func newDirectionAverager(window time.Duration, maxStations int) *directionAverager {
+	return &directionAverager{
+		window:  window,
+		samples: newLRUMap[[]directionSample](maxStations),
+	}
+}
+
+// Add records a wind direction reading, in degrees, for station and returns
+// the average direction within the window ending at t, between 0 and 360°.
+// There is no average when the directions cancel out, e.g. 90° and 270°. A
+// delayed reading doesn't see the newer ones, which are kept for the readings
+// that follow.
+func (a *directionAverager) Add(station string, t time.Time, direction int) (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rad := float64(direction) * math.Pi / 180
+	cutoff := t.Add(-a.window)
+	previous, _ := a.samples.Get(station)
+	samples := previous[:0]
+	for _, s := range previous {
+		if s.Time.After(cutoff) {
+			samples = append(samples, s)
+		}
+	}
+	samples = append(samples, directionSample{Time: t, Sin: math.Sin(rad), Cos: math.Cos(rad)})
+	a.samples.Put(station, samples)
+
+	var sumSin, sumCos float64
+	for _, s := range samples {
+		if !s.Time.After(t) {
+			sumSin += s.Sin
+			sumCos += s.Cos
+		}
+	}
+	// the directions cancel out, up to rounding errors
+	if math.Hypot(sumSin, sumCos) < 1e-9 {
+		return 0, false
+	}
+
+	avg := math.Atan2(sumSin, sumCos) * 180 / math.Pi
+	if avg < 0 {
+		avg += 360
+	}
+
+	return avg, true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDirectionAverager(t *testing.T) {
+	start := time.Date(2024, 6, 16, 16, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		directions []int
+		want       float64
+	}{
+		{"single", []int{196}, 196},
+		{"wraparound", []int{350, 10}, 0},
+		{"wraparound off center", []int{340, 10}, 355},
+		{"same side", []int{80, 100}, 90},
+		{"three", []int{0, 90, 90}, 63.43},
+	}
+
+	for _, tt := range tests {
+		a := newDirectionAverager(10*time.Minute, 0)
+		var got float64
+		for i, d := range tt.directions {
+			got, _ = a.Add("a", start.Add(time.Duration(i)*time.Minute), d)
+		}
+		// 0 and 360 are the same direction
+		if diff := math.Mod(math.Abs(got-tt.want), 360); math.Min(diff, 360-diff) > 0.01 {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the directions cancel out
+	a := newDirectionAverager(10*time.Minute, 0)
+	a.Add("a", start, 90)
+	if got, ok := a.Add("a", start.Add(time.Minute), 270); ok {
+		t.Errorf("expected no average for opposite directions, got %v", got)
+	}
+
+	// the first sample falls out of the window
+	if got, ok := a.Add("a", start.Add(10*time.Minute), 270); !ok || math.Abs(got-270) > 0.01 {
+		t.Errorf("expected 270 once 90 is out of the window, got %v (%v)", got, ok)
+	}
+
+	// a delayed reading doesn't see the newer ones, nor drop them
+	a = newDirectionAverager(10*time.Minute, 0)
+	a.Add("a", start, 80)
+	a.Add("a", start.Add(5*time.Minute), 100)
+	if got, _ := a.Add("a", start.Add(2*time.Minute), 80); math.Abs(got-80) > 0.01 {
+		t.Errorf("expected 80 for the delayed reading, got %v", got)
+	}
+	if got, _ := a.Add("a", start.Add(6*time.Minute), 100); math.Abs(got-90) > 0.01 {
+		t.Errorf("expected 90 with the newer reading kept, got %v", got)
+	}
+}
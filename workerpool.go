@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultWorkerPoolQueueSize is the capacity of the worker pool's queue when
+// worker_pool.queue_size is not set.
+const defaultWorkerPoolQueueSize = 100
+
+var (
+	workerPoolQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ecowitt_collector_worker_pool_queue_depth",
+		Help: "The number of readings waiting for a worker of the pool",
+	})
+
+	workerPoolBusySeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ecowitt_collector_worker_pool_busy_seconds_total",
+		Help: "The time spent by the workers of the pool writing readings to the sinks",
+	})
+)
+
+// workerPoolSink decouples the response to the stations from the sinks: Write
+// only enqueues the reading, which is written by one of a fixed number of
+// workers. Unlike queuedSink the caller doesn't wait for the result, so the
+// errors of the sinks are only logged; when the queue is full, writes fail
+// immediately with errSinkBusy.
+type workerPoolSink struct {
+	logger  *slog.Logger
+	next    MetricsSink
+	workers int
+	queue   chan queuedWrite
+}
+
+func newWorkerPoolSink(logger *slog.Logger, next MetricsSink, conf config.WorkerPoolConfig) *workerPoolSink {
+	size := conf.QueueSize
+	if size <= 0 {
+		size = defaultWorkerPoolQueueSize
+	}
+
+	return &workerPoolSink{
+		logger:  logger,
+		next:    next,
+		workers: conf.Size,
+		queue:   make(chan queuedWrite, size),
+	}
+}
+
+// Run runs the workers until ctx is cancelled, then writes the readings left
+// in the queue.
+func (s *workerPoolSink) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					s.drain()
+					return
+				case w := <-s.queue:
+					s.write(w)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *workerPoolSink) drain() {
+	for {
+		select {
+		case w := <-s.queue:
+			s.write(w)
+		default:
+			return
+		}
+	}
+}
+
+func (s *workerPoolSink) write(w queuedWrite) {
+	workerPoolQueueDepth.Set(float64(len(s.queue)))
+
+	start := time.Now()
+	err := s.next.Write(w.ctx, w.wd)
+	workerPoolBusySeconds.Add(time.Since(start).Seconds())
+
+	if err != nil {
+		requestLogger(w.ctx, s.logger).Error("error sending metrics", "station", w.wd.Station, "err", err)
+		reqErrors.With(prometheus.Labels{"error_type": "db"}).Inc()
+	}
+}
+
+func (s *workerPoolSink) Write(ctx context.Context, wd *WeatherData) error {
+	// the request is over by the time the reading is written, but its values,
+	// e.g. the request ID, are still useful for logging
+	w := queuedWrite{ctx: context.WithoutCancel(ctx), wd: wd}
+	select {
+	case s.queue <- w:
+		workerPoolQueueDepth.Set(float64(len(s.queue)))
+		return nil
+	default:
+		return errSinkBusy
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/piger/ecowitt-collector/internal/config"
+)
+
+func TestWorkerPoolSink(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	next := &blockingSink{release: make(chan struct{})}
+	sink := newWorkerPoolSink(logger, next, config.WorkerPoolConfig{Size: 1, QueueSize: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sink.Run(ctx)
+		close(done)
+	}()
+
+	// the writes return without waiting for the blocked sink
+	if err := sink.Write(context.Background(), &WeatherData{Station: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for next.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sink.Write(context.Background(), &WeatherData{Station: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker is busy and the queue is full
+	if err := sink.Write(context.Background(), &WeatherData{Station: "c"}); !errors.Is(err, errSinkBusy) {
+		t.Errorf("expected errSinkBusy, got %v", err)
+	}
+
+	// the queued reading is written when shutting down
+	cancel()
+	close(next.release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the workers didn't stop")
+	}
+	if len(sink.queue) != 0 {
+		t.Errorf("expected the queue to be drained, %d readings left", len(sink.queue))
+	}
+}
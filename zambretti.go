@@ -0,0 +1,102 @@
+package main
+
+import "time"
+
+// The range of pressures, in hPa, covered by the Zambretti forecaster.
+const (
+	zambrettiBottom = 950.0
+	zambrettiTop    = 1050.0
+)
+
+var zambrettiForecasts = []string{
+	"Settled fine",
+	"Fine weather",
+	"Becoming fine",
+	"Fine, becoming less settled",
+	"Fine, possible showers",
+	"Fairly fine, improving",
+	"Fairly fine, possible showers early",
+	"Fairly fine, showery later",
+	"Showery early, improving",
+	"Changeable, mending",
+	"Fairly fine, showers likely",
+	"Rather unsettled clearing later",
+	"Unsettled, probably improving",
+	"Showery, bright intervals",
+	"Showery, becoming less settled",
+	"Changeable, some rain",
+	"Unsettled, short fine intervals",
+	"Unsettled, rain later",
+	"Unsettled, some rain",
+	"Mostly very unsettled",
+	"Occasional rain, worsening",
+	"Rain at times, very unsettled",
+	"Rain at frequent intervals",
+	"Rain, very unsettled",
+	"Stormy, may improve",
+	"Stormy, much rain",
+}
+
+// The forecast for each of the 22 pressure bands, from the lowest, by tendency.
+var (
+	zambrettiRising  = []int{25, 25, 25, 24, 24, 19, 16, 12, 11, 9, 8, 6, 5, 2, 1, 1, 0, 0, 0, 0, 0, 0}
+	zambrettiSteady  = []int{25, 25, 25, 25, 25, 25, 23, 23, 22, 18, 15, 13, 10, 4, 1, 1, 0, 0, 0, 0, 0, 0}
+	zambrettiFalling = []int{25, 25, 25, 25, 25, 25, 25, 25, 23, 23, 21, 20, 17, 14, 7, 3, 1, 1, 1, 0, 0, 0}
+)
+
+// zambrettiWind is the pressure adjustment, in percent of the range, for the
+// wind directions in the northern hemisphere, in the order of WindDirections.
+var zambrettiWind = []float64{6, 5, 5, 2, -0.5, -2, -5, -8.5, -12, -10, -6, -4.5, -3, -0.5, 1.5, 3}
+
+// zambretti returns the Zambretti forecast for the relative pressure (hPa), its
+// tendency, the wind and the season of t, following the Beteljuice variant of
+// the algorithm. The wind direction is ignored when the wind is calm.
+func zambretti(pressure float64, tendency string, windDir int, windSpeed float64, t time.Time, southern bool) string {
+	const bandWidth = (zambrettiTop - zambrettiBottom) / 22
+
+	if windSpeed > 0 {
+		idx := int(float64(windDir%360)/22.5+0.5) % len(zambrettiWind)
+		if southern {
+			// the adjustments are mirrored, e.g. southerly winds bring
+			// fair weather
+			idx = (idx + len(zambrettiWind)/2) % len(zambrettiWind)
+		}
+		pressure += zambrettiWind[idx] / 100 * (zambrettiTop - zambrettiBottom)
+	}
+
+	summer := t.Month() >= time.April && t.Month() <= time.September
+	if southern {
+		summer = !summer
+	}
+	if summer {
+		switch tendency {
+		case tendencyRising:
+			pressure += 7.0 / 100 * (zambrettiTop - zambrettiBottom)
+		case tendencyFalling:
+			pressure -= 7.0 / 100 * (zambrettiTop - zambrettiBottom)
+		}
+	}
+
+	var prefix string
+	band := int((pressure - zambrettiBottom) / bandWidth)
+	if pressure < zambrettiBottom {
+		band = 0
+		prefix = "Exceptional weather, "
+	}
+	if band > 21 {
+		band = 21
+		prefix = "Exceptional weather, "
+	}
+
+	var options []int
+	switch tendency {
+	case tendencyRising:
+		options = zambrettiRising
+	case tendencyFalling:
+		options = zambrettiFalling
+	default:
+		options = zambrettiSteady
+	}
+
+	return prefix + zambrettiForecasts[options[band]]
+}
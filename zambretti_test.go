@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestZambretti(t *testing.T) {
+	winter := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	summer := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		pressure  float64
+		tendency  string
+		windDir   int
+		windSpeed float64
+		t         time.Time
+		southern  bool
+		want      string
+	}{
+		{"high and steady", 1030, tendencySteady, 0, 3, winter, false, "Settled fine"},
+		{"low and falling, southerly wind", 1000, tendencyFalling, 180, 5, winter, false, "Rain, very unsettled"},
+		{"rising in summer, westerly wind", 1015, tendencyRising, 270, 2, summer, false, "Fine weather"},
+		{"steady and calm", 1010, tendencySteady, 180, 0, winter, false, "Fine, possible showers"},
+		{"southern hemisphere, southerly wind", 1000, tendencyFalling, 180, 5, summer, true, "Unsettled, rain later"},
+		{"exceptionally low", 940, tendencyFalling, 0, 0, winter, false, "Exceptional weather, Stormy, much rain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := zambretti(tt.pressure, tt.tendency, tt.windDir, tt.windSpeed, tt.t, tt.southern)
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}